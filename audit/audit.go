@@ -0,0 +1,275 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/blueskan/harpocrates/service"
+)
+
+const DEFAULT_AUDIT_FILE_NAME = "harpocrates_audit.log"
+
+// Outcomes of an event, refusals are recorded with their message type.
+const OUTCOME_OK = "OK"
+const OUTCOME_BANNED = "BANNED"
+
+// OPERATION_BAN records an address banned after failed logins.
+const OPERATION_BAN = "BAN"
+
+const maxLineSize = 1 << 20
+
+var ErrChainBroken = errors.New("audit log was changed")
+
+// Event is a line of the audit log. Prev is the Hash of the event before,
+// Hash covers the event with Prev, so a changed or removed event breaks the
+// chain of all events after it.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Address     string    `json:"address,omitempty"`
+	Certificate string    `json:"certificate,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Operation   string    `json:"operation"`
+	Outcome     string    `json:"outcome"`
+	Detail      string    `json:"detail,omitempty"`
+	Prev        string    `json:"prev"`
+	Hash        string    `json:"hash"`
+}
+
+// ChainError tells where the chain of an audit log breaks.
+type ChainError struct {
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%s: line %d: %s", ErrChainBroken, e.Line, e.Reason)
+}
+
+func (e *ChainError) Unwrap() error {
+	return ErrChainBroken
+}
+
+type Log interface {
+	// Record appends the event, its Time, Prev and Hash are set by the log.
+	Record(event Event) error
+}
+
+// fileLog appends to a file of JSON lines. Another process writing the file is
+// noticed by its size, the head of the chain is read again then.
+type fileLog struct {
+	location string
+	mutex    sync.Mutex
+	head     string
+	size     int64
+	now      func() time.Time
+}
+
+// NewLog returns the audit log kept in location, an empty location means
+// `harpocrates_audit.log` in the home directory.
+func NewLog(location string) Log {
+	return &fileLog{
+		location: Location(location),
+		size:     -1,
+		now:      time.Now,
+	}
+}
+
+func Location(location string) string {
+	if len(location) > 0 {
+		return location
+	}
+
+	homeDir, _ := os.UserHomeDir()
+
+	return filepath.Join(homeDir, DEFAULT_AUDIT_FILE_NAME)
+}
+
+func (l *fileLog) Record(event Event) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	unlock, err := service.LockFile(l.location + ".lock")
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	file, err := os.OpenFile(l.location, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != l.size {
+		if l.head, err = head(file); err != nil {
+			return err
+		}
+	}
+
+	event.Time = l.now().UTC()
+	event.Prev = l.head
+	event.Hash = ""
+
+	if event.Hash, err = hash(&event); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&event)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := file.Write(append(b, '\n'))
+
+	if err != nil {
+		l.size = -1
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		l.size = -1
+		return err
+	}
+
+	l.head = event.Hash
+	l.size = info.Size() + int64(n)
+
+	return nil
+}
+
+// head returns the hash of the last event of the file.
+func head(file *os.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	last := ""
+
+	err := scan(file, func(line int, event *Event) error {
+		last = event.Hash
+		return nil
+	})
+
+	return last, err
+}
+
+func hash(event *Event) (string, error) {
+	hashed := *event
+	hashed.Hash = ""
+
+	b, err := json.Marshal(&hashed)
+
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func scan(r io.Reader, f func(line int, event *Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		event := new(Event)
+
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			return &ChainError{Line: line, Reason: "not an event"}
+		}
+
+		if err := f(line, event); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Verify checks the chain of the audit log in location and returns the
+// number of events and the hash of the last one. Removing the newest events
+// keeps the chain intact, compare the hash with one noted earlier to find
+// that out.
+func Verify(location string) (int, string, error) {
+	file, err := os.Open(Location(location))
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer file.Close()
+
+	count := 0
+	prev := ""
+
+	err = scan(file, func(line int, event *Event) error {
+		if event.Prev != prev {
+			return &ChainError{Line: line, Reason: "previous event is missing"}
+		}
+
+		sum, err := hash(event)
+
+		if err != nil {
+			return err
+		}
+
+		if sum != event.Hash {
+			return &ChainError{Line: line, Reason: "event was modified"}
+		}
+
+		count++
+		prev = event.Hash
+
+		return nil
+	})
+
+	return count, prev, err
+}
+
+// Read returns the events of the audit log in location from since on.
+func Read(location string, since time.Time) ([]Event, error) {
+	file, err := os.Open(Location(location))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	events := make([]Event, 0)
+
+	err = scan(file, func(line int, event *Event) error {
+		if !event.Time.Before(since) {
+			events = append(events, *event)
+		}
+
+		return nil
+	})
+
+	return events, err
+}
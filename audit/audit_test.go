@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_it_should_detect_removed_and_modified_events(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "audit.log")
+	log := NewLog(location)
+
+	for _, operation := range []string{"SRP_PROOF", "GET_PRIVATE_KEY", "LOGOUT"} {
+		if err := log.Record(Event{Address: "203.0.113.7", User: "alice", Operation: operation, Outcome: OUTCOME_OK}); err != nil {
+			t.Fatalf("Event could not be recorded: %s", err)
+		}
+	}
+
+	// A second log of the same file continues the chain.
+	if err := NewLog(location).Record(Event{Operation: OPERATION_BAN, Outcome: OUTCOME_BANNED}); err != nil {
+		t.Fatalf("Event could not be recorded: %s", err)
+	}
+
+	count, _, err := Verify(location)
+
+	if err != nil || count != 4 {
+		t.Fatalf("Verification was incorrect, got: %d, %v, want: %d", count, err, 4)
+	}
+
+	b, _ := ioutil.ReadFile(location)
+	lines := strings.SplitAfter(string(b), "\n")
+
+	ioutil.WriteFile(location, []byte(lines[0]+lines[2]+lines[3]), 0600)
+
+	var chainError *ChainError
+
+	if _, _, err := Verify(location); !errors.As(err, &chainError) || chainError.Line != 2 {
+		t.Errorf("Removed event was incorrect, got: %v, want line: %d", err, 2)
+	}
+
+	ioutil.WriteFile(location, []byte(lines[0]+strings.Replace(lines[1], "alice", "mallory", 1)+lines[2]), 0600)
+
+	if _, _, err := Verify(location); !errors.As(err, &chainError) || chainError.Line != 2 {
+		t.Errorf("Modified event was incorrect, got: %v, want line: %d", err, 2)
+	}
+}
+
+func Test_it_should_read_events_since(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "audit.log")
+	now := time.Now()
+
+	log := NewLog(location).(*fileLog)
+	log.now = func() time.Time {
+		return now
+	}
+
+	log.Record(Event{Operation: "SRP_PROOF", Outcome: "WRONG_CREDENTIALS"})
+
+	now = now.Add(time.Hour)
+	log.Record(Event{Operation: "SRP_PROOF", Outcome: OUTCOME_OK})
+
+	events, err := Read(location, now.Add(-time.Minute))
+
+	if err != nil || len(events) != 1 || events[0].Outcome != OUTCOME_OK {
+		t.Errorf("Events were incorrect, got: %v, %v, want: %s", events, err, OUTCOME_OK)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blueskan/harpocrates/audit"
+	"github.com/blueskan/harpocrates/server"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/spf13/cobra"
+)
+
+var auditFile string
+var auditSince string
+
+func auditCommand() *cobra.Command {
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Read the audit log of the server",
+	}
+
+	auditCmd.PersistentFlags().StringVar(&auditFile, "file", "", "file of the audit log, defaults to audit_file of the server settings")
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that no event of the audit log was changed or removed",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			count, head, err := audit.Verify(auditLocation())
+			exitOnError(err)
+
+			fmt.Printf("%d events verified, last hash %s\n", count, head)
+		},
+	}
+
+	tailCmd := &cobra.Command{
+		Use:   "tail",
+		Short: "Print the events of the audit log",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			since, err := parseSince(auditSince)
+			exitOnError(err)
+
+			events, err := audit.Read(auditLocation(), since)
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(events)
+				return
+			}
+
+			for _, event := range events {
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", event.Time.Local().Format(time.RFC3339), event.Address, event.User, event.Operation, event.Outcome, event.Detail)
+			}
+		},
+	}
+
+	tailCmd.Flags().StringVar(&auditSince, "since", "24h", "print the events of this long ago like 1h, or since a time like 2006-01-02T15:04:05Z")
+	tailCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the events as JSON")
+
+	auditCmd.AddCommand(verifyCmd, tailCmd)
+
+	return auditCmd
+}
+
+func auditLocation() string {
+	if len(auditFile) > 0 {
+		return auditFile
+	}
+
+	settings := server.ServerSettings(service.NewStorage("", settingsLocation, "server").ReadSettings(), nil)
+
+	return audit.Location(settings[server.SETTING_AUDIT_FILE])
+}
+
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+
+	if err != nil {
+		return t, fmt.Errorf("since should be a duration like 1h or a time like 2006-01-02T15:04:05Z, got: %s", since)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,361 @@
+package bans
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/vmihailenco/msgpack"
+)
+
+const DEFAULT_BANS_FILE_NAME = "harpocrates_bans.db"
+
+var ErrInvalidAddress = errors.New("address should be an IP address or a subnet like 203.0.113.0/24")
+var ErrNotBanned = errors.New("address has no failed logins")
+
+// Policy decides when an address is banned. After MaxFailures failed logins
+// within FindTime the address is banned for BanTime, every further failure
+// multiplies the ban by Backoff up to MaxBanTime. Addresses are grouped by
+// IPv4Prefix and IPv6Prefix bits, so a /24 or /64 is banned as a whole, and
+// addresses in AllowList are never banned.
+type Policy struct {
+	MaxFailures int
+	FindTime    time.Duration
+	BanTime     time.Duration
+	Backoff     float64
+	MaxBanTime  time.Duration
+	IPv4Prefix  int
+	IPv6Prefix  int
+	AllowList   []*net.IPNet
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxFailures: 3,
+		FindTime:    10 * time.Minute,
+		BanTime:     time.Minute,
+		Backoff:     2,
+		MaxBanTime:  24 * time.Hour,
+		IPv4Prefix:  32,
+		IPv6Prefix:  128,
+	}
+}
+
+// Ban holds the failed logins of an address or subnet.
+type Ban struct {
+	Address     string    `json:"address"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+func (b *Ban) Banned(now time.Time) bool {
+	return b.BannedUntil.After(now)
+}
+
+type Store interface {
+	// Banned returns until when the address is banned.
+	Banned(ip net.IP) (time.Time, bool, error)
+	// Fail records a failed login of the address.
+	Fail(ip net.IP) (Ban, error)
+	// Succeed forgets the failed logins of the address.
+	Succeed(ip net.IP) error
+	List() ([]Ban, error)
+	// Unban forgets the failed logins of an address or subnet.
+	Unban(address string) error
+}
+
+// store keeps the bans in a file, so they survive restarts and the admin
+// commands of another process change the bans of a running server. The file
+// is read again whenever it changed.
+type store struct {
+	location string
+	policy   Policy
+	mutex    sync.Mutex
+	bans     map[string]Ban
+	modTime  time.Time
+	now      func() time.Time
+}
+
+// NewStore returns the bans kept in location, an empty location means
+// `harpocrates_bans.db` in the home directory.
+func NewStore(location string, policy Policy) Store {
+	if len(location) <= 0 {
+		homeDir, _ := os.UserHomeDir()
+		location = filepath.Join(homeDir, DEFAULT_BANS_FILE_NAME)
+	}
+
+	return &store{
+		location: location,
+		policy:   policy,
+		bans:     make(map[string]Ban),
+		now:      time.Now,
+	}
+}
+
+func (s *store) Banned(ip net.IP) (time.Time, bool, error) {
+	if s.allowed(ip) {
+		return time.Time{}, false, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return time.Time{}, false, err
+	}
+
+	ban, ok := s.bans[s.key(ip)]
+
+	if !ok || !ban.Banned(s.now()) {
+		return time.Time{}, false, nil
+	}
+
+	return ban.BannedUntil, true, nil
+}
+
+func (s *store) Fail(ip net.IP) (Ban, error) {
+	if s.allowed(ip) {
+		return Ban{Address: ip.String()}, nil
+	}
+
+	var ban Ban
+
+	err := s.update(func(bans map[string]Ban, now time.Time) bool {
+		key := s.key(ip)
+		ban = bans[key]
+
+		// Failures older than FindTime are forgotten unless they still ban
+		// the address.
+		if now.Sub(ban.LastFailure) > s.policy.FindTime && !ban.Banned(now) {
+			ban = Ban{}
+		}
+
+		ban.Address = key
+		ban.Failures++
+		ban.LastFailure = now
+
+		if ban.Failures >= s.policy.MaxFailures {
+			ban.BannedUntil = now.Add(s.banTime(ban.Failures))
+		}
+
+		bans[key] = ban
+
+		return true
+	})
+
+	return ban, err
+}
+
+func (s *store) Succeed(ip net.IP) error {
+	if s.allowed(ip) {
+		return nil
+	}
+
+	return s.update(func(bans map[string]Ban, now time.Time) bool {
+		key := s.key(ip)
+
+		if _, ok := bans[key]; !ok {
+			return false
+		}
+
+		delete(bans, key)
+
+		return true
+	})
+}
+
+func (s *store) List() ([]Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Ban, 0, len(s.bans))
+
+	for _, ban := range s.bans {
+		list = append(list, ban)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+
+	return list, nil
+}
+
+func (s *store) Unban(address string) error {
+	key, err := s.parse(address)
+
+	if err != nil {
+		return err
+	}
+
+	found := false
+
+	err = s.update(func(bans map[string]Ban, now time.Time) bool {
+		_, found = bans[key]
+		delete(bans, key)
+
+		return found
+	})
+
+	if err == nil && !found {
+		return ErrNotBanned
+	}
+
+	return err
+}
+
+// banTime doubles (by default) the ban for every failure after MaxFailures.
+func (s *store) banTime(failures int) time.Duration {
+	banTime := float64(s.policy.BanTime) * math.Pow(s.policy.Backoff, float64(failures-s.policy.MaxFailures))
+
+	if banTime > float64(s.policy.MaxBanTime) {
+		return s.policy.MaxBanTime
+	}
+
+	return time.Duration(banTime)
+}
+
+func (s *store) allowed(ip net.IP) bool {
+	for _, network := range s.policy.AllowList {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// key returns the address, or its subnet when the policy groups addresses.
+func (s *store) key(ip net.IP) string {
+	bits, prefix := 128, s.policy.IPv6Prefix
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 32, s.policy.IPv4Prefix
+	}
+
+	if prefix <= 0 || prefix >= bits {
+		return ip.String()
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func (s *store) parse(address string) (string, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		return s.key(ip), nil
+	}
+
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		if ones, bits := network.Mask.Size(); ones == bits {
+			return network.IP.String(), nil
+		}
+
+		return network.String(), nil
+	}
+
+	return "", ErrInvalidAddress
+}
+
+// update applies fn to the bans while holding the lock of the file and
+// writes them when fn changed them. Expired bans are dropped on the way.
+func (s *store) update(fn func(bans map[string]Ban, now time.Time) bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.location), 0700); err != nil {
+		return err
+	}
+
+	unlock, err := service.LockFile(s.location + ".lock")
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	now := s.now()
+	changed := fn(s.bans, now)
+
+	for key, ban := range s.bans {
+		if !ban.Banned(now) && now.Sub(ban.LastFailure) > s.policy.FindTime {
+			delete(s.bans, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	b, err := msgpack.Marshal(s.bans)
+
+	if err != nil {
+		return err
+	}
+
+	if err := service.WriteFileAtomic(s.location, b); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.location); err == nil {
+		s.modTime = info.ModTime()
+	}
+
+	return nil
+}
+
+// load reads the file unless it is unchanged since the last read.
+func (s *store) load() error {
+	info, err := os.Stat(s.location)
+
+	if os.IsNotExist(err) {
+		s.bans = make(map[string]Ban)
+		s.modTime = time.Time{}
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.location)
+
+	if err != nil {
+		return err
+	}
+
+	bans := make(map[string]Ban)
+
+	if err := msgpack.Unmarshal(b, &bans); err != nil {
+		return err
+	}
+
+	s.bans = bans
+	s.modTime = info.ModTime()
+
+	return nil
+}
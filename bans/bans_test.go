@@ -0,0 +1,109 @@
+package bans
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, location string, policy Policy, now *time.Time) *store {
+	s := NewStore(location, policy).(*store)
+	s.now = func() time.Time {
+		return *now
+	}
+
+	return s
+}
+
+func Test_it_should_ban_subnet_with_backoff_across_restarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "bans.db")
+	policy := DefaultPolicy()
+	policy.IPv4Prefix = 24
+	now := time.Now()
+
+	s := newTestStore(t, location, policy, &now)
+
+	for i := 0; i < policy.MaxFailures; i++ {
+		if _, err := s.Fail(net.ParseIP("203.0.113.7")); err != nil {
+			t.Fatalf("Failure could not be recorded: %s", err)
+		}
+	}
+
+	// Another address of the subnet is banned by the failures, the ban is
+	// kept by a new store like after a restart.
+	s = newTestStore(t, location, policy, &now)
+
+	until, banned, err := s.Banned(net.ParseIP("203.0.113.99"))
+
+	if err != nil || !banned || !until.Equal(now.Add(policy.BanTime)) {
+		t.Errorf("Ban was incorrect, got: %v, %v, %v, want: %v", until, banned, err, now.Add(policy.BanTime))
+	}
+
+	ban, _ := s.Fail(net.ParseIP("203.0.113.7"))
+
+	if want := now.Add(2 * policy.BanTime); !ban.BannedUntil.Equal(want) {
+		t.Errorf("Backoff was incorrect, got: %v, want: %v", ban.BannedUntil, want)
+	}
+
+	if _, banned, _ := s.Banned(net.ParseIP("203.0.114.7")); banned {
+		t.Errorf("Address of another subnet was banned")
+	}
+
+	if err := s.Unban("203.0.113.0/24"); err != nil {
+		t.Fatalf("Subnet could not be unbanned: %s", err)
+	}
+
+	if _, banned, _ := s.Banned(net.ParseIP("203.0.113.7")); banned {
+		t.Errorf("Unbanned address was still banned")
+	}
+}
+
+func Test_it_should_never_ban_allowed_addresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+
+	policy := DefaultPolicy()
+	policy.AllowList = []*net.IPNet{network}
+	now := time.Now()
+
+	s := newTestStore(t, filepath.Join(dir, "bans.db"), policy, &now)
+
+	for i := 0; i < policy.MaxFailures+1; i++ {
+		s.Fail(net.ParseIP("10.1.2.3"))
+		s.Fail(net.ParseIP("::1"))
+	}
+
+	if _, banned, _ := s.Banned(net.ParseIP("10.1.2.3")); banned {
+		t.Errorf("Allowed address was banned")
+	}
+
+	if _, banned, _ := s.Banned(net.ParseIP("::1")); !banned {
+		t.Errorf("Address was not banned")
+	}
+
+	// The failures are forgotten once the ban and FindTime are over.
+	now = now.Add(policy.MaxBanTime + policy.FindTime + time.Second)
+	s.Fail(net.ParseIP("::1"))
+
+	if list, _ := s.List(); len(list) != 1 || list[0].Failures != 1 {
+		t.Errorf("Failures were incorrect, got: %v, want: %d", list, 1)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blueskan/harpocrates/bans"
+	"github.com/blueskan/harpocrates/server"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/spf13/cobra"
+)
+
+var bansFile string
+
+func bansCommand() *cobra.Command {
+	bansCmd := &cobra.Command{
+		Use:   "bans",
+		Short: "Manage the addresses banned after failed logins",
+	}
+
+	bansCmd.PersistentFlags().StringVar(&bansFile, "file", "", "file of the bans, defaults to ban_file of the server settings")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the addresses with failed logins",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			list, err := banStore().List()
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(list)
+				return
+			}
+
+			now := time.Now()
+
+			for _, ban := range list {
+				status := "watched"
+				if ban.Banned(now) {
+					status = "banned until " + ban.BannedUntil.Format(time.RFC3339)
+				}
+
+				fmt.Printf("%s\t%d\t%s\t%s\n", ban.Address, ban.Failures, ban.LastFailure.Format(time.RFC3339), status)
+			}
+		},
+	}
+
+	listCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the bans as JSON")
+
+	unbanCmd := &cobra.Command{
+		Use:   "unban <address>",
+		Short: "Forget the failed logins of an address or subnet, a running server applies it at once",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(banStore().Unban(args[0]))
+
+			fmt.Printf("Address `%s` unbanned\n", args[0])
+		},
+	}
+
+	bansCmd.AddCommand(listCmd, unbanCmd)
+
+	return bansCmd
+}
+
+func banStore() bans.Store {
+	settings := server.ServerSettings(service.NewStorage("", settingsLocation, "server").ReadSettings(), nil)
+
+	if len(bansFile) > 0 {
+		settings[server.SETTING_BAN_FILE] = bansFile
+	}
+
+	store, err := server.NewBanStore(settings)
+	exitOnError(err)
+
+	return store
+}
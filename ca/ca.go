@@ -0,0 +1,401 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const CA_CERTIFICATE_NAME = "ca.pem"
+const CA_KEY_NAME = "ca.key"
+const CRL_NAME = "crl.pem"
+const ISSUED_DIRECTORY_NAME = "issued"
+
+const DEFAULT_CA_DIRECTORY_NAME = "harpocrates_ca"
+const DEFAULT_CA_VALIDITY = 10 * 365 * 24 * time.Hour
+const DEFAULT_CERTIFICATE_VALIDITY = 2 * 365 * 24 * time.Hour
+const DEFAULT_CRL_VALIDITY = 180 * 24 * time.Hour
+
+var ErrNotInitialized = errors.New("certificate authority is not initialized, run `harpocrates ca init` first")
+var ErrAlreadyInitialized = errors.New("certificate authority already exists")
+var ErrUnknownCertificate = errors.New("certificate was not issued by this authority")
+
+type IssuedCertificate struct {
+	Certificate *x509.Certificate
+	Revoked     bool
+}
+
+type Authority interface {
+	Init(commonName string) error
+	IssueServer(commonName string, hosts []string) (certPem, keyPem []byte, err error)
+	IssueClient(commonName string) (certPem, keyPem []byte, err error)
+	Revoke(serial *big.Int) error
+	RefreshCrl() error
+	List() ([]IssuedCertificate, error)
+
+	CertificateLocation() string
+	CrlLocation() string
+}
+
+type authority struct {
+	directory string
+}
+
+// NewAuthority returns the certificate authority kept in directory, an empty
+// directory means `harpocrates_ca` in the home directory.
+func NewAuthority(directory string) Authority {
+	if len(directory) <= 0 {
+		homeDir, _ := os.UserHomeDir()
+		directory = filepath.Join(homeDir, DEFAULT_CA_DIRECTORY_NAME)
+	}
+
+	return &authority{
+		directory: directory,
+	}
+}
+
+func (a *authority) CertificateLocation() string {
+	return filepath.Join(a.directory, CA_CERTIFICATE_NAME)
+}
+
+func (a *authority) CrlLocation() string {
+	return filepath.Join(a.directory, CRL_NAME)
+}
+
+func (a *authority) Init(commonName string) error {
+	if _, err := os.Stat(a.CertificateLocation()); err == nil {
+		return ErrAlreadyInitialized
+	}
+
+	if err := os.MkdirAll(filepath.Join(a.directory, ISSUED_DIRECTORY_NAME), 0700); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Harpocrates"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(DEFAULT_CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyPem, err := privateKeyToPem(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(a.directory, CA_KEY_NAME), keyPem, 0600); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(a.CertificateLocation(), certificateToPem(der), 0644); err != nil {
+		return err
+	}
+
+	return a.RefreshCrl()
+}
+
+func (a *authority) IssueServer(commonName string, hosts []string) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName, Organization: []string{"Harpocrates"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if len(host) > 0 {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return a.issue(template)
+}
+
+func (a *authority) IssueClient(commonName string) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName, Organization: []string{"Harpocrates"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	return a.issue(template)
+}
+
+func (a *authority) Revoke(serial *big.Int) error {
+	if _, err := os.Stat(a.issuedLocation(serial)); err != nil {
+		return ErrUnknownCertificate
+	}
+
+	revoked, err := a.revokedSerials()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range revoked {
+		if entry.SerialNumber.Cmp(serial) == 0 {
+			return nil
+		}
+	}
+
+	revoked = append(revoked, x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: time.Now(),
+	})
+
+	return a.writeCrl(revoked)
+}
+
+// RefreshCrl signs the current revocation list again with a new validity
+// window, the server refuses clients once the list has expired.
+func (a *authority) RefreshCrl() error {
+	revoked, err := a.revokedSerials()
+	if err != nil {
+		return err
+	}
+
+	return a.writeCrl(revoked)
+}
+
+func (a *authority) List() ([]IssuedCertificate, error) {
+	files, err := ioutil.ReadDir(filepath.Join(a.directory, ISSUED_DIRECTORY_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotInitialized
+		}
+
+		return nil, err
+	}
+
+	revoked, err := a.revokedSerials()
+	if err != nil {
+		return nil, err
+	}
+
+	issued := make([]IssuedCertificate, 0)
+
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(filepath.Join(a.directory, ISSUED_DIRECTORY_NAME, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := ParseCertificate(bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		isRevoked := false
+		for _, entry := range revoked {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				isRevoked = true
+			}
+		}
+
+		issued = append(issued, IssuedCertificate{
+			Certificate: cert,
+			Revoked:     isRevoked,
+		})
+	}
+
+	sort.Slice(issued, func(i, j int) bool {
+		return issued[i].Certificate.NotBefore.Before(issued[j].Certificate.NotBefore)
+	})
+
+	return issued, nil
+}
+
+func (a *authority) issue(template *x509.Certificate) ([]byte, []byte, error) {
+	caCert, caKey, err := a.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.SerialNumber, err = newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template.NotBefore = now.Add(-time.Hour)
+	template.NotAfter = now.Add(DEFAULT_CERTIFICATE_VALIDITY)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPem := certificateToPem(der)
+
+	if err := ioutil.WriteFile(a.issuedLocation(template.SerialNumber), certPem, 0644); err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := privateKeyToPem(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certPem, keyPem, nil
+}
+
+func (a *authority) load() (*x509.Certificate, crypto.Signer, error) {
+	certPem, err := ioutil.ReadFile(a.CertificateLocation())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotInitialized
+		}
+
+		return nil, nil, err
+	}
+
+	cert, err := ParseCertificate(certPem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := ioutil.ReadFile(filepath.Join(a.directory, CA_KEY_NAME))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM block found in %s", CA_KEY_NAME)
+	}
+
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func (a *authority) revokedSerials() ([]x509.RevocationListEntry, error) {
+	bytes, err := ioutil.ReadFile(a.CrlLocation())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []x509.RevocationListEntry{}, nil
+		}
+
+		return nil, err
+	}
+
+	crl, err := ParseCrl(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return crl.RevokedCertificateEntries, nil
+}
+
+func (a *authority) writeCrl(revoked []x509.RevocationListEntry) error {
+	caCert, caKey, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(DEFAULT_CRL_VALIDITY),
+		RevokedCertificateEntries: revoked,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(a.CrlLocation(), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+func (a *authority) issuedLocation(serial *big.Int) string {
+	return filepath.Join(a.directory, ISSUED_DIRECTORY_NAME, strings.ToLower(serial.Text(16))+".pem")
+}
+
+// ParseSerial accepts a serial number in hex, as printed by `ca list`.
+func ParseSerial(serial string) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(serial), "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number `%s`", serial)
+	}
+
+	return value, nil
+}
+
+func ParseCertificate(bytes []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(bytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate PEM block found")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func ParseCrl(bytes []byte) (*x509.RevocationList, error) {
+	block, _ := pem.Decode(bytes)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, errors.New("no CRL PEM block found")
+	}
+
+	return x509.ParseRevocationList(block.Bytes)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func certificateToPem(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func privateKeyToPem(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,53 @@
+package ca
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func Test_it_should_issue_client_certificate_signed_by_authority(t *testing.T) {
+	sut := NewAuthority(t.TempDir())
+
+	if err := sut.Init("Test CA"); err != nil {
+		t.Fatalf("Authority could not be initialized: %s", err)
+	}
+
+	certPem, _, err := sut.IssueClient("laptop")
+
+	if err != nil {
+		t.Fatalf("Client certificate could not be issued: %s", err)
+	}
+
+	cert, _ := ParseCertificate(certPem)
+	caCert, _, _ := sut.(*authority).load()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	if err != nil {
+		t.Errorf("Client certificate was not verified by authority: %s", err)
+	}
+}
+
+func Test_it_should_list_revoked_certificate_in_crl(t *testing.T) {
+	sut := NewAuthority(t.TempDir())
+	sut.Init("Test CA")
+
+	certPem, _, _ := sut.IssueClient("laptop")
+	cert, _ := ParseCertificate(certPem)
+
+	if err := sut.Revoke(cert.SerialNumber); err != nil {
+		t.Fatalf("Certificate could not be revoked: %s", err)
+	}
+
+	issued, _ := sut.List()
+
+	if len(issued) != 1 || !issued[0].Revoked {
+		t.Errorf("Revoked certificate was not listed as revoked")
+	}
+}
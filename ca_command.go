@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blueskan/harpocrates/ca"
+	"github.com/blueskan/harpocrates/cli"
+	"github.com/blueskan/harpocrates/server"
+	"github.com/spf13/cobra"
+)
+
+var caDirectory string
+
+func caCommand() *cobra.Command {
+	caCmd := &cobra.Command{
+		Use:   "ca",
+		Short: "Manage the certificate authority of this install",
+	}
+
+	caCmd.PersistentFlags().StringVar(&caDirectory, "dir", "", "directory of the certificate authority")
+
+	var caCommonName string
+	var commonName string
+
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create the certificate authority of this install",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			authority := ca.NewAuthority(caDirectory)
+
+			exitOnError(authority.Init(caCommonName))
+
+			fmt.Printf("Certificate authority created: %s\n", authority.CertificateLocation())
+			fmt.Printf("Certificate revocation list: %s\n", authority.CrlLocation())
+		},
+	}
+
+	initCmd.Flags().StringVar(&caCommonName, "cn", "Harpocrates CA", "common name of the certificate authority")
+
+	var hosts string
+	var out string
+
+	issueServerCmd := &cobra.Command{
+		Use:   "issue-server",
+		Short: "Issue a server certificate",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(hosts) <= 0 {
+				exitOnError(fmt.Errorf("--host is required"))
+			}
+
+			hostList := strings.Split(hosts, ",")
+
+			if len(commonName) <= 0 {
+				commonName = hostList[0]
+			}
+
+			certPem, keyPem, err := ca.NewAuthority(caDirectory).IssueServer(commonName, hostList)
+			exitOnError(err)
+
+			writeIssued(out, commonName, certPem, keyPem)
+		},
+	}
+
+	issueServerCmd.Flags().StringVar(&commonName, "cn", "", "common name of the certificate, defaults to the first host")
+	issueServerCmd.Flags().StringVar(&hosts, "host", "", "comma separated host names and IP addresses of the server")
+	issueServerCmd.Flags().StringVar(&out, "out", "", "path prefix of the written .pem and .key files")
+
+	issueClientCmd := &cobra.Command{
+		Use:   "issue-client",
+		Short: "Issue a client certificate for a new device",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(commonName) <= 0 {
+				exitOnError(fmt.Errorf("--cn is required"))
+			}
+
+			certPem, keyPem, err := ca.NewAuthority(caDirectory).IssueClient(commonName)
+			exitOnError(err)
+
+			writeIssued(out, commonName, certPem, keyPem)
+		},
+	}
+
+	issueClientCmd.Flags().StringVar(&commonName, "cn", "", "common name of the certificate, usually the device name")
+	issueClientCmd.Flags().StringVar(&out, "out", "", "path prefix of the written .pem and .key files")
+
+	var serial string
+	var certificate string
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke an issued certificate and update the CRL",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			authority := ca.NewAuthority(caDirectory)
+
+			var serialNumber *big.Int
+			var err error
+
+			if len(certificate) > 0 {
+				bytes, err := ioutil.ReadFile(certificate)
+				exitOnError(err)
+
+				cert, err := ca.ParseCertificate(bytes)
+				exitOnError(err)
+
+				serialNumber = cert.SerialNumber
+			} else if len(serial) > 0 {
+				serialNumber, err = ca.ParseSerial(serial)
+				exitOnError(err)
+			} else {
+				exitOnError(fmt.Errorf("--serial or --cert is required"))
+			}
+
+			exitOnError(authority.Revoke(serialNumber))
+
+			fmt.Printf("Certificate %s revoked, CRL updated: %s\n", serialNumber.Text(16), authority.CrlLocation())
+		},
+	}
+
+	revokeCmd.Flags().StringVar(&serial, "serial", "", "serial number of the certificate to revoke")
+	revokeCmd.Flags().StringVar(&certificate, "cert", "", "certificate file to revoke")
+
+	crlCmd := &cobra.Command{
+		Use:   "crl",
+		Short: "Sign the CRL again before it expires",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			authority := ca.NewAuthority(caDirectory)
+
+			exitOnError(authority.RefreshCrl())
+
+			fmt.Printf("Certificate revocation list updated: %s\n", authority.CrlLocation())
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List issued certificates",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			issued, err := ca.NewAuthority(caDirectory).List()
+			exitOnError(err)
+
+			for _, entry := range issued {
+				status := "valid"
+				if entry.Revoked {
+					status = "revoked"
+				}
+
+				fmt.Printf("%s\t%s\t%s\t%s\n", entry.Certificate.SerialNumber.Text(16), entry.Certificate.Subject.CommonName, entry.Certificate.NotAfter.Format("2006-01-02"), status)
+			}
+		},
+	}
+
+	caCmd.AddCommand(initCmd, issueServerCmd, issueClientCmd, revokeCmd, crlCmd, listCmd)
+
+	return caCmd
+}
+
+func writeIssued(out, commonName string, certPem, keyPem []byte) {
+	if len(out) <= 0 {
+		out = commonName
+	}
+
+	exitOnError(ioutil.WriteFile(out+".pem", certPem, 0644))
+	exitOnError(ioutil.WriteFile(out+".key", keyPem, 0600))
+
+	fmt.Printf("Certificate written to %s.pem, key written to %s.key\n", out, out)
+}
+
+// setupServerCertificates runs on the first start of a server: it creates the
+// certificate authority, or uses the one in its directory, issues the server
+// certificate next to it and points the certificate settings at them.
+func setupServerCertificates(harpocratesCli *cli.Cli, settings map[string]string) {
+	directory := harpocratesCli.AskPath("Directory of the certificate authority (leave empty for ~/"+ca.DEFAULT_CA_DIRECTORY_NAME+")", "")
+
+	hostname, _ := os.Hostname()
+	hostList := make([]string, 0)
+
+	for _, host := range strings.Split(harpocratesCli.AskPath("Host names and addresses of the server, comma separated", hostname), ",") {
+		if host = strings.TrimSpace(host); len(host) > 0 {
+			hostList = append(hostList, host)
+		}
+	}
+
+	if len(hostList) <= 0 {
+		exitOnError(fmt.Errorf("the server certificate needs a host name"))
+	}
+
+	authority := ca.NewAuthority(directory)
+
+	if err := authority.Init("Harpocrates CA"); err != nil && err != ca.ErrAlreadyInitialized {
+		exitOnError(err)
+	}
+
+	certPem, keyPem, err := authority.IssueServer(hostList[0], hostList)
+	exitOnError(err)
+
+	out := filepath.Join(filepath.Dir(authority.CertificateLocation()), "server")
+	writeIssued(out, hostList[0], certPem, keyPem)
+
+	settings[server.SETTING_TLS_CERT] = out + ".pem"
+	settings[server.SETTING_TLS_KEY] = out + ".key"
+	settings[server.SETTING_TLS_CA] = authority.CertificateLocation()
+	settings[server.SETTING_TLS_CRL] = authority.CrlLocation()
+
+	caFlag := ""
+	if len(directory) > 0 {
+		caFlag = " --dir " + directory
+	}
+
+	fmt.Printf("Certificate authority: %s\n", authority.CertificateLocation())
+	fmt.Printf("Issue a certificate for every client device with `harpocrates ca%s issue-client --cn <device>`\n", caFlag)
+	fmt.Printf("and copy the .pem and .key files and %s to the device.\n", authority.CertificateLocation())
+}
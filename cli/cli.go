@@ -4,14 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
 	"github.com/manifoldco/promptui"
 	"github.com/olekukonko/tablewriter"
 )
 
 type Cli struct {
-	passwordService service.PasswordService
+	passwordService      service.PasswordService
+	sharedVaultTransport service.SharedVaultTransport
 }
 
 func NewCli() *Cli {
@@ -34,9 +39,15 @@ func (c *Cli) WelcomeMessage() {
 }
 
 func (c *Cli) Repl() {
+	items := []string{"Store Password", "Update Password", "Rename", "Delete Password", "Get Password", "Password History", "Restore Password", "List Passwords", "Export All Passwords to CSV"}
+
+	if c.sharedVaultTransport != nil {
+		items = append(items, "Shared Vaults")
+	}
+
 	prompt := promptui.Select{
 		Label: "Select Operation",
-		Items: []string{"Store Password", "Delete Password", "Get Password", "List Passwords", "Export All Passwords to CSV", "Exit"},
+		Items: append(items, "Exit"),
 	}
 
 	for {
@@ -49,11 +60,16 @@ func (c *Cli) Repl() {
 
 		switch result {
 		case "Store Password":
-			validateName := func(input string) error {
-				if len(input) <= 0 {
-					return errors.New("You should enter name")
-				}
+			err := c.storePassword(c.askPassword())
 
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			fmt.Println("Password successfully saved..")
+		case "Update Password":
+			validateName := func(input string) error {
 				return nil
 			}
 
@@ -64,44 +80,77 @@ func (c *Cli) Repl() {
 
 			resultName, _ := prompt.Run()
 
-			// Difference
+			current := c.findPassword(resultName)
 
-			validateUrl := func(input string) error {
-				return nil
+			if current == nil {
+				fmt.Println((&service.PasswordNotFoundError{Name: resultName}).Error())
+				break
 			}
 
 			prompt = promptui.Prompt{
-				Label:    "Url",
-				Validate: validateUrl,
+				Label:     "Url",
+				Default:   current.Url,
+				AllowEdit: true,
 			}
 
 			resultUrl, _ := prompt.Run()
 
-			// Difference
+			prompt = promptui.Prompt{
+				Label: "Password (leave empty to keep current)",
+				Mask:  '*',
+			}
+
+			resultPassword, _ := prompt.Run()
+
+			update := service.PasswordUpdate{}
+
+			if resultUrl != current.Url {
+				update.Url = &resultUrl
+			}
 
-			validatePassword := func(input string) error {
+			if len(resultPassword) > 0 {
+				update.Password = &resultPassword
+			}
+
+			err := c.updatePassword(resultName, update)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			fmt.Printf("Password named as `%s` updated successfully\n", resultName)
+		case "Rename":
+			validateName := func(input string) error {
 				if len(input) <= 0 {
-					return errors.New("You should enter password")
+					return errors.New("You should enter name")
 				}
 
 				return nil
 			}
 
+			prompt := promptui.Prompt{
+				Label:    "Name",
+				Validate: validateName,
+			}
+
+			resultName, _ := prompt.Run()
+
 			prompt = promptui.Prompt{
-				Label:    "Password",
-				Validate: validatePassword,
-				Mask:     '*',
+				Label:    "New Name",
+				Validate: validateName,
 			}
 
-			resultPassword, _ := prompt.Run()
+			resultNewName, _ := prompt.Run()
 
-			c.storePassword(&service.PasswordRepresentation{
-				Name:     resultName,
-				Url:      resultUrl,
-				Password: resultPassword,
-			})
+			err := c.renamePassword(resultName, resultNewName)
 
-			fmt.Println("Password successfully saved..")
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			fmt.Printf("Password named as `%s` renamed to `%s`\n", resultName, resultNewName)
 		case "Get Password":
 			validateName := func(input string) error {
 				return nil
@@ -121,18 +170,75 @@ func (c *Cli) Repl() {
 				break
 			}
 
-			data := [][]string{
-				[]string{passwordInformation.Name, passwordInformation.Url, passwordInformation.Password},
+			printPassword(passwordInformation)
+		case "Password History":
+			validateName := func(input string) error {
+				return nil
+			}
+
+			prompt := promptui.Prompt{
+				Label:    "Name",
+				Validate: validateName,
+			}
+
+			resultName, _ := prompt.Run()
+
+			versions, err := c.passwordHistory(resultName)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			if len(versions) <= 0 {
+				fmt.Printf("Password named as `%s` has no previous versions\n", resultName)
+				break
 			}
 
 			table := tablewriter.NewWriter(os.Stdout)
-			table.SetHeader([]string{"Name", "Url", "Password"})
+			table.SetHeader([]string{"Version", "Replaced At", "Password"})
 
-			for _, v := range data {
-				table.Append(v)
+			for _, v := range versions {
+				table.Append([]string{strconv.Itoa(v.Version), v.ReplacedAt.Format(time.RFC3339), v.Password})
 			}
 
 			table.Render()
+		case "Restore Password":
+			validateName := func(input string) error {
+				return nil
+			}
+
+			prompt := promptui.Prompt{
+				Label:    "Name",
+				Validate: validateName,
+			}
+
+			resultName, _ := prompt.Run()
+
+			validateVersion := func(input string) error {
+				if _, err := strconv.Atoi(input); err != nil {
+					return errors.New("You should enter version number")
+				}
+
+				return nil
+			}
+
+			prompt = promptui.Prompt{
+				Label:    "Version",
+				Validate: validateVersion,
+			}
+
+			resultVersion, _ := prompt.Run()
+			version, _ := strconv.Atoi(resultVersion)
+
+			err := c.restorePassword(resultName, version)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			fmt.Printf("Password named as `%s` restored to version %d\n", resultName, version)
 		case "Delete Password":
 			validateName := func(input string) error {
 				return nil
@@ -188,9 +294,16 @@ func (c *Cli) Repl() {
 
 			filename, _ := prompt.Run()
 
-			c.exportToCsv(filename)
+			err := c.exportToCsv(filename)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
 
 			fmt.Printf("All passwords saved to `%s`\n", filename)
+		case "Shared Vaults":
+			c.sharedVaultsRepl()
 		case "Exit":
 			fmt.Println("Goodbye :)")
 			os.Exit(0)
@@ -198,8 +311,187 @@ func (c *Cli) Repl() {
 	}
 }
 
-func (c *Cli) storePassword(representation *service.PasswordRepresentation) {
-	c.passwordService.StorePassword(*representation)
+// askPassword asks the fields of a new password.
+func (c *Cli) askPassword() *service.PasswordRepresentation {
+	typePrompt := promptui.Select{
+		Label: "Type",
+		Items: service.ENTRY_TYPES,
+	}
+
+	_, resultType, _ := typePrompt.Run()
+
+	validateName := func(input string) error {
+		if len(input) <= 0 {
+			return errors.New("You should enter name")
+		}
+
+		return nil
+	}
+
+	prompt := promptui.Prompt{
+		Label:    "Name",
+		Validate: validateName,
+	}
+
+	resultName, _ := prompt.Run()
+
+	prompt = promptui.Prompt{
+		Label: "Username",
+	}
+
+	resultUsername, _ := prompt.Run()
+
+	// Difference
+
+	validateUrl := func(input string) error {
+		return nil
+	}
+
+	prompt = promptui.Prompt{
+		Label:    "Url",
+		Validate: validateUrl,
+	}
+
+	resultUrl, _ := prompt.Run()
+
+	// Difference
+
+	validatePassword := func(input string) error {
+		if len(input) <= 0 && resultType != service.ENTRY_TYPE_NOTE {
+			return errors.New("You should enter password")
+		}
+
+		return nil
+	}
+
+	prompt = promptui.Prompt{
+		Label:    "Password",
+		Validate: validatePassword,
+		Mask:     '*',
+	}
+
+	resultPassword, _ := prompt.Run()
+
+	prompt = promptui.Prompt{
+		Label: "Notes",
+	}
+
+	resultNotes, _ := prompt.Run()
+
+	prompt = promptui.Prompt{
+		Label: "Tags (comma separated)",
+	}
+
+	resultTags, _ := prompt.Run()
+
+	return &service.PasswordRepresentation{
+		Name:     resultName,
+		Type:     resultType,
+		Url:      resultUrl,
+		Username: resultUsername,
+		Password: resultPassword,
+		Notes:    resultNotes,
+		Tags:     splitTags(resultTags),
+		Fields:   c.askCustomFields(),
+	}
+}
+
+func printPassword(passwordInformation *service.PasswordRepresentation) {
+	data := [][]string{
+		[]string{"Name", passwordInformation.Name},
+		[]string{"Type", passwordInformation.Type},
+		[]string{"Username", passwordInformation.Username},
+		[]string{"Url", passwordInformation.Url},
+		[]string{"Password", passwordInformation.Password},
+		[]string{"Notes", passwordInformation.Notes},
+		[]string{"Tags", strings.Join(passwordInformation.Tags, ", ")},
+	}
+
+	for _, field := range passwordInformation.Fields {
+		data = append(data, []string{field.Name, field.Value})
+	}
+
+	data = append(data,
+		[]string{"Created", formatTimestamp(passwordInformation.CreatedAt)},
+		[]string{"Modified", formatTimestamp(passwordInformation.ModifiedAt)},
+		[]string{"Accessed", formatTimestamp(passwordInformation.AccessedAt)},
+	)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Field", "Value"})
+	table.SetAutoWrapText(false)
+
+	for _, v := range data {
+		table.Append(v)
+	}
+
+	table.Render()
+}
+
+// askCustomFields asks custom fields until an empty name is entered.
+func (c *Cli) askCustomFields() []service.CustomFieldRepresentation {
+	fields := make([]service.CustomFieldRepresentation, 0)
+
+	for {
+		prompt := promptui.Prompt{
+			Label: "Custom field name (leave empty to finish)",
+		}
+
+		name, err := prompt.Run()
+
+		if err != nil || len(name) <= 0 {
+			return fields
+		}
+
+		secretPrompt := promptui.Select{
+			Label: "Is `" + name + "` secret",
+			Items: []string{"No", "Yes"},
+		}
+
+		_, secret, _ := secretPrompt.Run()
+
+		prompt = promptui.Prompt{
+			Label: name,
+		}
+
+		if secret == "Yes" {
+			prompt.Mask = '*'
+		}
+
+		value, _ := prompt.Run()
+
+		fields = append(fields, service.CustomFieldRepresentation{
+			Name:   name,
+			Value:  value,
+			Secret: secret == "Yes",
+		})
+	}
+}
+
+func splitTags(input string) []string {
+	tags := make([]string, 0)
+
+	for _, tag := range strings.Split(input, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func formatTimestamp(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func (c *Cli) storePassword(representation *service.PasswordRepresentation) error {
+	_, err := c.passwordService.StorePassword(*representation)
+
+	return err
 }
 
 func (c *Cli) listPasswords() []*service.PasswordRepresentation {
@@ -210,12 +502,40 @@ func (c *Cli) getPassword(name string) (*service.PasswordRepresentation, error)
 	return c.passwordService.GetPassword(name)
 }
 
+func (c *Cli) findPassword(name string) *service.PasswordRepresentation {
+	for _, val := range c.listPasswords() {
+		if val.Name == name {
+			return val
+		}
+	}
+
+	return nil
+}
+
+func (c *Cli) updatePassword(name string, update service.PasswordUpdate) error {
+	_, err := c.passwordService.UpdatePassword(name, update)
+
+	return err
+}
+
+func (c *Cli) passwordHistory(name string) ([]*service.PasswordVersionRepresentation, error) {
+	return c.passwordService.PasswordHistory(name)
+}
+
+func (c *Cli) restorePassword(name string, version int) error {
+	return c.passwordService.RestorePassword(name, version)
+}
+
+func (c *Cli) renamePassword(name, newName string) error {
+	return c.passwordService.RenamePassword(name, newName)
+}
+
 func (c *Cli) deletePassword(name string) error {
 	return c.passwordService.DeletePassword(name)
 }
 
-func (c *Cli) exportToCsv(filename string) {
-	c.passwordService.ExportToCsv(filename)
+func (c *Cli) exportToCsv(filename string) error {
+	return c.passwordService.ExportToCsv(filename)
 }
 
 func (c *Cli) AskEncryptionBits() string {
@@ -259,6 +579,22 @@ func (c *Cli) AskMasterPassword() string {
 	return result
 }
 
+func (c *Cli) AskUsername() string {
+	prompt := promptui.Prompt{
+		Label:    "Choose your username on the server",
+		Validate: users.ValidateUsername,
+	}
+
+	result, err := prompt.Run()
+
+	if err != nil {
+		fmt.Printf("Prompt failed %v\n", err)
+		return ""
+	}
+
+	return result
+}
+
 func (c *Cli) AskServerPort() string {
 	validate := func(input string) error {
 		return nil
@@ -299,6 +635,42 @@ func (c *Cli) AskServerAddr() string {
 	return result
 }
 
+func (c *Cli) AskSecret(label string) string {
+	prompt := promptui.Prompt{
+		Label: label,
+		Mask:  '*',
+	}
+
+	result, err := prompt.Run()
+
+	if err != nil {
+		fmt.Printf("Prompt failed %v\n", err)
+		return ""
+	}
+
+	return result
+}
+
+func (c *Cli) AskPath(label, defaultValue string) string {
+	prompt := promptui.Prompt{
+		Label:   label,
+		Default: defaultValue,
+	}
+
+	result, err := prompt.Run()
+
+	if err != nil {
+		fmt.Printf("Prompt failed %v\n", err)
+		return ""
+	}
+
+	return result
+}
+
 func (c *Cli) SetPasswordService(passwordService service.PasswordService) {
 	c.passwordService = passwordService
 }
+
+func (c *Cli) SetSharedVaultTransport(transport service.SharedVaultTransport) {
+	c.sharedVaultTransport = transport
+}
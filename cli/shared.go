@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/manifoldco/promptui"
+	"github.com/olekukonko/tablewriter"
+)
+
+// sharedVaultsRepl lets the user pick one of the shared vaults they are a
+// member of and work with its passwords.
+func (c *Cli) sharedVaultsRepl() {
+	list, err := c.passwordService.SharedVaults(c.sharedVaultTransport)
+
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if len(list) <= 0 {
+		fmt.Println("You are not a member of any shared vault")
+		return
+	}
+
+	names := make([]string, 0, len(list))
+
+	for _, vault := range list {
+		names = append(names, vault.Name)
+	}
+
+	prompt := promptui.Select{
+		Label: "Shared Vault",
+		Items: names,
+	}
+
+	index, _, err := prompt.Run()
+
+	if err != nil {
+		return
+	}
+
+	c.sharedVaultRepl(list[index])
+}
+
+// sharedVaultRepl shows only the operations the role of the user allows.
+func (c *Cli) sharedVaultRepl(vault *service.SharedVaultRepresentation) {
+	items := []string{"List Passwords", "Get Password"}
+
+	if vault.CanWrite() {
+		items = append(items, "Store Password", "Delete Password")
+	}
+
+	prompt := promptui.Select{
+		Label: fmt.Sprintf("Shared Vault `%s` (%s)", vault.Name, vault.Role),
+		Items: append(items, "Back"),
+	}
+
+	for {
+		_, result, err := prompt.Run()
+
+		if err != nil {
+			return
+		}
+
+		switch result {
+		case "List Passwords":
+			passwordList, err := c.passwordService.SharedPasswords(c.sharedVaultTransport, vault.Name)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			if len(passwordList) <= 0 {
+				fmt.Println("There are no stored passwords")
+				break
+			}
+
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Name", "Url"})
+
+			for _, val := range passwordList {
+				table.Append([]string{val.Name, val.Url})
+			}
+
+			table.Render()
+		case "Get Password":
+			prompt := promptui.Prompt{
+				Label: "Name",
+			}
+
+			resultName, _ := prompt.Run()
+
+			passwordInformation, err := c.passwordService.GetSharedPassword(c.sharedVaultTransport, vault.Name, resultName)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			printPassword(passwordInformation)
+		case "Store Password":
+			err := c.passwordService.StoreSharedPassword(c.sharedVaultTransport, vault.Name, *c.askPassword())
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			fmt.Println("Password successfully saved..")
+		case "Delete Password":
+			prompt := promptui.Prompt{
+				Label: "Name",
+			}
+
+			resultName, _ := prompt.Run()
+
+			err := c.passwordService.DeleteSharedPassword(c.sharedVaultTransport, vault.Name, resultName)
+
+			if err != nil {
+				fmt.Println(err.Error())
+				break
+			}
+
+			fmt.Printf("Password named as `%s` deleted successfully\n", resultName)
+		case "Back":
+			return
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blueskan/harpocrates/cli"
+	"github.com/blueskan/harpocrates/server"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/spf13/cobra"
+)
+
+var jsonOutput bool
+
+func passwordCommands() []*cobra.Command {
+	getCmd := &cobra.Command{
+		Use:   "get <name>",
+		Short: "Print a password",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			password, err := passwordService.GetPassword(args[0])
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(password)
+				return
+			}
+
+			if password.Type == service.ENTRY_TYPE_NOTE && len(password.Password) <= 0 {
+				fmt.Println(password.Notes)
+				return
+			}
+
+			fmt.Println(password.Password)
+		},
+	}
+
+	var url string
+	var fromStdin bool
+	var entryType string
+	var newEntryType string
+	var username string
+	var notes string
+	var tags []string
+	var fields []string
+	var secretFields []string
+	var removeFields []string
+
+	setCmd := &cobra.Command{
+		Use:   "set <name>",
+		Short: "Store a password",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			harpocratesCli := cli.NewCli()
+			passwordService := openPasswordService(harpocratesCli)
+
+			exitOnError(service.ValidateEntryType(entryType))
+
+			var password string
+
+			if fromStdin {
+				password = readStdin()
+			} else if entryType != service.ENTRY_TYPE_NOTE {
+				password = harpocratesCli.AskSecret("Password")
+			}
+
+			if len(password) <= 0 && entryType != service.ENTRY_TYPE_NOTE {
+				exitOnError(fmt.Errorf("You should enter password"))
+			}
+
+			stored, err := passwordService.StorePassword(service.PasswordRepresentation{
+				Name:     args[0],
+				Type:     entryType,
+				Url:      url,
+				Username: username,
+				Password: password,
+				Notes:    notes,
+				Tags:     tags,
+				Fields:   customFields(fields, secretFields),
+			})
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(stored)
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` saved successfully\n", stored.Name)
+		},
+	}
+
+	setCmd.Flags().StringVar(&url, "url", "", "url of the password")
+	setCmd.Flags().BoolVar(&fromStdin, "stdin", false, "read the password from stdin instead of prompting")
+	setCmd.Flags().StringVar(&entryType, "type", service.ENTRY_TYPE_LOGIN, "entry type: "+strings.Join(service.ENTRY_TYPES, ", "))
+	setCmd.Flags().StringVar(&username, "username", "", "username of the entry")
+	setCmd.Flags().StringVar(&notes, "notes", "", "free-form notes, stored encrypted")
+	setCmd.Flags().StringSliceVar(&tags, "tag", nil, "tag of the entry, may be repeated")
+	setCmd.Flags().StringArrayVar(&fields, "field", nil, "custom field as name=value, may be repeated")
+	setCmd.Flags().StringArrayVar(&secretFields, "secret-field", nil, "encrypted custom field as name=value, may be repeated")
+
+	updateCmd := &cobra.Command{
+		Use:   "update <name>",
+		Short: "Change the url and/or the password of an entry",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			harpocratesCli := cli.NewCli()
+			passwordService := openPasswordService(harpocratesCli)
+
+			update := service.PasswordUpdate{}
+
+			if cmd.Flags().Changed("type") {
+				update.Type = &newEntryType
+			}
+
+			if cmd.Flags().Changed("url") {
+				update.Url = &url
+			}
+
+			if cmd.Flags().Changed("username") {
+				update.Username = &username
+			}
+
+			if cmd.Flags().Changed("notes") {
+				update.Notes = &notes
+			}
+
+			if cmd.Flags().Changed("tag") {
+				update.Tags = &tags
+			}
+
+			update.Fields = customFields(fields, secretFields)
+			update.RemoveFields = removeFields
+
+			if fromStdin {
+				password := readStdin()
+				update.Password = &password
+			} else if update.IsEmpty() {
+				password := harpocratesCli.AskSecret("Password")
+				update.Password = &password
+			}
+
+			updated, err := passwordService.UpdatePassword(args[0], update)
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(updated)
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` updated successfully\n", updated.Name)
+		},
+	}
+
+	updateCmd.Flags().StringVar(&url, "url", "", "new url of the password")
+	updateCmd.Flags().BoolVar(&fromStdin, "stdin", false, "read the new password from stdin instead of prompting")
+	updateCmd.Flags().StringVar(&newEntryType, "type", "", "new entry type: "+strings.Join(service.ENTRY_TYPES, ", "))
+	updateCmd.Flags().StringVar(&username, "username", "", "new username of the entry")
+	updateCmd.Flags().StringVar(&notes, "notes", "", "new notes of the entry")
+	updateCmd.Flags().StringSliceVar(&tags, "tag", nil, "replace the tags of the entry, may be repeated")
+	updateCmd.Flags().StringArrayVar(&fields, "field", nil, "add or change a custom field as name=value, may be repeated")
+	updateCmd.Flags().StringArrayVar(&secretFields, "secret-field", nil, "add or change an encrypted custom field as name=value, may be repeated")
+	updateCmd.Flags().StringArrayVar(&removeFields, "remove-field", nil, "remove a custom field by name, may be repeated")
+
+	mvCmd := &cobra.Command{
+		Use:   "mv <name> <new-name>",
+		Short: "Rename an entry",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			exitOnError(passwordService.RenamePassword(args[0], args[1]))
+
+			if jsonOutput {
+				printJson(&service.PasswordRepresentation{Name: args[1]})
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` renamed to `%s`\n", args[0], args[1])
+		},
+	}
+
+	var reveal bool
+
+	historyCmd := &cobra.Command{
+		Use:   "history <name>",
+		Short: "List previous versions of a password",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			versions, err := passwordService.PasswordHistory(args[0])
+			exitOnError(err)
+
+			if !reveal {
+				for _, version := range versions {
+					version.Password = ""
+				}
+			}
+
+			if jsonOutput {
+				printJson(versions)
+				return
+			}
+
+			for _, version := range versions {
+				fmt.Printf("%d\t%s\t%s\n", version.Version, version.ReplacedAt.Format(time.RFC3339), version.Password)
+			}
+		},
+	}
+
+	historyCmd.Flags().BoolVar(&reveal, "reveal", false, "print the previous passwords too")
+
+	var version int
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <name>",
+		Short: "Make a previous version of a password current again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			exitOnError(passwordService.RestorePassword(args[0], version))
+
+			if jsonOutput {
+				printJson(&service.PasswordRepresentation{Name: args[0]})
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` restored to version %d\n", args[0], version)
+		},
+	}
+
+	restoreCmd.Flags().IntVar(&version, "version", 1, "version to restore, 1 is the value before the last change")
+
+	rmCmd := &cobra.Command{
+		Use:   "rm <name>",
+		Short: "Delete a password",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			exitOnError(passwordService.DeletePassword(args[0]))
+
+			if jsonOutput {
+				printJson(&service.PasswordRepresentation{Name: args[0]})
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` deleted successfully\n", args[0])
+		},
+	}
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List stored passwords",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			passwordList := passwordService.ListPasswords()
+
+			if jsonOutput {
+				printJson(passwordList)
+				return
+			}
+
+			for _, val := range passwordList {
+				fmt.Printf("%s\t%s\n", val.Name, val.Url)
+			}
+		},
+	}
+
+	exportCmd := &cobra.Command{
+		Use:   "export [file]",
+		Short: "Export all passwords to CSV, `-` or no file writes to stdout",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService := openPasswordService(cli.NewCli())
+
+			if len(args) <= 0 || args[0] == "-" {
+				exitOnError(passwordService.ExportCsv(os.Stdout))
+				return
+			}
+
+			exitOnError(passwordService.ExportToCsv(args[0]))
+
+			fmt.Fprintf(os.Stderr, "All passwords saved to `%s`\n", args[0])
+		},
+	}
+
+	importCmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import passwords from CSV written by export, `-` reads from stdin",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var reader io.Reader = os.Stdin
+
+			if args[0] != "-" {
+				file, err := os.Open(args[0])
+				exitOnError(err)
+
+				defer file.Close()
+				reader = file
+			}
+
+			passwordService := openPasswordService(cli.NewCli())
+
+			imported, skipped, err := passwordService.ImportCsv(reader)
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(map[string]interface{}{
+					"imported": imported,
+					"skipped":  skipped,
+				})
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "%d passwords imported\n", imported)
+
+			for _, name := range skipped {
+				fmt.Fprintf(os.Stderr, "Skipped `%s`, it already exists\n", name)
+			}
+		},
+	}
+
+	commands := []*cobra.Command{getCmd, setCmd, updateCmd, mvCmd, historyCmd, restoreCmd, rmCmd, lsCmd, exportCmd, importCmd}
+
+	for _, command := range commands {
+		if command != exportCmd {
+			command.Flags().BoolVar(&jsonOutput, "json", false, "print the result as JSON")
+		}
+	}
+
+	return commands
+}
+
+func restoreBackupCommand() *cobra.Command {
+	restoreBackupCmd := &cobra.Command{
+		Use:   "restore-backup [generation]",
+		Short: "List backups of the password database or restore one of them",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			storageService := newStorage()
+
+			if len(args) <= 0 {
+				backups, err := storageService.ListBackups()
+				exitOnError(err)
+
+				if jsonOutput {
+					printJson(backups)
+					return
+				}
+
+				for _, backup := range backups {
+					fmt.Printf("%d\t%s\t%d bytes\n", backup.Generation, backup.ModifiedAt.Format(time.RFC3339), backup.Size)
+				}
+
+				return
+			}
+
+			generation, err := strconv.Atoi(args[0])
+			if err != nil || generation < 1 {
+				exitOnError(fmt.Errorf("Backup generation should be a number from 1"))
+			}
+
+			// The current database may be the broken one, so it is not read.
+			cryptoManager, pri, pub, _ := unlock(cli.NewCli(), storageService)
+			storageService.SetVaultCipher(service.NewVaultCipher(cryptoManager, pri, pub))
+
+			exitOnError(storageService.RestoreBackup(generation))
+
+			fmt.Fprintf(os.Stderr, "Backup generation %d restored, the replaced database is now generation 1\n", generation)
+		},
+	}
+
+	restoreBackupCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the result as JSON")
+
+	return restoreBackupCmd
+}
+
+func migrateStorageCommand() *cobra.Command {
+	var from string
+	var to string
+	var fromLocation string
+	var toLocation string
+
+	migrateStorageCmd := &cobra.Command{
+		Use:   "migrate-storage",
+		Short: "Copy the passwords to another storage backend and use it from now on",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if from == to {
+				exitOnError(fmt.Errorf("--from and --to should be different backends"))
+			}
+
+			source, err := service.OpenStorage(from, fromLocation, settingsLocation, mode)
+			exitOnError(err)
+
+			target, err := service.OpenStorage(to, toLocation, settingsLocation, mode)
+			exitOnError(err)
+
+			cryptoManager, pri, pub, _ := unlock(cli.NewCli(), source)
+			vaultCipher := service.NewVaultCipher(cryptoManager, pri, pub)
+
+			source.SetVaultCipher(vaultCipher)
+			target.SetVaultCipher(vaultCipher)
+
+			passwords, err := source.ReadPasswords()
+			exitOnError(err)
+
+			_, err = target.UpdatePasswords(func(existing map[string]service.Password) error {
+				if len(existing) > 0 {
+					return fmt.Errorf("Target %s storage already has passwords", to)
+				}
+
+				for name, password := range passwords {
+					existing[name] = password
+				}
+
+				return nil
+			})
+			exitOnError(err)
+
+			settings := source.ReadSettings()
+			settings[service.SETTING_STORAGE_BACKEND] = to
+			settings[service.SETTING_STORAGE_LOCATION] = toLocation
+			source.StoreSettings(settings)
+
+			fmt.Fprintf(os.Stderr, "%d passwords migrated from %s to %s storage, %s is used from now on\n", len(passwords), from, to, to)
+		},
+	}
+
+	backends := strings.Join(service.STORAGE_BACKENDS, ", ")
+
+	migrateStorageCmd.Flags().StringVar(&from, "from", service.STORAGE_BACKEND_FILE, "backend to migrate from: "+backends)
+	migrateStorageCmd.Flags().StringVar(&to, "to", "", "backend to migrate to: "+backends)
+	migrateStorageCmd.Flags().StringVar(&fromLocation, "from-passwords", "", "location of the passwords to migrate, defaults to the location of the backend")
+	migrateStorageCmd.Flags().StringVar(&toLocation, "to-passwords", "", "location of the migrated passwords, defaults to the location of the backend")
+	migrateStorageCmd.MarkFlagRequired("to")
+
+	return migrateStorageCmd
+}
+
+func syncCommand() *cobra.Command {
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Synchronize the passwords with your other devices through the server",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			storageService := newStorage()
+
+			cryptoManager, pri, pub, password := unlock(cli.NewCli(), storageService)
+
+			passwordService, err := service.NewPasswordService(cryptoManager, pri, pub, storageService)
+			exitOnError(err)
+
+			result, err := passwordService.Sync(server.NewSyncTransport(password, storageService.ReadSettings()))
+
+			if jsonOutput && result != nil {
+				printJson(result)
+			}
+
+			exitOnError(err)
+
+			if !jsonOutput {
+				fmt.Fprintf(os.Stderr, "%d passwords pulled, %d passwords pushed, server revision %d\n", result.Pulled, result.Pushed, result.Revision)
+			}
+		},
+	}
+
+	syncCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the result as JSON")
+
+	return syncCmd
+}
+
+func logoutCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "logout",
+		Short: "Revoke the session token of the server, the next command logs in with the master password",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(server.Logout(newStorage().ReadSettings()))
+
+			fmt.Fprintln(os.Stderr, "Logged out")
+		},
+	}
+}
+
+func customFields(fields, secretFields []string) []service.CustomFieldRepresentation {
+	representations := make([]service.CustomFieldRepresentation, 0, len(fields)+len(secretFields))
+
+	for _, field := range fields {
+		representation, err := service.ParseCustomField(field, false)
+		exitOnError(err)
+
+		representations = append(representations, representation)
+	}
+
+	for _, field := range secretFields {
+		representation, err := service.ParseCustomField(field, true)
+		exitOnError(err)
+
+		representations = append(representations, representation)
+	}
+
+	return representations
+}
+
+// readStdin returns stdin without the trailing newline most tools append.
+func readStdin() string {
+	bytes, err := ioutil.ReadAll(os.Stdin)
+	exitOnError(err)
+
+	return strings.TrimSuffix(strings.TrimSuffix(string(bytes), "\n"), "\r")
+}
+
+func printJson(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	exitOnError(encoder.Encode(v))
+}
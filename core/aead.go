@@ -0,0 +1,45 @@
+package core
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// SYMMETRIC_KEY_SIZE is the size of the AES-256-GCM keys of SealWithKey.
+const SYMMETRIC_KEY_SIZE = 32
+
+// SealWithKey encrypts with AES-256-GCM under a key the caller keeps, the
+// random nonce is prepended to the result.
+func SealWithKey(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, newCryptoError("encryption", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, newCryptoError("encryption", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func OpenWithKey(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, newCryptoError("decryption", err)
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, newCryptoError("decryption", ErrCorruptedCiphertext)
+	}
+
+	return plaintext, nil
+}
@@ -11,13 +11,15 @@ import (
 type CryptoManager interface {
 	GetBits() int
 
-	CreatePubPriKey() (*rsa.PrivateKey, *rsa.PublicKey)
+	CreatePubPriKey() (*rsa.PrivateKey, *rsa.PublicKey, error)
 	PrivateKeyToBytes(pri *rsa.PrivateKey) []byte
 	PublicKeyToBytes(pub *rsa.PublicKey) []byte
-	BytesToPrivateKey(priv []byte) *rsa.PrivateKey
-	BytesToPublicKey(pub []byte) *rsa.PublicKey
-	EncryptWithPublicKey(msg []byte, pub *rsa.PublicKey) []byte
-	DecryptWithPrivateKey(ciphertext []byte, priv *rsa.PrivateKey) []byte
+	BytesToPrivateKey(priv []byte) (*rsa.PrivateKey, error)
+	BytesToPublicKey(pub []byte) (*rsa.PublicKey, error)
+	EncryptWithPublicKey(msg []byte, pub *rsa.PublicKey) ([]byte, error)
+	DecryptWithPrivateKey(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error)
+	SealEnvelope(msg []byte, pub *rsa.PublicKey) ([]byte, error)
+	OpenEnvelope(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error)
 }
 
 type cryptoManager struct {
@@ -34,10 +36,14 @@ func (cm *cryptoManager) GetBits() int {
 	return cm.bits
 }
 
-func (cm *cryptoManager) CreatePubPriKey() (*rsa.PrivateKey, *rsa.PublicKey) {
-	privkey, _ := rsa.GenerateKey(rand.Reader, cm.bits)
+func (cm *cryptoManager) CreatePubPriKey() (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	privkey, err := rsa.GenerateKey(rand.Reader, cm.bits)
 
-	return privkey, &privkey.PublicKey
+	if err != nil {
+		return nil, nil, newCryptoError("key generation", err)
+	}
+
+	return privkey, &privkey.PublicKey, nil
 }
 
 func (cm *cryptoManager) PrivateKeyToBytes(pri *rsa.PrivateKey) []byte {
@@ -62,72 +68,76 @@ func (cm *cryptoManager) PublicKeyToBytes(pub *rsa.PublicKey) []byte {
 	return pubBytes
 }
 
-func (cm *cryptoManager) BytesToPrivateKey(priv []byte) *rsa.PrivateKey {
-	block, _ := pem.Decode(priv)
-	enc := x509.IsEncryptedPEMBlock(block)
-	b := block.Bytes
-	var err error
-
-	if enc {
-		// log.Println("is encrypted pem block")
-		b, err = x509.DecryptPEMBlock(block, nil)
-		if err != nil {
-			// log.Error(err)
-		}
+func (cm *cryptoManager) BytesToPrivateKey(priv []byte) (*rsa.PrivateKey, error) {
+	b, err := decodePem(priv)
+
+	if err != nil {
+		return nil, newCryptoError("private key decoding", err)
 	}
 
 	key, err := x509.ParsePKCS1PrivateKey(b)
+
 	if err != nil {
-		// log.Error(err)
+		return nil, newCryptoError("private key decoding", err)
 	}
 
-	return key
+	return key, nil
 }
 
-func (cm *cryptoManager) BytesToPublicKey(pub []byte) *rsa.PublicKey {
-	block, _ := pem.Decode(pub)
-	enc := x509.IsEncryptedPEMBlock(block)
-	b := block.Bytes
-	var err error
-
-	if enc {
-		// log.Println("is encrypted pem block")
-		b, err = x509.DecryptPEMBlock(block, nil)
-		if err != nil {
-			// log.Error(err)
-		}
+func (cm *cryptoManager) BytesToPublicKey(pub []byte) (*rsa.PublicKey, error) {
+	b, err := decodePem(pub)
+
+	if err != nil {
+		return nil, newCryptoError("public key decoding", err)
 	}
 
 	ifc, err := x509.ParsePKIXPublicKey(b)
+
 	if err != nil {
-		// log.Error(err)
+		return nil, newCryptoError("public key decoding", err)
 	}
 
 	key, ok := ifc.(*rsa.PublicKey)
+
 	if !ok {
-		// log.Error("not ok")
+		return nil, newCryptoError("public key decoding", ErrNotRsaKey)
 	}
 
-	return key
+	return key, nil
 }
 
-func (cm *cryptoManager) EncryptWithPublicKey(msg []byte, pub *rsa.PublicKey) []byte {
+func (cm *cryptoManager) EncryptWithPublicKey(msg []byte, pub *rsa.PublicKey) ([]byte, error) {
 	hash := sha512.New()
 	ciphertext, err := rsa.EncryptOAEP(hash, rand.Reader, pub, msg, nil)
+
 	if err != nil {
-		// log.Error(err)
+		return nil, newCryptoError("encryption", err)
 	}
 
-	return ciphertext
+	return ciphertext, nil
 }
 
-func (cm *cryptoManager) DecryptWithPrivateKey(ciphertext []byte, priv *rsa.PrivateKey) []byte {
+func (cm *cryptoManager) DecryptWithPrivateKey(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error) {
 	hash := sha512.New()
 	plaintext, err := rsa.DecryptOAEP(hash, rand.Reader, priv, ciphertext, nil)
 
 	if err != nil {
-		// log.Error(err)
+		return nil, newCryptoError("decryption", ErrWrongKey)
+	}
+
+	return plaintext, nil
+}
+
+func decodePem(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, ErrInvalidPem
+	}
+
+	if x509.IsEncryptedPEMBlock(block) {
+		return x509.DecryptPEMBlock(block, nil)
 	}
 
-	return plaintext
+	return block.Bytes, nil
 }
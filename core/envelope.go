@@ -0,0 +1,110 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"io"
+)
+
+// Envelope layout:
+//
+//	[version:1][wrapped key length:2][wrapped key][nonce:12][AES-256-GCM ciphertext]
+//
+// The payload is sealed with a random per-entry data key and only that key
+// is encrypted with RSA-OAEP, so the payload size is no longer bounded by
+// the RSA modulus.
+const ENVELOPE_VERSION = 1
+const ENVELOPE_DATA_KEY_SIZE = 32
+
+const envelopeHeaderSize = 3
+
+func (cm *cryptoManager) SealEnvelope(msg []byte, pub *rsa.PublicKey) ([]byte, error) {
+	dataKey := make([]byte, ENVELOPE_DATA_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := cm.EncryptWithPublicKey(dataKey, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(wrappedKey))
+	header[0] = ENVELOPE_VERSION
+	binary.BigEndian.PutUint16(header[1:], uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := append(header, nonce...)
+
+	return gcm.Seal(envelope, nonce, msg, header), nil
+}
+
+func (cm *cryptoManager) OpenEnvelope(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	// Entries written before envelopes existed are a single RSA-OAEP block,
+	// which is always exactly as long as the modulus.
+	if len(ciphertext) == priv.Size() {
+		return cm.DecryptWithPrivateKey(ciphertext, priv)
+	}
+
+	if len(ciphertext) < envelopeHeaderSize || ciphertext[0] != ENVELOPE_VERSION {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	wrappedKeyLen := int(binary.BigEndian.Uint16(ciphertext[1:envelopeHeaderSize]))
+	headerLen := envelopeHeaderSize + wrappedKeyLen
+
+	if len(ciphertext) < headerLen {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	header := ciphertext[:headerLen]
+	dataKey, err := cm.DecryptWithPrivateKey(header[envelopeHeaderSize:], priv)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dataKey) != ENVELOPE_DATA_KEY_SIZE {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	body := ciphertext[headerLen:]
+	if len(body) < gcm.NonceSize() {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	nonce, sealed := body[:gcm.NonceSize()], body[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, newCryptoError("decryption", ErrCorruptedCiphertext)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
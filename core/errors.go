@@ -0,0 +1,33 @@
+package core
+
+import "errors"
+
+var ErrWrongKey = errors.New("wrong key")
+var ErrWrongPassphrase = errors.New("wrong master password")
+var ErrInvalidPem = errors.New("no PEM block found")
+var ErrNotRsaKey = errors.New("not an RSA key")
+var ErrMalformedCiphertext = errors.New("malformed ciphertext")
+var ErrCorruptedCiphertext = errors.New("ciphertext corrupted")
+
+// CryptoError describes which CryptoManager operation failed and why, so
+// callers can match the cause with errors.Is while users get a readable
+// message such as "decryption failed: wrong key".
+type CryptoError struct {
+	Op  string
+	Err error
+}
+
+func (e *CryptoError) Error() string {
+	return e.Op + " failed: " + e.Err.Error()
+}
+
+func (e *CryptoError) Unwrap() error {
+	return e.Err
+}
+
+func newCryptoError(op string, err error) error {
+	return &CryptoError{
+		Op:  op,
+		Err: err,
+	}
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Private keys escrowed on the server are sealed with a key derived from the
+// master password, so the server only ever stores a blob it cannot open.
+// The result is a PEM block whose headers carry the Argon2id parameters; the
+// headers are authenticated as additional data of the AES-256-GCM seal.
+const PASSPHRASE_SEALED_PEM_TYPE = "HARPOCRATES ENCRYPTED PRIVATE KEY"
+
+const ARGON2_TIME = 3
+const ARGON2_MEMORY = 64 * 1024
+const ARGON2_THREADS = 4
+const ARGON2_SALT_SIZE = 16
+const ARGON2_KEY_SIZE = 32
+
+// The parameters come with the blob from the server, opening refuses larger
+// ones so a server can not make the client spend unbounded memory or time.
+const ARGON2_MAX_TIME = 10
+const ARGON2_MAX_MEMORY = 256 * 1024
+const ARGON2_MAX_THREADS = 16
+
+func SealWithPassphrase(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, ARGON2_SALT_SIZE)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, newCryptoError("encryption", err)
+	}
+
+	headers := map[string]string{
+		"KDF":         "argon2id",
+		"KDF-Time":    strconv.Itoa(ARGON2_TIME),
+		"KDF-Memory":  strconv.Itoa(ARGON2_MEMORY),
+		"KDF-Threads": strconv.Itoa(ARGON2_THREADS),
+		"KDF-Salt":    hex.EncodeToString(salt),
+		"Cipher":      "AES-256-GCM",
+	}
+
+	key := argon2.IDKey([]byte(passphrase), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_SIZE)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, newCryptoError("encryption", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, newCryptoError("encryption", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, passphraseAdditionalData(headers))
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    PASSPHRASE_SEALED_PEM_TYPE,
+		Headers: headers,
+		Bytes:   sealed,
+	}), nil
+}
+
+func OpenWithPassphrase(sealed []byte, passphrase string) ([]byte, error) {
+	block, _ := pem.Decode(sealed)
+
+	if block == nil || block.Type != PASSPHRASE_SEALED_PEM_TYPE {
+		return nil, newCryptoError("decryption", ErrInvalidPem)
+	}
+
+	if block.Headers["KDF"] != "argon2id" || block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	time, errTime := strconv.ParseUint(block.Headers["KDF-Time"], 10, 32)
+	memory, errMemory := strconv.ParseUint(block.Headers["KDF-Memory"], 10, 32)
+	threads, errThreads := strconv.ParseUint(block.Headers["KDF-Threads"], 10, 8)
+	salt, errSalt := hex.DecodeString(block.Headers["KDF-Salt"])
+
+	if errTime != nil || errMemory != nil || errThreads != nil || errSalt != nil || len(salt) != ARGON2_SALT_SIZE {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	if time == 0 || time > ARGON2_MAX_TIME || memory == 0 || memory > ARGON2_MAX_MEMORY || threads == 0 || threads > ARGON2_MAX_THREADS {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	key := argon2.IDKey([]byte(passphrase), salt, uint32(time), uint32(memory), uint8(threads), ARGON2_KEY_SIZE)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, newCryptoError("decryption", err)
+	}
+
+	if len(block.Bytes) < gcm.NonceSize() {
+		return nil, newCryptoError("decryption", ErrMalformedCiphertext)
+	}
+
+	nonce, ciphertext := block.Bytes[:gcm.NonceSize()], block.Bytes[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, passphraseAdditionalData(block.Headers))
+	if err != nil {
+		return nil, newCryptoError("decryption", ErrWrongPassphrase)
+	}
+
+	return plaintext, nil
+}
+
+func IsPassphraseSealed(data []byte) bool {
+	block, _ := pem.Decode(data)
+
+	return block != nil && block.Type == PASSPHRASE_SEALED_PEM_TYPE
+}
+
+func passphraseAdditionalData(headers map[string]string) []byte {
+	return []byte(headers["KDF"] + "|" + headers["KDF-Time"] + "|" + headers["KDF-Memory"] + "|" +
+		headers["KDF-Threads"] + "|" + headers["KDF-Salt"] + "|" + headers["Cipher"])
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// SRP-6a (RFC 5054) over the 2048-bit group with SHA-256. The password is
+// stretched with Argon2id before it becomes the private value x, so a leaked
+// verifier is as expensive to brute force as the escrowed private key.
+
+var ErrSrpAuthentication = errors.New("srp: authentication failed")
+var ErrSrpIllegalParameter = errors.New("srp: illegal parameter")
+
+const SRP_SALT_SIZE = 16
+
+var srpN, _ = new(big.Int).SetString(strings.Join(strings.Fields(`
+	AC6BDB41 324A9A9B F166DE5E 1389582F AF72B665 1987EE07 FC319294 3DB56050
+	A37329CB B4A099ED 8193E075 7767A13D D52312AB 4B03310D CD7F48A9 DA04FD50
+	E8083969 EDB767B0 CF609517 9A163AB3 661A05FB D5FAAAE8 2918A996 2F0B93B8
+	55F97993 EC975EEA A80D740A DBF4FF74 7359D041 D5C33EA7 1D281E44 6B14773B
+	CA97B43A 23FB8016 76BD207A 436C6481 F1D2B907 8717461A 5B9D32E6 88F87748
+	544523B5 24B0D57D 5EA77A27 75D2ECFA 032CFBDB F52FB378 61602790 04E57AE6
+	AF874E73 03CE5329 9CCC041C 7BC308D8 2A5698F3 A8D0C382 71AE35F8 E9DBFBB6
+	94B5C803 D89F7AE4 35DE236D 525F5475 9B65E372 FCD68EF2 0FA7111F 9E4AFF73`), ""), 16)
+
+var srpG = big.NewInt(2)
+
+var srpK = new(big.Int).SetBytes(srpHash(srpPad(srpN), srpPad(srpG)))
+
+type SrpClient struct {
+	identity string
+	password string
+	a        *big.Int
+	A        *big.Int
+	K        []byte
+	M1       []byte
+}
+
+type SrpServer struct {
+	identity string
+	salt     []byte
+	v        *big.Int
+	b        *big.Int
+	B        *big.Int
+}
+
+// NewSrpVerifier returns the salt and verifier the server stores in place of
+// the master password.
+func NewSrpVerifier(identity, password string) ([]byte, []byte, error) {
+	salt := make([]byte, SRP_SALT_SIZE)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+
+	x := srpX(identity, password, salt)
+	v := new(big.Int).Exp(srpG, x, srpN)
+
+	return salt, v.Bytes(), nil
+}
+
+// NewSrpDecoy returns the salt and verifier the server answers an unknown
+// identity with. They are derived from a secret of the server, so they are
+// the same on every login attempt like those of a real identity, and skip
+// the Argon2 derivation so unknown identities cost the server nothing.
+func NewSrpDecoy(secret []byte, identity string) ([]byte, []byte) {
+	salt := srpHmac(secret, "salt", identity)[:SRP_SALT_SIZE]
+	x := new(big.Int).SetBytes(srpHmac(secret, "verifier", identity))
+
+	return salt, new(big.Int).Exp(srpG, x, srpN).Bytes()
+}
+
+func NewSrpClient(identity, password string) (*SrpClient, error) {
+	a, err := srpRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SrpClient{
+		identity: identity,
+		password: password,
+		a:        a,
+		A:        new(big.Int).Exp(srpG, a, srpN),
+	}, nil
+}
+
+func (c *SrpClient) PublicKey() []byte {
+	return c.A.Bytes()
+}
+
+// Proof answers the server challenge and returns M1, which proves to the
+// server that the client knows the password.
+func (c *SrpClient) Proof(salt, serverPublicKey []byte) ([]byte, error) {
+	B := new(big.Int).SetBytes(serverPublicKey)
+
+	if !srpValidPublicKey(B) {
+		return nil, ErrSrpIllegalParameter
+	}
+
+	u := new(big.Int).SetBytes(srpHash(srpPad(c.A), srpPad(B)))
+	if u.Sign() == 0 {
+		return nil, ErrSrpIllegalParameter
+	}
+
+	x := srpX(c.identity, c.password, salt)
+
+	// S = (B - k * g^x) ^ (a + u * x) mod N
+	base := new(big.Int).Exp(srpG, x, srpN)
+	base.Mul(base, srpK)
+	base.Sub(B, base)
+	base.Mod(base, srpN)
+
+	exponent := new(big.Int).Mul(u, x)
+	exponent.Add(exponent, c.a)
+
+	S := new(big.Int).Exp(base, exponent, srpN)
+
+	c.K = srpHash(srpPad(S))
+	c.M1 = srpHash(srpPad(c.A), srpPad(B), c.K)
+
+	return c.M1, nil
+}
+
+// VerifyServer checks M2, which proves the server holds the verifier.
+func (c *SrpClient) VerifyServer(serverProof []byte) bool {
+	if c.K == nil {
+		return false
+	}
+
+	expected := srpHash(srpPad(c.A), c.M1, c.K)
+
+	return subtle.ConstantTimeCompare(expected, serverProof) == 1
+}
+
+func NewSrpServer(identity string, salt, verifier []byte) (*SrpServer, error) {
+	b, err := srpRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(big.Int).SetBytes(verifier)
+
+	// B = k * v + g^b mod N
+	B := new(big.Int).Mul(srpK, v)
+	B.Add(B, new(big.Int).Exp(srpG, b, srpN))
+	B.Mod(B, srpN)
+
+	return &SrpServer{
+		identity: identity,
+		salt:     salt,
+		v:        v,
+		b:        b,
+		B:        B,
+	}, nil
+}
+
+func (s *SrpServer) Salt() []byte {
+	return s.salt
+}
+
+func (s *SrpServer) PublicKey() []byte {
+	return s.B.Bytes()
+}
+
+// Verify checks the client proof M1 and returns the server proof M2.
+func (s *SrpServer) Verify(clientPublicKey, clientProof []byte) ([]byte, error) {
+	A := new(big.Int).SetBytes(clientPublicKey)
+
+	if !srpValidPublicKey(A) {
+		return nil, ErrSrpIllegalParameter
+	}
+
+	u := new(big.Int).SetBytes(srpHash(srpPad(A), srpPad(s.B)))
+	if u.Sign() == 0 {
+		return nil, ErrSrpIllegalParameter
+	}
+
+	// S = (A * v^u) ^ b mod N
+	S := new(big.Int).Exp(s.v, u, srpN)
+	S.Mul(S, A)
+	S.Exp(S, s.b, srpN)
+
+	K := srpHash(srpPad(S))
+	M1 := srpHash(srpPad(A), srpPad(s.B), K)
+
+	if subtle.ConstantTimeCompare(M1, clientProof) != 1 {
+		return nil, ErrSrpAuthentication
+	}
+
+	return srpHash(srpPad(A), M1, K), nil
+}
+
+func srpX(identity, password string, salt []byte) *big.Int {
+	key := argon2.IDKey([]byte(identity+":"+password), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_SIZE)
+
+	return new(big.Int).SetBytes(key)
+}
+
+func srpRandom() (*big.Int, error) {
+	bytes := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, bytes); err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// srpValidPublicKey rejects a public key which is 0 mod N or does not fit
+// into N, the latter could not be padded.
+func srpValidPublicKey(key *big.Int) bool {
+	return key.Sign() > 0 && key.Cmp(srpN) < 0
+}
+
+func srpPad(n *big.Int) []byte {
+	padded := make([]byte, (srpN.BitLen()+7)/8)
+
+	return n.FillBytes(padded)
+}
+
+func srpHmac(secret []byte, label, identity string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label + ":" + identity))
+
+	return mac.Sum(nil)
+}
+
+func srpHash(parts ...[]byte) []byte {
+	hash := sha256.New()
+
+	for _, part := range parts {
+		hash.Write(part)
+	}
+
+	return hash.Sum(nil)
+}
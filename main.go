@@ -3,102 +3,248 @@ package main
 import (
 	"bufio"
 	"crypto/rsa"
-	"flag"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
-
-	"github.com/blueskan/harpocrates/server"
+	"strings"
 
 	"github.com/blueskan/harpocrates/cli"
 	"github.com/blueskan/harpocrates/core"
+	"github.com/blueskan/harpocrates/server"
 	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
+	"github.com/spf13/cobra"
 )
 
+// Exit codes of the non-interactive commands.
+const EXIT_OK = 0
+const EXIT_ERROR = 1
+const EXIT_USAGE = 2
+const EXIT_NOT_FOUND = 3
+const EXIT_AUTHENTICATION_FAILED = 4
+
+// MASTER_PASSWORD_ENV lets scripts provide the master password instead of
+// being prompted for it.
+const MASTER_PASSWORD_ENV = "HARPOCRATES_MASTER_PASSWORD"
+
+var mode string
+var settingsLocation string
+var passwordsLocation string
+var backend string
+
 func main() {
-	mode := flag.String("mode", "client", "operational mode")
-	settingsLocation := flag.String("settings", "", "location of settings")
-	passwordsLocation := flag.String("passwords", "", "location of passwords")
+	rootCmd := &cobra.Command{
+		Use:   "harpocrates",
+		Short: "Store your secrets encrypted with RSA and access them from the command line",
+		Run: func(cmd *cobra.Command, args []string) {
+			if mode == "server" {
+				runServer(nil)
+			}
+
+			runShell()
+		},
+		SilenceUsage: true,
+	}
 
-	flag.Parse()
+	rootCmd.PersistentFlags().StringVar(&mode, "mode", "client", "operational mode")
+	rootCmd.PersistentFlags().StringVar(&settingsLocation, "settings", "", "location of settings")
+	rootCmd.PersistentFlags().StringVar(&passwordsLocation, "passwords", "", "location of passwords")
+	rootCmd.PersistentFlags().StringVar(&backend, "backend", "", "storage backend of passwords: "+strings.Join(service.STORAGE_BACKENDS, ", ")+", defaults to the storage_backend setting or file")
+
+	rootCmd.AddCommand(
+		serverCommand(),
+		&cobra.Command{
+			Use:   "shell",
+			Short: "Open the interactive menu",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				runShell()
+			},
+		},
+	)
 
-	storageService := service.NewStorage(*passwordsLocation, *settingsLocation, *mode)
+	rootCmd.AddCommand(passwordCommands()...)
+	rootCmd.AddCommand(restoreBackupCommand())
+	rootCmd.AddCommand(migrateStorageCommand())
+	rootCmd.AddCommand(syncCommand())
+	rootCmd.AddCommand(logoutCommand())
+	rootCmd.AddCommand(vaultCommand())
+	rootCmd.AddCommand(caCommand())
+	rootCmd.AddCommand(usersCommand())
+	rootCmd.AddCommand(bansCommand())
+	rootCmd.AddCommand(auditCommand())
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(EXIT_USAGE)
+	}
+}
 
-	fmt.Printf("Selected mode: %s\n\n", *mode)
+func newStorage() service.Storage {
+	storageService, err := service.OpenStorage(backend, passwordsLocation, settingsLocation, mode)
+	exitOnError(err)
 
-	areSettingsExists := storageService.AreSettingsExists()
-	settings := make(map[string]string)
+	return storageService
+}
 
-	// Server
-	if *mode == "server" {
-		harpocratesCli := cli.NewCli()
-		harpocratesCli.Banner()
+// serverCommand has a flag for every server setting, like --bind-address
+// for bind_address.
+func serverCommand() *cobra.Command {
+	serverCmd := &cobra.Command{
+		Use:   "server",
+		Short: "Run the key escrow server",
+		Long:  "Run the key escrow server. Its settings are read from server_harpocrates.ini, overridden by environment variables like " + server.EnvName(server.SETTING_PORT) + " and by flags.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			flags := make(map[string]string)
+
+			for _, setting := range server.SERVER_SETTINGS {
+				if flag := cmd.Flags().Lookup(settingFlag(setting.Key)); flag.Changed {
+					flags[setting.Key] = flag.Value.String()
+				}
+			}
+
+			mode = "server"
+			runServer(flags)
+		},
+	}
 
-		if !areSettingsExists {
-			harpocratesCli.WelcomeMessage()
+	for _, setting := range server.SERVER_SETTINGS {
+		serverCmd.Flags().String(settingFlag(setting.Key), "", setting.Usage+", env "+server.EnvName(setting.Key))
+	}
 
-			settings["password"] = harpocratesCli.AskMasterPassword()
-			settings["port"] = harpocratesCli.AskServerPort()
+	return serverCmd
+}
 
-			storageService.StoreSettings(settings)
+func settingFlag(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
 
-			fmt.Println("\n")
-		} else {
-			settings = storageService.ReadSettings()
+func runServer(flags map[string]string) {
+	storageService := newStorage()
+
+	harpocratesCli := cli.NewCli()
+	harpocratesCli.Banner()
+
+	fmt.Printf("Selected mode: %s\n\n", mode)
+
+	if !storageService.AreSettingsExists() {
+		settings := make(map[string]string)
+
+		harpocratesCli.WelcomeMessage()
+
+		settings["port"] = harpocratesCli.AskServerPort()
+
+		// Certificates given by environment variable or flag are not
+		// replaced by new ones.
+		if overridden := server.ServerSettings(settings, flags); len(overridden[server.SETTING_TLS_CERT]) <= 0 {
+			setupServerCertificates(harpocratesCli, settings)
 		}
 
-		server.Server(storageService)
+		settings[server.SETTING_USERS_DIR] = harpocratesCli.AskPath("Directory of user accounts (leave empty for ~/"+users.DEFAULT_USERS_DIRECTORY_NAME+")", "")
+
+		storageService.StoreSettings(settings)
+
+		fmt.Print("\n\n")
 	}
 
-	// Client
+	server.Server(storageService, flags)
+	os.Exit(EXIT_OK)
+}
+
+func runShell() {
 	harpocratesCli := cli.NewCli()
 	harpocratesCli.Banner()
 
+	fmt.Printf("Selected mode: %s\n\n", mode)
+
+	passwordService, transport := openSharedVaults(harpocratesCli)
+
+	harpocratesCli.SetPasswordService(*passwordService)
+	harpocratesCli.SetSharedVaultTransport(transport)
+	harpocratesCli.Repl()
+}
+
+func openPasswordService(harpocratesCli *cli.Cli) *service.PasswordService {
+	storageService := newStorage()
+
+	cryptoManager, pri, pub, _ := unlock(harpocratesCli, storageService)
+
+	passwordService, err := service.NewPasswordService(
+		cryptoManager,
+		pri,
+		pub,
+		storageService,
+	)
+	exitOnError(err)
+
+	return passwordService
+}
+
+// unlock runs the client setup on first start, otherwise logs in to the
+// server to fetch the private key. The master password is returned for
+// later requests to the server. Status messages go to stderr so the output
+// of scripted commands stays clean.
+func unlock(harpocratesCli *cli.Cli, storageService service.Storage) (core.CryptoManager, *rsa.PrivateKey, *rsa.PublicKey, string) {
+	settings := make(map[string]string)
+
+	var password string
 	var pri *rsa.PrivateKey
 	var pub *rsa.PublicKey
 	var cryptoManager core.CryptoManager
+	var err error
 
-	if !areSettingsExists {
+	if !storageService.AreSettingsExists() {
 		harpocratesCli.WelcomeMessage()
-		password := harpocratesCli.AskMasterPassword()
+		settings[server.SETTING_USERNAME] = harpocratesCli.AskUsername()
+		password = harpocratesCli.AskMasterPassword()
 
 		settings["server_host"] = harpocratesCli.AskServerAddr()
 		settings["server_port"] = harpocratesCli.AskServerPort()
+		settings[server.SETTING_TLS_CERT] = harpocratesCli.AskPath("Client certificate (`harpocrates ca issue-client` on the server)", "")
+		settings[server.SETTING_TLS_KEY] = harpocratesCli.AskPath("Client certificate key", "")
+		settings[server.SETTING_TLS_CA] = harpocratesCli.AskPath("CA certificate of the server, its ca.pem (leave empty to trust on first use)", "")
 		settings["bits"] = harpocratesCli.AskEncryptionBits()
 		bits, _ := strconv.Atoi(settings["bits"])
 
 		cryptoManager = core.NewCryptoManager(bits)
-		pri, pub = cryptoManager.CreatePubPriKey()
+		pri, pub, err = cryptoManager.CreatePubPriKey()
+		exitOnError(err)
+
+		sealedPrivateKey, err := core.SealWithPassphrase(cryptoManager.PrivateKeyToBytes(pri), password)
+		exitOnError(err)
+
+		exitOnRegistrationFailure(server.Register(password, settings))
 
 		request := server.PrivateKeyExchange{
-			PasswordHash: password,
-			PrivateKey:   string(cryptoManager.PrivateKeyToBytes(pri)),
-			Type:         server.MESSAGE_TYPE_STORE_PRIVATE_KEY,
+			PrivateKey: string(sealedPrivateKey),
+			PublicKey:  string(cryptoManager.PublicKeyToBytes(pub)),
+			Type:       server.MESSAGE_TYPE_STORE_PRIVATE_KEY,
 		}
 
-		resp := server.Client(password, settings["server_host"], settings["server_port"], request)
+		resp := server.Client(password, settings, request)
 
-		if resp.Type == server.MESSAGE_TYPE_WRONG_CREDENTIALS {
-			fmt.Println("Wrong credentials")
-			os.Exit(0)
-		}
+		exitOnAuthenticationFailure(resp)
 
-		if resp.Type == server.MESSAGE_TYPE_BANNED {
-			fmt.Println("You're banned please try after a while..")
-			os.Exit(0)
+		if resp.Type == server.MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS {
+			fmt.Fprintln(os.Stderr, "Private key already exists in server")
+			os.Exit(EXIT_ERROR)
 		}
 
-		if resp.Type == server.MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS {
-			fmt.Println("Private key already exists in server")
-			os.Exit(0)
+		if resp.Type == server.MESSAGE_TYPE_PRIVATE_KEY_NOT_ENCRYPTED || resp.Type == server.MESSAGE_TYPE_INTERNAL_ERROR {
+			fmt.Fprintln(os.Stderr, "Server could not save private key")
+			os.Exit(EXIT_ERROR)
 		}
 
-		if resp.Type == server.MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS {
-			fmt.Println("Server successfully saved private key.")
+		if resp.Type == server.MESSAGE_TYPE_PRIVATE_KEY_SAVED {
+			fmt.Fprintln(os.Stderr, "Server successfully saved private key.")
 		}
 
-		pubKeyFile, _ := os.OpenFile(service.PUBLIC_KEY_LOCATION, os.O_WRONLY|os.O_CREATE, 0666)
+		fmt.Fprintf(os.Stderr, "Server certificate fingerprint: %s\n", settings[server.SETTING_SERVER_FINGERPRINT])
+
+		pubKeyFile, err := os.OpenFile(service.PUBLIC_KEY_LOCATION, os.O_WRONLY|os.O_CREATE, 0666)
+		exitOnError(err)
 
 		writer := bufio.NewWriter(pubKeyFile)
 
@@ -111,52 +257,128 @@ func main() {
 
 		storageService.StoreSettings(settings)
 	} else {
-		password := harpocratesCli.AskMasterPassword()
+		password = masterPassword(harpocratesCli)
 
 		settings = storageService.ReadSettings()
 		encryptionBits := settings["bits"]
 		publicKey := settings["public_key"]
-		serverHost := settings["server_host"]
-		serverPort := settings["server_port"]
 
 		bits, _ := strconv.Atoi(encryptionBits)
 
 		cryptoManager = core.NewCryptoManager(bits)
 
-		pubKeyFile, _ := os.OpenFile(publicKey, os.O_RDONLY|os.O_CREATE, 0666)
-		bytes, _ := ioutil.ReadAll(pubKeyFile)
+		bytes, err := ioutil.ReadFile(publicKey)
+		exitOnError(err)
 
-		pub = cryptoManager.BytesToPublicKey(bytes)
-
-		pubKeyFile.Close()
+		pub, err = cryptoManager.BytesToPublicKey(bytes)
+		exitOnError(err)
 
 		request := server.PrivateKeyExchange{
-			PasswordHash: password,
-			Type:         server.MESSAGE_TYPE_GET_PRIVATE_KEY,
+			PublicKey: string(bytes),
+			Type:      server.MESSAGE_TYPE_GET_PRIVATE_KEY,
 		}
 
-		resp := server.Client(password, serverHost, serverPort, request)
+		pinnedFingerprint := settings[server.SETTING_SERVER_FINGERPRINT]
+
+		resp := server.Client(password, settings, request)
 
-		if resp.Type == server.MESSAGE_TYPE_WRONG_CREDENTIALS {
-			fmt.Println("Wrong credentials")
-			os.Exit(0)
+		if settings[server.SETTING_SERVER_FINGERPRINT] != pinnedFingerprint {
+			fmt.Fprintf(os.Stderr, "Trusting server certificate %s on first use\n", settings[server.SETTING_SERVER_FINGERPRINT])
+			storageService.StoreSettings(settings)
 		}
 
-		if resp.Type == server.MESSAGE_TYPE_BANNED {
-			fmt.Println("You're banned please try after a while")
-			os.Exit(0)
+		exitOnAuthenticationFailure(resp)
+
+		privateKey := []byte(resp.PrivateKey)
+
+		if core.IsPassphraseSealed(privateKey) {
+			privateKey, err = core.OpenWithPassphrase(privateKey, password)
+			exitOnError(err)
+		} else {
+			upgradePrivateKey(password, settings, privateKey)
 		}
 
-		pri = cryptoManager.BytesToPrivateKey([]byte(resp.PrivateKey))
+		pri, err = cryptoManager.BytesToPrivateKey(privateKey)
+		exitOnError(err)
 	}
 
-	passwordService := service.NewPasswordService(
-		cryptoManager,
-		pri,
-		pub,
-		storageService,
-	)
+	return cryptoManager, pri, pub, password
+}
 
-	harpocratesCli.SetPasswordService(*passwordService)
-	harpocratesCli.Repl()
+func masterPassword(harpocratesCli *cli.Cli) string {
+	if password, ok := os.LookupEnv(MASTER_PASSWORD_ENV); ok {
+		return password
+	}
+
+	return harpocratesCli.AskMasterPassword()
+}
+
+// upgradePrivateKey replaces a private key that an older version escrowed as
+// plain PEM with its passphrase-sealed form.
+func upgradePrivateKey(password string, settings map[string]string, privateKey []byte) {
+	sealedPrivateKey, err := core.SealWithPassphrase(privateKey, password)
+	exitOnError(err)
+
+	request := server.PrivateKeyExchange{
+		PrivateKey: string(sealedPrivateKey),
+		Type:       server.MESSAGE_TYPE_UPGRADE_PRIVATE_KEY,
+	}
+
+	resp := server.Client(password, settings, request)
+
+	if resp.Type == server.MESSAGE_TYPE_PRIVATE_KEY_SAVED {
+		fmt.Fprintln(os.Stderr, "Private key on server is now encrypted with your master password.")
+	}
+}
+
+func exitOnAuthenticationFailure(resp *server.PrivateKeyExchange) {
+	if resp.Type == server.MESSAGE_TYPE_WRONG_CREDENTIALS {
+		fmt.Fprintln(os.Stderr, "Wrong credentials")
+		os.Exit(EXIT_AUTHENTICATION_FAILED)
+	}
+
+	if resp.Type == server.MESSAGE_TYPE_BANNED {
+		fmt.Fprintln(os.Stderr, "You're banned please try after a while..")
+		os.Exit(EXIT_AUTHENTICATION_FAILED)
+	}
+
+	if resp.Type == server.MESSAGE_TYPE_USER_DISABLED {
+		fmt.Fprintln(os.Stderr, "Your account is disabled, please contact the administrator of the server")
+		os.Exit(EXIT_AUTHENTICATION_FAILED)
+	}
+}
+
+func exitOnRegistrationFailure(resp *server.PrivateKeyExchange) {
+	exitOnAuthenticationFailure(resp)
+
+	switch resp.Type {
+	case server.MESSAGE_TYPE_REGISTERED:
+		fmt.Fprintln(os.Stderr, "Account created on server.")
+		return
+	case server.MESSAGE_TYPE_USER_ALREADY_EXISTS:
+		fmt.Fprintln(os.Stderr, "Username is already taken")
+	case server.MESSAGE_TYPE_INVALID_USERNAME:
+		fmt.Fprintln(os.Stderr, users.ErrInvalidUsername.Error())
+	case server.MESSAGE_TYPE_REGISTRATION_CLOSED:
+		fmt.Fprintln(os.Stderr, "Server does not accept new users")
+	default:
+		fmt.Fprintln(os.Stderr, "Server could not create account")
+	}
+
+	os.Exit(EXIT_ERROR)
+}
+
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, err.Error())
+
+	var notFound *service.PasswordNotFoundError
+	if errors.As(err, &notFound) {
+		os.Exit(EXIT_NOT_FOUND)
+	}
+
+	os.Exit(EXIT_ERROR)
 }
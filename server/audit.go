@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/blueskan/harpocrates/audit"
+)
+
+// SETTING_AUDIT_FILE is the server setting holding where the audit log is
+// kept, see audit.NewLog.
+const SETTING_AUDIT_FILE = "audit_file"
+
+// record writes an event of the connection to the audit log, the user of
+// the connection is used unless event has one. A failed write is logged and
+// the request is served anyway.
+func (c *connState) record(event audit.Event) {
+	if c.auditLog == nil {
+		return
+	}
+
+	if c.ip != nil {
+		event.Address = c.ip.String()
+	}
+
+	if len(event.User) <= 0 {
+		event.User = c.username
+	}
+
+	event.Certificate = c.certificate
+
+	if err := c.auditLog.Record(event); err != nil {
+		log.Printf("Harpocrates Server: audit: %s", err)
+	}
+}
+
+// recordRequest writes the outcome of a request to the audit log.
+func (c *connState) recordRequest(operation string, request *PrivateKeyExchange, message *PrivateKeyExchange) {
+	event := audit.Event{
+		Operation: operation,
+		Outcome:   audit.OUTCOME_OK,
+		Detail:    requestDetail(request),
+	}
+
+	if _, ok := messageStatuses[message.Type]; ok {
+		event.Outcome = message.Type
+	}
+
+	if operation == MESSAGE_TYPE_REGISTER {
+		event.User = usernameOrDefault(request.Username)
+	}
+
+	c.record(event)
+}
+
+func requestDetail(request *PrivateKeyExchange) string {
+	details := make([]string, 0, 3)
+
+	if len(request.VaultName) > 0 {
+		details = append(details, fmt.Sprintf("vault `%s`", request.VaultName))
+	}
+
+	if len(request.Member) > 0 {
+		details = append(details, fmt.Sprintf("member `%s`", request.Member))
+	}
+
+	if len(request.Role) > 0 {
+		details = append(details, "role "+request.Role)
+	}
+
+	return strings.Join(details, ", ")
+}
@@ -1,37 +1,636 @@
 package server
 
 import (
+	"bufio"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"time"
 
+	"github.com/blueskan/harpocrates/core"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/vaults"
 	"github.com/vmihailenco/msgpack"
 )
 
-func Client(password, host, port string, request PrivateKeyExchange) *PrivateKeyExchange {
-	cert, err := tls.LoadX509KeyPair("server/util/certs/client.pem", "server/util/certs/client.key")
+// SETTING_USERNAME is the client setting holding the account on the server,
+// clients set up before accounts existed have none and use DEFAULT_USERNAME.
+const SETTING_USERNAME = "username"
 
+// Client authenticates with the saved session token or SRP and sends request
+// to the server configured in settings. When the server certificate gets pinned on first use its
+// fingerprint is added to settings, so callers should persist settings.
+func Client(password string, settings map[string]string, request PrivateKeyExchange) *PrivateKeyExchange {
+	session, err := Connect(settings)
 	if err != nil {
-		log.Fatalf("server: loadkeys: %s", err)
+		log.Fatalf("client: %s", err)
 	}
+	defer session.Close()
 
-	config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	resp, err := authenticate(session, password, settings)
 
-	conn, err := tls.Dial("tcp", host+":"+port, &config)
+	if err == nil {
+		resp, err = session.Do(request)
+	}
+
+	if resp == nil {
+		log.Fatalf("client: %s", err)
+	}
+
+	log.Print("client: exiting")
+
+	return resp
+}
+
+// Register creates the account of settings on the server, only the SRP
+// verifier of password is sent.
+func Register(password string, settings map[string]string) *PrivateKeyExchange {
+	username := settings[SETTING_USERNAME]
+
+	salt, verifier, err := core.NewSrpVerifier(username, password)
+	if err != nil {
+		log.Fatalf("client: srp: %s", err)
+	}
+
+	session, err := Connect(settings)
+	if err != nil {
+		log.Fatalf("client: %s", err)
+	}
+	defer session.Close()
+
+	resp, err := session.call(OP_REGISTER, PrivateKeyExchange{
+		Type:        MESSAGE_TYPE_REGISTER,
+		Username:    username,
+		SrpSalt:     salt,
+		SrpVerifier: verifier,
+	})
+
+	if resp == nil {
+		log.Fatalf("client: %s", err)
+	}
+
+	return resp
+}
+
+var ErrServerProof = errors.New("server could not prove that it knows the master password verifier")
+var ErrNotSupported = errors.New("server does not support this request, please upgrade it")
+
+// ProtocolError is a response with a status other than STATUS_OK, Type is
+// the message type of the refusal.
+type ProtocolError struct {
+	Status  Status
+	Type    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return ErrRequestRejected
+}
+
+// Session is a connection to the server. Hello negotiated the version and
+// capabilities when it was opened, after Login it carries any number of
+// requests.
+type Session struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	username     string
+	version      uint16
+	capabilities []string
+	idleTimeout  time.Duration
+	lastUsed     time.Time
+	nextId       uint64
+}
+
+// Connect opens a session with the server configured in settings.
+func Connect(settings map[string]string) (*Session, error) {
+	conn, err := dial(settings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := newSession(conn, usernameOrDefault(settings[SETTING_USERNAME]))
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func newSession(conn net.Conn, username string) (*Session, error) {
+	s := &Session{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		username: username,
+	}
+
+	payload, err := msgpack.Marshal(&Hello{
+		MinVersion:   PROTOCOL_MIN_VERSION,
+		MaxVersion:   PROTOCOL_VERSION,
+		Capabilities: CAPABILITIES,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.roundTrip(&Frame{Op: OP_HELLO, Payload: payload})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Status != STATUS_OK {
+		return nil, &ProtocolError{Status: response.Status, Message: response.Error}
+	}
+
+	hello := new(Hello)
+
+	if err := msgpack.Unmarshal(response.Payload, hello); err != nil {
+		return nil, fmt.Errorf("hello: %w", err)
+	}
+
+	s.version = hello.Version
+	s.capabilities = hello.Capabilities
+	s.idleTimeout = time.Duration(hello.IdleTimeout)
+
+	return s, nil
+}
+
+// Supports tells whether both sides negotiated capability.
+func (s *Session) Supports(capability string) bool {
+	return containsString(s.capabilities, capability)
+}
+
+// Idle tells whether the server may have closed the session in the
+// meantime.
+func (s *Session) Idle() bool {
+	return time.Since(s.lastUsed) > s.idleTimeout/2
+}
+
+// Login authenticates the user of the session with SRP. A refusal is
+// returned both as response and as *ProtocolError.
+func (s *Session) Login(password string) (*PrivateKeyExchange, error) {
+	srpClient, err := core.NewSrpClient(s.username, password)
+	if err != nil {
+		return nil, fmt.Errorf("srp: %w", err)
+	}
+
+	challenge, err := s.call(OP_SRP_INIT, PrivateKeyExchange{
+		Type:         MESSAGE_TYPE_SRP_INIT,
+		Username:     s.username,
+		SrpPublicKey: srpClient.PublicKey(),
+	})
+
+	if err != nil {
+		return challenge, err
+	}
+
+	proof, err := srpClient.Proof(challenge.SrpSalt, challenge.SrpPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("srp: %w", err)
+	}
+
+	resp, err := s.call(OP_SRP_PROOF, PrivateKeyExchange{
+		SrpProof: proof,
+	})
+
+	if err != nil {
+		return resp, err
+	}
+
+	if !srpClient.VerifyServer(resp.SrpProof) {
+		return nil, ErrServerProof
+	}
+
+	return resp, nil
+}
+
+// Resume logs the session in with a session token of an earlier Login.
+func (s *Session) Resume(token string) (*PrivateKeyExchange, error) {
+	if !s.Supports(CAPABILITY_SESSION_TOKENS) {
+		return nil, ErrNotSupported
+	}
+
+	return s.call(OP_RESUME, PrivateKeyExchange{SessionToken: token})
+}
+
+// Refresh replaces the session token of the logged in session with a new
+// one, the old token is refused afterwards.
+func (s *Session) Refresh() (*PrivateKeyExchange, error) {
+	if !s.Supports(CAPABILITY_SESSION_TOKENS) {
+		return nil, ErrNotSupported
+	}
+
+	return s.call(OP_REFRESH_SESSION, PrivateKeyExchange{})
+}
+
+// Logout revokes the session token of the session and token, which may be
+// empty.
+func (s *Session) Logout(token string) error {
+	if !s.Supports(CAPABILITY_SESSION_TOKENS) {
+		return ErrNotSupported
+	}
+
+	_, err := s.call(OP_LOGOUT, PrivateKeyExchange{SessionToken: token})
+
+	return err
+}
+
+// authenticate resumes the saved session of settings and falls back to SRP
+// when there is none or the server refuses it. A token close to expiry is
+// refreshed, new tokens are saved for the following commands.
+func authenticate(session *Session, password string, settings map[string]string) (*PrivateKeyExchange, error) {
+	if saved := loadSession(settings); saved != nil && session.Supports(CAPABILITY_SESSION_TOKENS) {
+		resp, err := session.Resume(saved.Token)
+
+		var protocolError *ProtocolError
+
+		if err == nil {
+			if saved.stale() {
+				if refreshed, err := session.Refresh(); err == nil {
+					keepSession(settings, refreshed)
+				}
+			}
+
+			return resp, nil
+		}
+
+		if !errors.As(err, &protocolError) || protocolError.Type != MESSAGE_TYPE_SESSION_INVALID {
+			return resp, err
+		}
+
+		deleteSession(settings)
+	}
+
+	resp, err := session.Login(password)
+
+	if err == nil {
+		keepSession(settings, resp)
+	}
+
+	return resp, err
+}
+
+func keepSession(settings map[string]string, resp *PrivateKeyExchange) {
+	if len(resp.SessionToken) == 0 {
+		return
+	}
+
+	if err := saveSession(settings, resp.SessionToken, resp.SessionExpiresAt); err != nil {
+		log.Printf("client: session: %s", err)
+	}
+}
+
+// Logout revokes the saved session token of settings on the server and
+// forgets it.
+func Logout(settings map[string]string) error {
+	saved := loadSession(settings)
+
+	if saved != nil {
+		session, err := Connect(settings)
+
+		if err != nil {
+			return err
+		}
+
+		defer session.Close()
+
+		if err := session.Logout(saved.Token); err != nil {
+			return err
+		}
+	}
+
+	return deleteSession(settings)
+}
+
+// Do sends a request of the logged in user, its Type selects the operation.
+func (s *Session) Do(request PrivateKeyExchange) (*PrivateKeyExchange, error) {
+	op, ok := typeOp(request.Type)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotSupported, request.Type)
+	}
+
+	if capability, ok := opCapabilities[op]; ok && !s.Supports(capability) {
+		return nil, ErrNotSupported
+	}
+
+	return s.call(op, request)
+}
+
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// call sends a request and returns the response, which is also returned
+// together with a *ProtocolError when the server refused the request.
+func (s *Session) call(op Op, request PrivateKeyExchange) (*PrivateKeyExchange, error) {
+	payload, err := msgpack.Marshal(&request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.roundTrip(&Frame{Version: s.version, Op: op, Payload: payload})
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(PrivateKeyExchange)
+
+	if err := msgpack.Unmarshal(response.Payload, resp); err != nil && response.Status == STATUS_OK {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+
+	if response.Status != STATUS_OK {
+		return resp, &ProtocolError{Status: response.Status, Type: resp.Type, Message: response.Error}
+	}
+
+	return resp, nil
+}
+
+func (s *Session) roundTrip(frame *Frame) (*Frame, error) {
+	s.nextId++
+	frame.Id = s.nextId
+
+	if err := writeFrame(s.conn, frame); err != nil {
+		return nil, err
+	}
+
+	response, err := readFrame(s.reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Id != frame.Id {
+		return nil, fmt.Errorf("response to request %d, want: %d", response.Id, frame.Id)
+	}
+
+	s.lastUsed = time.Now()
+
+	return response, nil
+}
+
+func serverAddress(settings map[string]string) string {
+	return net.JoinHostPort(settings["server_host"], settings["server_port"])
+}
+
+func dial(settings map[string]string) (*tls.Conn, error) {
+	config, err := clientTlsConfig(settings)
 	if err != nil {
-		log.Fatalf("client: dial: %s", err)
+		return nil, err
+	}
+
+	conn, err := tls.Dial("tcp", serverAddress(settings), config)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
 	}
-	defer conn.Close()
 	log.Println("client: connected to: ", conn.RemoteAddr())
 
-	b, err := msgpack.Marshal(request)
-	conn.Write(b)
+	return conn, nil
+}
+
+var ErrRequestRejected = errors.New("server rejected the request")
 
-	decoder := msgpack.NewDecoder(conn)
-	tmpStruct := new(PrivateKeyExchange)
+var sharedVaultErrors = map[string]error{
+	MESSAGE_TYPE_VAULT_NOT_FOUND:       service.ErrSharedVaultNotFound,
+	MESSAGE_TYPE_VAULT_ALREADY_EXISTS:  service.ErrSharedVaultExists,
+	MESSAGE_TYPE_INVALID_VAULT_NAME:    vaults.ErrInvalidVaultName,
+	MESSAGE_TYPE_VAULT_FORBIDDEN:       service.ErrSharedVaultForbidden,
+	MESSAGE_TYPE_VAULT_KEY_CHANGED:     service.ErrSharedVaultKeyChanged,
+	MESSAGE_TYPE_VAULT_CHANGED:         service.ErrSharedVaultConflict,
+	MESSAGE_TYPE_MEMBER_NOT_FOUND:      service.ErrMemberNotFound,
+	MESSAGE_TYPE_MEMBER_ALREADY_EXISTS: service.ErrMemberExists,
+	MESSAGE_TYPE_INVALID_ROLE:          service.ErrInvalidRole,
+}
 
-	decoder.Decode(tmpStruct)
+// syncTransport keeps its session open for the following requests.
+type syncTransport struct {
+	password string
+	settings map[string]string
+	session  *Session
+}
 
-	log.Print("client: exiting")
+// NewSyncTransport returns a service.SyncTransport that exchanges the synced
+// entries with the server configured in settings.
+func NewSyncTransport(password string, settings map[string]string) service.SyncTransport {
+	return &syncTransport{
+		password: password,
+		settings: settings,
+	}
+}
+
+func (t *syncTransport) Pull(since uint64) ([]service.SyncEntry, uint64, error) {
+	resp, err := t.send(PrivateKeyExchange{
+		Type:         MESSAGE_TYPE_PULL_VAULT,
+		SyncRevision: since,
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.SyncEntries, resp.SyncRevision, nil
+}
+
+func (t *syncTransport) Push(entries []service.SyncEntry) ([]service.SyncEntry, error) {
+	resp, err := t.send(PrivateKeyExchange{
+		Type:        MESSAGE_TYPE_PUSH_VAULT,
+		SyncEntries: entries,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.SyncEntries, nil
+}
+
+func (t *syncTransport) send(request PrivateKeyExchange) (*PrivateKeyExchange, error) {
+	session, err := t.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := session.Do(request)
+
+	var protocolError *ProtocolError
+
+	if err != nil && !errors.As(err, &protocolError) && err != ErrNotSupported {
+		session.Close()
+		t.session = nil
+	}
+
+	return resp, err
+}
+
+func (t *syncTransport) connect() (*Session, error) {
+	if t.session != nil && !t.session.Idle() {
+		return t.session, nil
+	}
+
+	if t.session != nil {
+		t.session.Close()
+		t.session = nil
+	}
+
+	session, err := Connect(t.settings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := authenticate(session, t.password, t.settings); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	t.session = session
+
+	return session, nil
+}
+
+type sharedVaultTransport struct {
+	syncTransport
+}
+
+// NewSharedVaultTransport returns a service.SharedVaultTransport that
+// exchanges the shared vaults with the server configured in settings.
+func NewSharedVaultTransport(password string, settings map[string]string) service.SharedVaultTransport {
+	return &sharedVaultTransport{
+		syncTransport{
+			password: password,
+			settings: settings,
+		},
+	}
+}
+
+func (t *sharedVaultTransport) CreateVault(name string, wrappedKey []byte) error {
+	_, err := t.sendShared(PrivateKeyExchange{
+		Type:       MESSAGE_TYPE_CREATE_VAULT,
+		VaultName:  name,
+		WrappedKey: wrappedKey,
+	})
+
+	return err
+}
+
+func (t *sharedVaultTransport) Vaults() ([]service.SharedVault, error) {
+	resp, err := t.sendShared(PrivateKeyExchange{
+		Type: MESSAGE_TYPE_LIST_VAULTS,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.SharedVaults, nil
+}
+
+func (t *sharedVaultTransport) Vault(name string) (*service.SharedVault, error) {
+	resp, err := t.sendShared(PrivateKeyExchange{
+		Type:      MESSAGE_TYPE_GET_VAULT,
+		VaultName: name,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.SharedVault, nil
+}
+
+func (t *sharedVaultTransport) PublicKey(username string) ([]byte, error) {
+	resp, err := t.sendShared(PrivateKeyExchange{
+		Type:   MESSAGE_TYPE_GET_PUBLIC_KEY,
+		Member: username,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(resp.PublicKey), nil
+}
+
+func (t *sharedVaultTransport) AddMember(vault, username, role string, wrappedKey []byte) error {
+	_, err := t.sendShared(PrivateKeyExchange{
+		Type:       MESSAGE_TYPE_ADD_MEMBER,
+		VaultName:  vault,
+		Member:     username,
+		Role:       role,
+		WrappedKey: wrappedKey,
+	})
+
+	return err
+}
+
+func (t *sharedVaultTransport) SetRole(vault, username, role string) error {
+	_, err := t.sendShared(PrivateKeyExchange{
+		Type:      MESSAGE_TYPE_SET_ROLE,
+		VaultName: vault,
+		Member:    username,
+		Role:      role,
+	})
+
+	return err
+}
+
+func (t *sharedVaultTransport) Rekey(vault string, keyVersion, revision uint64, members map[string][]byte, entries []service.SyncEntry) error {
+	_, err := t.sendShared(PrivateKeyExchange{
+		Type:         MESSAGE_TYPE_REKEY_VAULT,
+		VaultName:    vault,
+		KeyVersion:   keyVersion,
+		SyncRevision: revision,
+		Members:      members,
+		SyncEntries:  entries,
+	})
+
+	return err
+}
+
+func (t *sharedVaultTransport) Push(vault string, keyVersion uint64, entries []service.SyncEntry) ([]service.SyncEntry, error) {
+	resp, err := t.sendShared(PrivateKeyExchange{
+		Type:        MESSAGE_TYPE_PUSH_SHARED,
+		VaultName:   vault,
+		KeyVersion:  keyVersion,
+		SyncEntries: entries,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.SyncEntries, nil
+}
+
+// sendShared maps the refusals of the server to the errors of the service.
+func (t *sharedVaultTransport) sendShared(request PrivateKeyExchange) (*PrivateKeyExchange, error) {
+	resp, err := t.send(request)
+
+	var protocolError *ProtocolError
+
+	if errors.As(err, &protocolError) {
+		if sharedVaultError, ok := sharedVaultErrors[protocolError.Type]; ok {
+			return nil, sharedVaultError
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
-	return tmpStruct
+	return resp, nil
 }
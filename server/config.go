@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blueskan/harpocrates/bans"
+)
+
+// Settings of the listener and the data of the server. bind_address is a
+// comma separated list of addresses, IPv6 ones are written like `::1`.
+// data_dir holds the users, shared vaults, bans and audit log unless their
+// own settings point elsewhere.
+const SETTING_PORT = "port"
+const SETTING_BIND_ADDRESS = "bind_address"
+const SETTING_DATA_DIR = "data_dir"
+
+const DEFAULT_BIND_ADDRESS = "0.0.0.0"
+
+// ENV_PREFIX starts the environment variables overriding server settings,
+// HARPOCRATES_PORT overrides port.
+const ENV_PREFIX = "HARPOCRATES_"
+
+// ServerSetting is a setting of server_harpocrates.ini which may also be
+// given as environment variable or flag.
+type ServerSetting struct {
+	Key   string
+	Usage string
+}
+
+var SERVER_SETTINGS = []ServerSetting{
+	{SETTING_PORT, "port to listen on"},
+	{SETTING_BIND_ADDRESS, "comma separated addresses to listen on, default " + DEFAULT_BIND_ADDRESS},
+	{SETTING_DATA_DIR, "directory of the users, shared vaults, bans and audit log, default the home directory"},
+	{SETTING_USERS_DIR, "directory of the user accounts"},
+	{SETTING_VAULTS_DIR, "directory of the shared vaults"},
+	{SETTING_ALLOW_REGISTRATION, "whether new users may register, true or false"},
+	{SETTING_TLS_CERT, "server certificate"},
+	{SETTING_TLS_KEY, "key of the server certificate"},
+	{SETTING_TLS_CA, "CA certificate of the client certificates"},
+	{SETTING_TLS_CRL, "certificate revocation list of the client certificates"},
+	{SETTING_TLS_MIN_VERSION, "oldest TLS version, 1.2 or 1.3"},
+	{SETTING_TLS_CIPHER_SUITES, "comma separated TLS 1.2 cipher suites like TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+	{SETTING_MAX_CONNECTIONS, "connections served at once"},
+	{SETTING_HANDSHAKE_TIMEOUT, "longest TLS handshake"},
+	{SETTING_READ_TIMEOUT, "how long a connection may wait for its next request"},
+	{SETTING_WRITE_TIMEOUT, "longest writing of a response"},
+	{SETTING_SHUTDOWN_TIMEOUT, "how long a stopping server waits for the requests in flight"},
+	{SETTING_SESSION_TTL, "how long a session token is valid"},
+	{SETTING_AUDIT_FILE, "file of the audit log"},
+	{SETTING_BAN_FILE, "file of the bans"},
+	{SETTING_BAN_MAX_FAILURES, "failed logins until an address is banned"},
+	{SETTING_BAN_FIND_TIME, "how long failed logins are remembered"},
+	{SETTING_BAN_TIME, "length of the first ban"},
+	{SETTING_BAN_BACKOFF, "factor of every further ban"},
+	{SETTING_BAN_MAX_TIME, "longest ban"},
+	{SETTING_BAN_IPV4_PREFIX, "bits of the IPv4 subnets banned as a whole"},
+	{SETTING_BAN_IPV6_PREFIX, "bits of the IPv6 subnets banned as a whole"},
+	{SETTING_BAN_ALLOW, "comma separated addresses and subnets which are never banned"},
+}
+
+// dataFiles are the settings which default to a file of data_dir.
+var dataFiles = map[string]string{
+	SETTING_USERS_DIR:  "users",
+	SETTING_VAULTS_DIR: "vaults",
+	SETTING_BAN_FILE:   "bans.db",
+	SETTING_AUDIT_FILE: "audit.log",
+}
+
+// EnvName returns the environment variable of a server setting.
+func EnvName(key string) string {
+	return ENV_PREFIX + strings.ToUpper(key)
+}
+
+// ServerSettings returns settings overridden by the environment variables
+// and then by flags, and with the data files placed in data_dir. settings
+// itself is not changed, so it can still be stored.
+func ServerSettings(settings, flags map[string]string) map[string]string {
+	effective := make(map[string]string, len(settings))
+
+	for key, value := range settings {
+		effective[key] = value
+	}
+
+	for _, setting := range SERVER_SETTINGS {
+		if value, ok := os.LookupEnv(EnvName(setting.Key)); ok {
+			effective[setting.Key] = value
+		}
+
+		if value, ok := flags[setting.Key]; ok {
+			effective[setting.Key] = value
+		}
+	}
+
+	if dataDir := effective[SETTING_DATA_DIR]; len(dataDir) > 0 {
+		for key, name := range dataFiles {
+			if len(effective[key]) <= 0 {
+				effective[key] = filepath.Join(dataDir, name)
+			}
+		}
+	}
+
+	return effective
+}
+
+// serverConfig is what the server needs of its settings, checked before it
+// starts.
+type serverConfig struct {
+	addresses  []string
+	tls        *tls.Config
+	limits     limits
+	banPolicy  bans.Policy
+	sessionTtl time.Duration
+}
+
+// configError lists every problem of the settings, so they can be fixed at
+// once.
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid server settings:\n  " + strings.Join(e, "\n  ")
+}
+
+func loadConfig(settings map[string]string) (*serverConfig, error) {
+	config := new(serverConfig)
+	problems := make(configError, 0)
+
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	var err error
+
+	config.addresses, err = listenAddresses(settings)
+	check(err)
+
+	if dataDir := settings[SETTING_DATA_DIR]; len(dataDir) > 0 {
+		check(checkDataDir(dataDir))
+	}
+
+	if value := settings[SETTING_ALLOW_REGISTRATION]; len(value) > 0 && value != "true" && value != "false" {
+		check(fmt.Errorf("%s should be true or false, got: %s", SETTING_ALLOW_REGISTRATION, value))
+	}
+
+	config.tls, err = serverTlsConfig(settings)
+	check(err)
+
+	config.limits, err = newLimits(settings)
+	check(err)
+
+	config.banPolicy, err = BanPolicy(settings)
+	check(err)
+
+	config.sessionTtl, err = durationSetting(settings, SETTING_SESSION_TTL, DEFAULT_SESSION_TTL)
+	check(err)
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return config, nil
+}
+
+func listenAddresses(settings map[string]string) ([]string, error) {
+	port, ok := settings[SETTING_PORT]
+
+	if !ok || len(port) <= 0 {
+		return nil, fmt.Errorf("%s is required", SETTING_PORT)
+	}
+
+	if _, err := intSetting(settings, SETTING_PORT, 0, 1, 65535); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0)
+
+	for _, host := range strings.Split(settingOrDefault(settings, SETTING_BIND_ADDRESS, DEFAULT_BIND_ADDRESS), ",") {
+		host = strings.Trim(strings.TrimSpace(host), "[]")
+
+		if len(host) <= 0 {
+			continue
+		}
+
+		if net.ParseIP(host) == nil && strings.ContainsAny(host, ":/ ") {
+			return nil, fmt.Errorf("%s should hold addresses without port like 0.0.0.0 or ::, got: %s", SETTING_BIND_ADDRESS, host)
+		}
+
+		addresses = append(addresses, net.JoinHostPort(host, port))
+	}
+
+	if len(addresses) <= 0 {
+		return nil, fmt.Errorf("%s holds no address", SETTING_BIND_ADDRESS)
+	}
+
+	return addresses, nil
+}
+
+func checkDataDir(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("%s: %s", SETTING_DATA_DIR, err)
+	}
+
+	return nil
+}
+
+// listenNetwork keeps IPv4 and IPv6 addresses apart, so 0.0.0.0 and :: can
+// both be bound.
+func listenNetwork(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return "tcp4"
+		}
+
+		return "tcp6"
+	}
+
+	return "tcp"
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blueskan/harpocrates/ca"
+)
+
+func Test_it_should_override_settings_by_env_and_flags(t *testing.T) {
+	os.Setenv(EnvName(SETTING_PORT), "9000")
+	os.Setenv(EnvName(SETTING_BIND_ADDRESS), "127.0.0.1, ::1")
+	defer os.Unsetenv(EnvName(SETTING_PORT))
+	defer os.Unsetenv(EnvName(SETTING_BIND_ADDRESS))
+
+	stored := map[string]string{SETTING_PORT: "8000", SETTING_DATA_DIR: "/srv/harpocrates", SETTING_BAN_FILE: "/var/lib/bans.db"}
+	settings := ServerSettings(stored, map[string]string{SETTING_PORT: "9443"})
+
+	if stored[SETTING_PORT] != "8000" || len(stored[SETTING_USERS_DIR]) > 0 {
+		t.Errorf("Stored settings were changed, got: %v", stored)
+	}
+
+	addresses, err := listenAddresses(settings)
+
+	if err != nil || strings.Join(addresses, " ") != "127.0.0.1:9443 [::1]:9443" {
+		t.Errorf("Addresses were incorrect, got: %v, %v, want: %s", addresses, err, "127.0.0.1:9443 [::1]:9443")
+	}
+
+	if want := filepath.Join("/srv/harpocrates", "users"); settings[SETTING_USERS_DIR] != want {
+		t.Errorf("Users dir was incorrect, got: %s, want: %s", settings[SETTING_USERS_DIR], want)
+	}
+
+	if settings[SETTING_BAN_FILE] != "/var/lib/bans.db" {
+		t.Errorf("Ban file was incorrect, got: %s, want: %s", settings[SETTING_BAN_FILE], "/var/lib/bans.db")
+	}
+}
+
+func Test_it_should_report_every_invalid_setting(t *testing.T) {
+	_, err := loadConfig(map[string]string{
+		SETTING_PORT:              "70000",
+		SETTING_TLS_CERT:          "missing.pem",
+		SETTING_TLS_KEY:           "missing.key",
+		SETTING_TLS_CA:            "missing-ca.pem",
+		SETTING_TLS_MIN_VERSION:   "1.0",
+		SETTING_TLS_CIPHER_SUITES: "TLS_RSA_WITH_RC4_128_SHA",
+		SETTING_READ_TIMEOUT:      "soon",
+		SETTING_BAN_ALLOW:         "not an address",
+	})
+
+	var problems configError
+
+	if !errors.As(err, &problems) || len(problems) != 4 {
+		t.Fatalf("Problems were incorrect, got: %v, want: %d", err, 4)
+	}
+
+	for i, setting := range []string{SETTING_PORT, SETTING_TLS_CERT, SETTING_READ_TIMEOUT, SETTING_BAN_ALLOW} {
+		if !strings.HasPrefix(problems[i], setting) {
+			t.Errorf("Problem was incorrect, got: %s, want: %s", problems[i], setting)
+		}
+	}
+
+	settings := testCertificates(t)
+	settings[SETTING_PORT] = "8443"
+	settings[SETTING_BIND_ADDRESS] = "0.0.0.0:8443"
+	settings[SETTING_TLS_MIN_VERSION] = "1.0"
+	settings[SETTING_TLS_CIPHER_SUITES] = "TLS_RSA_WITH_RC4_128_SHA"
+
+	_, err = loadConfig(settings)
+
+	if !errors.As(err, &problems) || len(problems) != 2 || !strings.HasPrefix(problems[0], SETTING_BIND_ADDRESS) || !strings.HasPrefix(problems[1], SETTING_TLS_MIN_VERSION) {
+		t.Errorf("Problems were incorrect, got: %v", err)
+	}
+}
+
+func Test_it_should_require_certificates(t *testing.T) {
+	_, err := loadConfig(map[string]string{SETTING_PORT: "8443"})
+
+	var problems configError
+
+	if !errors.As(err, &problems) || len(problems) != 1 || !strings.HasPrefix(problems[0], SETTING_TLS_CERT+", "+SETTING_TLS_KEY+", "+SETTING_TLS_CA) {
+		t.Errorf("Problems were incorrect, got: %v, want: %s", err, SETTING_TLS_CERT)
+	}
+
+	if _, err := loadConfig(testCertificates(t)); err == nil {
+		t.Errorf("Port was not required")
+	}
+}
+
+// testCertificates returns the certificate settings of a server, issued by a
+// new certificate authority.
+func testCertificates(t *testing.T) map[string]string {
+	dir := t.TempDir()
+	authority := ca.NewAuthority(dir)
+
+	if err := authority.Init("Harpocrates Test CA"); err != nil {
+		t.Fatal(err)
+	}
+
+	certPem, keyPem, err := authority.IssueServer("localhost", []string{"localhost", "127.0.0.1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "server.pem"), certPem, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "server.key"), keyPem, 0600)
+
+	return map[string]string{
+		SETTING_TLS_CERT: filepath.Join(dir, "server.pem"),
+		SETTING_TLS_KEY:  filepath.Join(dir, "server.key"),
+		SETTING_TLS_CA:   authority.CertificateLocation(),
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blueskan/harpocrates/bans"
+)
+
+// Settings of the ban policy, see bans.Policy. Durations are written like
+// `10m` or `24h`, ban_allow is a comma separated list of addresses and
+// subnets which are never banned.
+const SETTING_BAN_FILE = "ban_file"
+const SETTING_BAN_MAX_FAILURES = "ban_max_failures"
+const SETTING_BAN_FIND_TIME = "ban_find_time"
+const SETTING_BAN_TIME = "ban_time"
+const SETTING_BAN_BACKOFF = "ban_backoff"
+const SETTING_BAN_MAX_TIME = "ban_max_time"
+const SETTING_BAN_IPV4_PREFIX = "ban_ipv4_prefix"
+const SETTING_BAN_IPV6_PREFIX = "ban_ipv6_prefix"
+const SETTING_BAN_ALLOW = "ban_allow"
+
+// NewBanStore returns the bans of the server with the policy of its
+// settings.
+func NewBanStore(settings map[string]string) (bans.Store, error) {
+	policy, err := BanPolicy(settings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bans.NewStore(settings[SETTING_BAN_FILE], policy), nil
+}
+
+func BanPolicy(settings map[string]string) (bans.Policy, error) {
+	policy := bans.DefaultPolicy()
+
+	var err error
+
+	if policy.MaxFailures, err = intSetting(settings, SETTING_BAN_MAX_FAILURES, policy.MaxFailures, 1, 1000); err != nil {
+		return policy, err
+	}
+
+	if policy.FindTime, err = durationSetting(settings, SETTING_BAN_FIND_TIME, policy.FindTime); err != nil {
+		return policy, err
+	}
+
+	if policy.BanTime, err = durationSetting(settings, SETTING_BAN_TIME, policy.BanTime); err != nil {
+		return policy, err
+	}
+
+	if policy.MaxBanTime, err = durationSetting(settings, SETTING_BAN_MAX_TIME, policy.MaxBanTime); err != nil {
+		return policy, err
+	}
+
+	if policy.IPv4Prefix, err = intSetting(settings, SETTING_BAN_IPV4_PREFIX, policy.IPv4Prefix, 8, 32); err != nil {
+		return policy, err
+	}
+
+	if policy.IPv6Prefix, err = intSetting(settings, SETTING_BAN_IPV6_PREFIX, policy.IPv6Prefix, 16, 128); err != nil {
+		return policy, err
+	}
+
+	if value, ok := settings[SETTING_BAN_BACKOFF]; ok && len(value) > 0 {
+		backoff, err := strconv.ParseFloat(value, 64)
+
+		if err != nil || backoff < 1 {
+			return policy, fmt.Errorf("%s should be a number of at least 1, got: %s", SETTING_BAN_BACKOFF, value)
+		}
+
+		policy.Backoff = backoff
+	}
+
+	for _, address := range strings.Split(settings[SETTING_BAN_ALLOW], ",") {
+		address = strings.TrimSpace(address)
+
+		if len(address) <= 0 {
+			continue
+		}
+
+		if !strings.Contains(address, "/") {
+			if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+				address += "/32"
+			} else {
+				address += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(address)
+
+		if err != nil {
+			return policy, fmt.Errorf("%s: %s", SETTING_BAN_ALLOW, err)
+		}
+
+		policy.AllowList = append(policy.AllowList, network)
+	}
+
+	return policy, nil
+}
+
+func intSetting(settings map[string]string, key string, defaultValue, min, max int) (int, error) {
+	value, ok := settings[key]
+
+	if !ok || len(value) <= 0 {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(value)
+
+	if err != nil || i < min || i > max {
+		return defaultValue, fmt.Errorf("%s should be a number from %d to %d, got: %s", key, min, max, value)
+	}
+
+	return i, nil
+}
+
+func durationSetting(settings map[string]string, key string, defaultValue time.Duration) (time.Duration, error) {
+	value, ok := settings[key]
+
+	if !ok || len(value) <= 0 {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(value)
+
+	if err != nil || d <= 0 {
+		return defaultValue, fmt.Errorf("%s should be a duration like 10m, got: %s", key, value)
+	}
+
+	return d, nil
+}
+
+// remoteIP returns the address of the client without its port, which
+// changes with every connection.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
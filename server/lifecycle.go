@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Settings of the connection limits and timeouts. handshake_timeout limits
+// the TLS handshake, read_timeout how long a connection may wait for its
+// next request, write_timeout the writing of a response and
+// shutdown_timeout how long a stopping server waits for the requests in
+// flight.
+const SETTING_MAX_CONNECTIONS = "max_connections"
+const SETTING_HANDSHAKE_TIMEOUT = "handshake_timeout"
+const SETTING_READ_TIMEOUT = "read_timeout"
+const SETTING_WRITE_TIMEOUT = "write_timeout"
+const SETTING_SHUTDOWN_TIMEOUT = "shutdown_timeout"
+
+const DEFAULT_MAX_CONNECTIONS = 256
+const DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+const DEFAULT_WRITE_TIMEOUT = 15 * time.Second
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+const maxAcceptBackoff = time.Second
+
+type limits struct {
+	MaxConnections   int
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	ShutdownTimeout  time.Duration
+}
+
+func defaultLimits() limits {
+	return limits{
+		MaxConnections:   DEFAULT_MAX_CONNECTIONS,
+		HandshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+		ReadTimeout:      DEFAULT_SERVER_DEADLINE,
+		WriteTimeout:     DEFAULT_WRITE_TIMEOUT,
+		ShutdownTimeout:  DEFAULT_SHUTDOWN_TIMEOUT,
+	}
+}
+
+func newLimits(settings map[string]string) (limits, error) {
+	l := defaultLimits()
+
+	var err error
+
+	if l.MaxConnections, err = intSetting(settings, SETTING_MAX_CONNECTIONS, l.MaxConnections, 1, 1<<16); err != nil {
+		return l, err
+	}
+
+	if l.HandshakeTimeout, err = durationSetting(settings, SETTING_HANDSHAKE_TIMEOUT, l.HandshakeTimeout); err != nil {
+		return l, err
+	}
+
+	if l.ReadTimeout, err = durationSetting(settings, SETTING_READ_TIMEOUT, l.ReadTimeout); err != nil {
+		return l, err
+	}
+
+	if l.WriteTimeout, err = durationSetting(settings, SETTING_WRITE_TIMEOUT, l.WriteTimeout); err != nil {
+		return l, err
+	}
+
+	if l.ShutdownTimeout, err = durationSetting(settings, SETTING_SHUTDOWN_TIMEOUT, l.ShutdownTimeout); err != nil {
+		return l, err
+	}
+
+	return l, nil
+}
+
+// serve accepts connections of listeners until ctx is done and serves each
+// with a copy of state, at most MaxConnections at once. Then it waits
+// ShutdownTimeout for the requests in flight and closes the connections
+// that are left. When accepting fails for good on one listener the server
+// stops and the error is returned.
+func serve(ctx context.Context, listeners []net.Listener, state connState) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slots := make(chan struct{}, state.limits.MaxConnections)
+	closing := make(chan struct{})
+
+	state.stopping = ctx.Done()
+	state.closing = closing
+
+	var handlers sync.WaitGroup
+
+	handle := func(conn net.Conn) {
+		handlers.Add(1)
+
+		go func() {
+			defer func() {
+				<-slots
+				handlers.Done()
+			}()
+
+			handleClient(conn, state)
+		}()
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			err := accept(ctx, listener, slots, handle)
+
+			if err != nil {
+				cancel()
+			}
+
+			errs <- err
+		}(listener)
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	var err error
+
+	for range listeners {
+		if acceptErr := <-errs; acceptErr != nil && err == nil {
+			err = acceptErr
+		}
+	}
+
+	drained := make(chan struct{})
+
+	go func() {
+		handlers.Wait()
+		close(drained)
+	}()
+
+	if active := len(slots); active > 0 {
+		log.Printf("Harpocrates Server: waiting for %d connections", active)
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(state.limits.ShutdownTimeout):
+		log.Printf("Harpocrates Server: closing %d connections after %s", len(slots), state.limits.ShutdownTimeout)
+
+		close(closing)
+		<-drained
+	}
+
+	return err
+}
+
+// accept hands the connections to handle while a slot is free. Temporary
+// errors are retried with a growing backoff, like running out of file
+// descriptors.
+func accept(ctx context.Context, listener net.Listener, slots chan struct{}, handle func(net.Conn)) error {
+	var backoff time.Duration
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		conn, err := listener.Accept()
+
+		if err != nil {
+			<-slots
+
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+				return err
+			}
+
+			if backoff *= 2; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+
+			log.Printf("Harpocrates Server: accept connection: %s, retrying in %s", err, backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
+
+			continue
+		}
+
+		backoff = 0
+
+		handle(conn)
+	}
+}
+
+// watch ends the connection when the server stops: a connection waiting for
+// its next request stops at once, one serving a request is closed when the
+// server stops waiting for it.
+func (c *connState) watch(conn net.Conn, finished <-chan struct{}) {
+	select {
+	case <-finished:
+		return
+	case <-c.stopping:
+		conn.SetReadDeadline(time.Now())
+	}
+
+	select {
+	case <-finished:
+	case <-c.closing:
+		conn.Close()
+	}
+}
+
+func (c *connState) stopped() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_it_should_limit_connections_and_drain_on_shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := newTestState(dir, nil)
+	state.limits.MaxConnections = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- serve(ctx, []net.Listener{listener}, state)
+	}()
+
+	open := func() (*Session, error) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newSession(conn, "alice")
+	}
+
+	first, err := open()
+
+	if err != nil {
+		t.Fatalf("Session could not be opened: %s", err)
+	}
+
+	opened := make(chan *Session, 1)
+
+	go func() {
+		second, err := open()
+
+		if err != nil {
+			t.Errorf("Session could not be opened: %s", err)
+		}
+
+		opened <- second
+	}()
+
+	select {
+	case <-opened:
+		t.Fatalf("Connection over the limit was served")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	first.Close()
+
+	var second *Session
+
+	select {
+	case second = <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection was not served after another one closed")
+	}
+
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Shutdown was incorrect, got: %s, want: %v", err, nil)
+		}
+	case <-time.After(state.limits.ShutdownTimeout / 2):
+		t.Fatalf("Idle connection was not closed on shutdown")
+	}
+
+	if _, err := second.call(OP_LOGOUT, PrivateKeyExchange{}); err == nil {
+		t.Errorf("Connection was served after shutdown")
+	}
+}
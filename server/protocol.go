@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// PROTOCOL_VERSION is the newest version of the framed protocol this build
+// speaks, PROTOCOL_MIN_VERSION the oldest one it still accepts.
+const PROTOCOL_VERSION = 1
+const PROTOCOL_MIN_VERSION = 1
+
+// MAX_FRAME_SIZE limits a frame. It also keeps the first byte of a frame,
+// the high byte of its length, below the first byte of a msgpack map, which
+// tells framed clients apart from clients of the unframed protocol.
+const MAX_FRAME_SIZE = 32 << 20
+
+// Capabilities are negotiated with OP_HELLO, a client only sends requests of
+// capabilities the server announced and the server refuses the others.
+const CAPABILITY_SYNC = "sync"
+const CAPABILITY_SHARED_VAULTS = "shared-vaults"
+const CAPABILITY_VAULT_ROLES = "vault-roles"
+const CAPABILITY_SESSION_TOKENS = "session-tokens"
+
+var CAPABILITIES = []string{CAPABILITY_SYNC, CAPABILITY_SHARED_VAULTS, CAPABILITY_VAULT_ROLES, CAPABILITY_SESSION_TOKENS}
+
+var ErrFrameTooLarge = errors.New("frame is larger than allowed")
+
+// Op is the operation of a frame. The values are part of the protocol, new
+// operations get new values and old ones are never reused.
+type Op uint16
+
+const (
+	OP_HELLO               Op = 1
+	OP_REGISTER            Op = 2
+	OP_SRP_INIT            Op = 3
+	OP_SRP_PROOF           Op = 4
+	OP_RESUME              Op = 5
+	OP_REFRESH_SESSION     Op = 6
+	OP_LOGOUT              Op = 7
+	OP_GET_PRIVATE_KEY     Op = 10
+	OP_STORE_PRIVATE_KEY   Op = 11
+	OP_UPGRADE_PRIVATE_KEY Op = 12
+	OP_PULL_VAULT          Op = 20
+	OP_PUSH_VAULT          Op = 21
+	OP_CREATE_VAULT        Op = 30
+	OP_LIST_VAULTS         Op = 31
+	OP_GET_VAULT           Op = 32
+	OP_GET_PUBLIC_KEY      Op = 33
+	OP_ADD_MEMBER          Op = 34
+	OP_REKEY_VAULT         Op = 35
+	OP_PUSH_SHARED         Op = 36
+	OP_SET_ROLE            Op = 37
+)
+
+// opTypes maps the operations of authenticated requests to the message types
+// the handlers know.
+var opTypes = map[Op]string{
+	OP_GET_PRIVATE_KEY:     MESSAGE_TYPE_GET_PRIVATE_KEY,
+	OP_STORE_PRIVATE_KEY:   MESSAGE_TYPE_STORE_PRIVATE_KEY,
+	OP_UPGRADE_PRIVATE_KEY: MESSAGE_TYPE_UPGRADE_PRIVATE_KEY,
+	OP_PULL_VAULT:          MESSAGE_TYPE_PULL_VAULT,
+	OP_PUSH_VAULT:          MESSAGE_TYPE_PUSH_VAULT,
+	OP_CREATE_VAULT:        MESSAGE_TYPE_CREATE_VAULT,
+	OP_LIST_VAULTS:         MESSAGE_TYPE_LIST_VAULTS,
+	OP_GET_VAULT:           MESSAGE_TYPE_GET_VAULT,
+	OP_GET_PUBLIC_KEY:      MESSAGE_TYPE_GET_PUBLIC_KEY,
+	OP_ADD_MEMBER:          MESSAGE_TYPE_ADD_MEMBER,
+	OP_REKEY_VAULT:         MESSAGE_TYPE_REKEY_VAULT,
+	OP_PUSH_SHARED:         MESSAGE_TYPE_PUSH_SHARED,
+	OP_SET_ROLE:            MESSAGE_TYPE_SET_ROLE,
+}
+
+// opCapabilities holds the capability an operation needs.
+var opCapabilities = map[Op]string{
+	OP_RESUME:          CAPABILITY_SESSION_TOKENS,
+	OP_REFRESH_SESSION: CAPABILITY_SESSION_TOKENS,
+	OP_LOGOUT:          CAPABILITY_SESSION_TOKENS,
+	OP_PULL_VAULT:      CAPABILITY_SYNC,
+	OP_PUSH_VAULT:      CAPABILITY_SYNC,
+	OP_CREATE_VAULT:    CAPABILITY_SHARED_VAULTS,
+	OP_LIST_VAULTS:     CAPABILITY_SHARED_VAULTS,
+	OP_GET_VAULT:       CAPABILITY_SHARED_VAULTS,
+	OP_GET_PUBLIC_KEY:  CAPABILITY_SHARED_VAULTS,
+	OP_ADD_MEMBER:      CAPABILITY_SHARED_VAULTS,
+	OP_REKEY_VAULT:     CAPABILITY_SHARED_VAULTS,
+	OP_PUSH_SHARED:     CAPABILITY_SHARED_VAULTS,
+	OP_SET_ROLE:        CAPABILITY_VAULT_ROLES,
+}
+
+// opNames names the operations without a message type.
+var opNames = map[Op]string{
+	OP_HELLO:           "HELLO",
+	OP_REGISTER:        MESSAGE_TYPE_REGISTER,
+	OP_SRP_INIT:        MESSAGE_TYPE_SRP_INIT,
+	OP_SRP_PROOF:       "LOGIN",
+	OP_RESUME:          "RESUME",
+	OP_REFRESH_SESSION: "REFRESH_SESSION",
+	OP_LOGOUT:          "LOGOUT",
+}
+
+func (op Op) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+
+	if messageType, ok := opTypes[op]; ok {
+		return messageType
+	}
+
+	return fmt.Sprintf("OP_%d", op)
+}
+
+func typeOp(messageType string) (Op, bool) {
+	for op, t := range opTypes {
+		if t == messageType {
+			return op, true
+		}
+	}
+
+	return 0, false
+}
+
+// Status of a response, the values follow the HTTP status codes.
+type Status uint16
+
+const (
+	STATUS_OK                  Status = 0
+	STATUS_BAD_REQUEST         Status = 400
+	STATUS_UNAUTHORIZED        Status = 401
+	STATUS_FORBIDDEN           Status = 403
+	STATUS_NOT_FOUND           Status = 404
+	STATUS_CONFLICT            Status = 409
+	STATUS_TOO_MANY_FAILURES   Status = 429
+	STATUS_INTERNAL_ERROR      Status = 500
+	STATUS_UNKNOWN_OP          Status = 501
+	STATUS_UNSUPPORTED_VERSION Status = 505
+)
+
+type messageStatus struct {
+	Status Status
+	Error  string
+}
+
+// messageStatuses maps the refusals of the handlers to the status and error
+// of the response, other message types are successful.
+var messageStatuses = map[string]messageStatus{
+	MESSAGE_TYPE_WRONG_CREDENTIALS:          {STATUS_UNAUTHORIZED, "wrong username or master password"},
+	MESSAGE_TYPE_UNAUTHENTICATED:            {STATUS_UNAUTHORIZED, "log in before sending requests"},
+	MESSAGE_TYPE_SESSION_INVALID:            {STATUS_UNAUTHORIZED, "session token is invalid, expired or logged out"},
+	MESSAGE_TYPE_ALREADY_AUTHENTICATED:      {STATUS_BAD_REQUEST, "already logged in, log out first"},
+	MESSAGE_TYPE_BANNED:                     {STATUS_TOO_MANY_FAILURES, "too many failed logins, please try again later"},
+	MESSAGE_TYPE_USER_DISABLED:              {STATUS_FORBIDDEN, "user is disabled"},
+	MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS: {STATUS_CONFLICT, "private key already exists"},
+	MESSAGE_TYPE_PRIVATE_KEY_NOT_ENCRYPTED:  {STATUS_BAD_REQUEST, "private key is not encrypted"},
+	MESSAGE_TYPE_INTERNAL_ERROR:             {STATUS_INTERNAL_ERROR, "internal server error"},
+	MESSAGE_TYPE_UNKNOWN_REQUEST:            {STATUS_UNKNOWN_OP, "unknown operation"},
+	MESSAGE_TYPE_NOT_NEGOTIATED:             {STATUS_UNKNOWN_OP, "capability of the operation was not negotiated"},
+	MESSAGE_TYPE_BAD_REQUEST:                {STATUS_BAD_REQUEST, "malformed request"},
+	MESSAGE_TYPE_USER_ALREADY_EXISTS:        {STATUS_CONFLICT, "user already exists"},
+	MESSAGE_TYPE_INVALID_USERNAME:           {STATUS_BAD_REQUEST, "invalid username"},
+	MESSAGE_TYPE_REGISTRATION_CLOSED:        {STATUS_FORBIDDEN, "registration is closed"},
+	MESSAGE_TYPE_VAULT_NOT_FOUND:            {STATUS_NOT_FOUND, "shared vault does not exist"},
+	MESSAGE_TYPE_VAULT_ALREADY_EXISTS:       {STATUS_CONFLICT, "shared vault already exists"},
+	MESSAGE_TYPE_INVALID_VAULT_NAME:         {STATUS_BAD_REQUEST, "invalid shared vault name"},
+	MESSAGE_TYPE_VAULT_FORBIDDEN:            {STATUS_FORBIDDEN, "role does not allow this"},
+	MESSAGE_TYPE_VAULT_KEY_CHANGED:          {STATUS_CONFLICT, "shared vault was re-keyed"},
+	MESSAGE_TYPE_VAULT_CHANGED:              {STATUS_CONFLICT, "shared vault was changed since it was read"},
+	MESSAGE_TYPE_MEMBER_NOT_FOUND:           {STATUS_NOT_FOUND, "member does not exist"},
+	MESSAGE_TYPE_MEMBER_ALREADY_EXISTS:      {STATUS_CONFLICT, "member already exists"},
+	MESSAGE_TYPE_INVALID_ROLE:               {STATUS_BAD_REQUEST, "invalid role"},
+}
+
+// Frame is the envelope of every request and response of the framed
+// protocol. It is sent as msgpack after its length as a big endian uint32.
+// Payload holds a msgpack PrivateKeyExchange, or a Hello for OP_HELLO. A
+// response carries the Id and Op of its request.
+type Frame struct {
+	Version uint16
+	Id      uint64
+	Op      Op
+	Status  Status
+	Error   string
+	Payload []byte
+}
+
+// Hello negotiates the version and capabilities. The client sends the range
+// of versions and the capabilities it knows, the server answers with the
+// version it chose and the capabilities both know. IdleTimeout is how long
+// the server keeps an idle connection.
+type Hello struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	Version      uint16
+	Capabilities []string
+	IdleTimeout  int64
+}
+
+// negotiate returns the newest version both sides speak.
+func negotiate(hello *Hello) (uint16, bool) {
+	version := uint16(PROTOCOL_VERSION)
+
+	if hello.MaxVersion < version {
+		version = hello.MaxVersion
+	}
+
+	if version < PROTOCOL_MIN_VERSION || version < hello.MinVersion {
+		return 0, false
+	}
+
+	return version, true
+}
+
+func commonCapabilities(offered []string) []string {
+	common := make([]string, 0, len(offered))
+
+	for _, capability := range offered {
+		if containsString(CAPABILITIES, capability) {
+			common = append(common, capability)
+		}
+	}
+
+	return common
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readFrame(r io.Reader) (*Frame, error) {
+	var size uint32
+
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size > MAX_FRAME_SIZE {
+		return nil, ErrFrameTooLarge
+	}
+
+	b := make([]byte, size)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	frame := new(Frame)
+
+	if err := msgpack.Unmarshal(b, frame); err != nil {
+		return nil, fmt.Errorf("frame: %w", err)
+	}
+
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, frame *Frame) error {
+	b, err := msgpack.Marshal(frame)
+
+	if err != nil {
+		return err
+	}
+
+	if len(b) > MAX_FRAME_SIZE {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+
+	_, err = w.Write(buf)
+
+	return err
+}
+
+// isUnframed tells whether the first byte of a connection starts a msgpack
+// map, which is how clients before the framed protocol start.
+func isUnframed(first byte) bool {
+	return first&0xf0 == 0x80 || first == 0xde || first == 0xdf
+}
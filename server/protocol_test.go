@@ -0,0 +1,458 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blueskan/harpocrates/audit"
+	"github.com/blueskan/harpocrates/bans"
+	"github.com/blueskan/harpocrates/core"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
+	"github.com/blueskan/harpocrates/vaults"
+	"github.com/vmihailenco/msgpack"
+)
+
+func newTestSession(t *testing.T, dir, username string) *Session {
+	return newTestSessionWithTokens(t, dir, username, nil)
+}
+
+func newTestState(dir string, tokens *tokenIssuer) connState {
+	if tokens == nil {
+		tokens, _ = newTokenIssuer(DEFAULT_SESSION_TTL)
+	}
+
+	return connState{
+		settings:   make(map[string]string),
+		userStore:  users.NewStore(filepath.Join(dir, "users")),
+		vaultStore: vaults.NewStore(filepath.Join(dir, "vaults")),
+		banStore:   bans.NewStore(filepath.Join(dir, "bans.db"), bans.DefaultPolicy()),
+		tokens:     tokens,
+		srpSecret:  []byte("secret of the test server decoys"),
+		auditLog:   audit.NewLog(filepath.Join(dir, "audit.log")),
+		limits:     defaultLimits(),
+	}
+}
+
+func newTestSessionWithTokens(t *testing.T, dir, username string, tokens *tokenIssuer) *Session {
+	client, server := net.Pipe()
+
+	state := newTestState(dir, tokens)
+
+	go func() {
+		defer server.Close()
+		state.serve(server)
+	}()
+
+	session, err := newSession(client, username)
+
+	if err != nil {
+		t.Fatalf("Session could not be opened: %s", err)
+	}
+
+	return session
+}
+
+func Test_it_should_negotiate_newest_common_version(t *testing.T) {
+	if version, ok := negotiate(&Hello{MinVersion: 1, MaxVersion: PROTOCOL_VERSION + 5}); !ok || version != PROTOCOL_VERSION {
+		t.Errorf("Version was incorrect, got: %d, %v, want: %d", version, ok, PROTOCOL_VERSION)
+	}
+
+	if _, ok := negotiate(&Hello{MinVersion: PROTOCOL_VERSION + 1, MaxVersion: PROTOCOL_VERSION + 5}); ok {
+		t.Errorf("Version newer than the server was negotiated")
+	}
+}
+
+func Test_it_should_serve_several_requests_per_connection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	session := newTestSession(t, dir, "alice")
+	defer session.Close()
+
+	if !session.Supports(CAPABILITY_SHARED_VAULTS) {
+		t.Errorf("Capabilities were incorrect, got: %v, want: %s", session.capabilities, CAPABILITY_SHARED_VAULTS)
+	}
+
+	salt, verifier, _ := core.NewSrpVerifier("alice", "secret")
+
+	if _, err := session.call(OP_REGISTER, PrivateKeyExchange{Username: "alice", SrpSalt: salt, SrpVerifier: verifier}); err != nil {
+		t.Fatalf("User could not be registered: %s", err)
+	}
+
+	_, err = session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_LIST_VAULTS})
+
+	var protocolError *ProtocolError
+
+	if !errors.As(err, &protocolError) || protocolError.Status != STATUS_UNAUTHORIZED {
+		t.Errorf("Request before login was incorrect, got: %v, want: %d", err, STATUS_UNAUTHORIZED)
+	}
+
+	if _, err := session.Login("secret"); err != nil {
+		t.Fatalf("User could not log in: %s", err)
+	}
+
+	if _, err := session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_CREATE_VAULT, VaultName: "team", WrappedKey: []byte("key")}); err != nil {
+		t.Fatalf("Shared vault could not be created: %s", err)
+	}
+
+	resp, err := session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_LIST_VAULTS})
+
+	if err != nil || len(resp.SharedVaults) != 1 {
+		t.Fatalf("Shared vaults were incorrect, got: %v, %v, want: %d", resp, err, 1)
+	}
+
+	_, err = session.call(Op(999), PrivateKeyExchange{})
+
+	if !errors.As(err, &protocolError) || protocolError.Status != STATUS_UNKNOWN_OP {
+		t.Errorf("Unknown operation was incorrect, got: %v, want: %d", err, STATUS_UNKNOWN_OP)
+	}
+
+	_, err = session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_GET_VAULT, VaultName: "missing"})
+
+	if !errors.As(err, &protocolError) || protocolError.Status != STATUS_NOT_FOUND || protocolError.Type != MESSAGE_TYPE_VAULT_NOT_FOUND {
+		t.Errorf("Missing vault was incorrect, got: %v, want: %d", err, STATUS_NOT_FOUND)
+	}
+}
+
+func Test_it_should_resume_session_until_logout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tokens, _ := newTokenIssuer(DEFAULT_SESSION_TTL)
+
+	session := newTestSessionWithTokens(t, dir, "alice", tokens)
+	salt, verifier, _ := core.NewSrpVerifier("alice", "secret")
+	session.call(OP_REGISTER, PrivateKeyExchange{Username: "alice", SrpSalt: salt, SrpVerifier: verifier})
+
+	login, err := session.Login("secret")
+	session.Close()
+
+	if err != nil || len(login.SessionToken) == 0 {
+		t.Fatalf("Session token was incorrect, got: %v, %v", login, err)
+	}
+
+	session = newTestSessionWithTokens(t, dir, "alice", tokens)
+	defer session.Close()
+
+	if _, err := session.Resume(login.SessionToken); err != nil {
+		t.Fatalf("Session could not be resumed: %s", err)
+	}
+
+	if _, err := session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_LIST_VAULTS}); err != nil {
+		t.Errorf("Request of resumed session was refused: %s", err)
+	}
+
+	refreshed, err := session.Refresh()
+
+	if err != nil || refreshed.SessionToken == login.SessionToken {
+		t.Fatalf("Refreshed token was incorrect, got: %v, %v", refreshed, err)
+	}
+
+	if err := session.Logout(""); err != nil {
+		t.Fatalf("Session could not log out: %s", err)
+	}
+
+	var protocolError *ProtocolError
+
+	for _, token := range []string{login.SessionToken, refreshed.SessionToken, "forged.token"} {
+		_, err = session.Resume(token)
+
+		if !errors.As(err, &protocolError) || protocolError.Type != MESSAGE_TYPE_SESSION_INVALID {
+			t.Errorf("Resume was incorrect, got: %v, want: %s", err, MESSAGE_TYPE_SESSION_INVALID)
+		}
+	}
+
+	_, err = session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_LIST_VAULTS})
+
+	if !errors.As(err, &protocolError) || protocolError.Status != STATUS_UNAUTHORIZED {
+		t.Errorf("Request after logout was incorrect, got: %v, want: %d", err, STATUS_UNAUTHORIZED)
+	}
+
+	session.Close()
+
+	events, _ := audit.Read(filepath.Join(dir, "audit.log"), time.Time{})
+	outcomes := make([]string, 0, len(events))
+
+	for _, event := range events {
+		outcomes = append(outcomes, event.Operation+" "+event.Outcome)
+	}
+
+	want := []string{"REGISTER OK", "LOGIN OK", "RESUME OK", "LIST_VAULTS OK", "REFRESH_SESSION OK", "LOGOUT OK", "RESUME SESSION_INVALID"}
+
+	if got := strings.Join(outcomes, ", "); !strings.HasPrefix(got, strings.Join(want, ", ")) {
+		t.Errorf("Audit log was incorrect, got: %s, want: %s", got, strings.Join(want, ", "))
+	}
+
+	if _, _, err := audit.Verify(filepath.Join(dir, "audit.log")); err != nil {
+		t.Errorf("Audit log could not be verified: %s", err)
+	}
+}
+
+func Test_it_should_not_log_in_twice_on_one_connection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tokens, _ := newTokenIssuer(DEFAULT_SESSION_TTL)
+
+	bob := newTestSessionWithTokens(t, dir, "bob", tokens)
+	salt, verifier, _ := core.NewSrpVerifier("bob", "bob-secret")
+	bob.call(OP_REGISTER, PrivateKeyExchange{Username: "bob", SrpSalt: salt, SrpVerifier: verifier})
+
+	bobLogin, err := bob.Login("bob-secret")
+	bob.Close()
+
+	if err != nil {
+		t.Fatalf("User could not log in: %s", err)
+	}
+
+	session := newTestSessionWithTokens(t, dir, "alice", tokens)
+	defer session.Close()
+
+	salt, verifier, _ = core.NewSrpVerifier("alice", "secret")
+	session.call(OP_REGISTER, PrivateKeyExchange{Username: "alice", SrpSalt: salt, SrpVerifier: verifier})
+
+	if _, err := session.Login("secret"); err != nil {
+		t.Fatalf("User could not log in: %s", err)
+	}
+
+	var protocolError *ProtocolError
+
+	requests := map[Op]PrivateKeyExchange{
+		OP_SRP_INIT: {Username: "bob", SrpPublicKey: []byte{2}},
+		OP_REGISTER: {Username: "carol", SrpSalt: salt, SrpVerifier: verifier},
+		OP_RESUME:   {SessionToken: bobLogin.SessionToken},
+	}
+
+	for op, request := range requests {
+		_, err := session.call(op, request)
+
+		if !errors.As(err, &protocolError) || protocolError.Type != MESSAGE_TYPE_ALREADY_AUTHENTICATED {
+			t.Errorf("Second login with %s was incorrect, got: %v, want: %s", op, err, MESSAGE_TYPE_ALREADY_AUTHENTICATED)
+		}
+	}
+
+	if _, err := session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_CREATE_VAULT, VaultName: "team", WrappedKey: []byte("key")}); err != nil {
+		t.Fatalf("Shared vault could not be created: %s", err)
+	}
+
+	vault, err := vaults.NewStore(filepath.Join(dir, "vaults")).Get("team")
+
+	if err != nil || vault.Owner != "alice" {
+		t.Errorf("Owner was incorrect, got: %v, %v, want: %s", vault, err, "alice")
+	}
+}
+
+func Test_it_should_refuse_operations_of_capabilities_not_negotiated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	state := newTestState(dir, nil)
+
+	go func() {
+		defer server.Close()
+		state.serve(server)
+	}()
+
+	session := &Session{conn: client, reader: bufio.NewReader(client)}
+	payload, _ := msgpack.Marshal(&Hello{MinVersion: PROTOCOL_MIN_VERSION, MaxVersion: PROTOCOL_VERSION, Capabilities: []string{CAPABILITY_SYNC}})
+
+	response, err := session.roundTrip(&Frame{Op: OP_HELLO, Payload: payload})
+
+	if err != nil || response.Status != STATUS_OK {
+		t.Fatalf("Hello was incorrect, got: %v, %v", response, err)
+	}
+
+	session.version = response.Version
+
+	var protocolError *ProtocolError
+
+	for _, op := range []Op{OP_CREATE_VAULT, OP_SET_ROLE, OP_RESUME} {
+		_, err := session.call(op, PrivateKeyExchange{VaultName: "team"})
+
+		if !errors.As(err, &protocolError) || protocolError.Status != STATUS_UNKNOWN_OP || protocolError.Type != MESSAGE_TYPE_NOT_NEGOTIATED {
+			t.Errorf("%s was incorrect, got: %v, want: %s", op, err, MESSAGE_TYPE_NOT_NEGOTIATED)
+		}
+	}
+
+	_, err = session.call(OP_PULL_VAULT, PrivateKeyExchange{})
+
+	if !errors.As(err, &protocolError) || protocolError.Status != STATUS_UNAUTHORIZED {
+		t.Errorf("Negotiated operation was incorrect, got: %v, want: %d", err, STATUS_UNAUTHORIZED)
+	}
+}
+
+func Test_it_should_answer_unknown_users_like_existing_ones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	challenge := func(username string) []byte {
+		session := newTestSession(t, dir, username)
+		defer session.Close()
+
+		client, _ := core.NewSrpClient(username, "secret")
+
+		resp, err := session.call(OP_SRP_INIT, PrivateKeyExchange{
+			Type:         MESSAGE_TYPE_SRP_INIT,
+			Username:     username,
+			SrpPublicKey: client.PublicKey(),
+		})
+
+		if err != nil || resp.Type != MESSAGE_TYPE_SRP_CHALLENGE || len(resp.SrpSalt) != core.SRP_SALT_SIZE {
+			t.Fatalf("Challenge was incorrect, got: %v, %v, want: %s", resp, err, MESSAGE_TYPE_SRP_CHALLENGE)
+		}
+
+		return resp.SrpSalt
+	}
+
+	if string(challenge("mallory")) != string(challenge("mallory")) {
+		t.Errorf("Salt of unknown user changed between logins")
+	}
+
+	if string(challenge("mallory")) == string(challenge("trudy")) {
+		t.Errorf("Unknown users had the same salt")
+	}
+
+	session := newTestSession(t, dir, "mallory")
+	defer session.Close()
+
+	_, err = session.Login("secret")
+
+	var protocolError *ProtocolError
+
+	if !errors.As(err, &protocolError) || protocolError.Type != MESSAGE_TYPE_WRONG_CREDENTIALS {
+		t.Errorf("Login of unknown user was incorrect, got: %v, want: %s", err, MESSAGE_TYPE_WRONG_CREDENTIALS)
+	}
+}
+
+func Test_it_should_not_give_roles_of_deleted_user_to_new_user(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	vaultStore := vaults.NewStore(filepath.Join(dir, "vaults"))
+
+	vaultStore.Create(vaults.Vault{Name: "team", Owner: "alice", Members: map[string][]byte{"alice": []byte("key"), "bob": []byte("key")}})
+	vaultStore.Create(vaults.Vault{Name: "private", Owner: "alice", Members: map[string][]byte{"alice": []byte("key")}})
+
+	removed, err := vaultStore.RemoveMember("alice")
+
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("Removed vaults were incorrect, got: %v, %v, want: %d", removed, err, 2)
+	}
+
+	// A new user registering the deleted name is added again by a member.
+	vaultStore.Update("team", func(vault *vaults.Vault) error {
+		vault.Members["alice"] = []byte("new key")
+		vault.SetRole("bob", "alice", service.SHARED_VAULT_ROLE_READ_ONLY)
+		return nil
+	})
+
+	vault, err := vaultStore.Get("team")
+
+	if err != nil || vault.Owner != "" || !vault.RekeyNeeded || vault.Role("alice") != service.SHARED_VAULT_ROLE_READ_ONLY || vault.Role("bob") != service.SHARED_VAULT_ROLE_READ_WRITE {
+		t.Errorf("Roles were incorrect, got: %v, %v, want: %s", vault, err, service.SHARED_VAULT_ROLE_READ_ONLY)
+	}
+
+	if _, err := vaultStore.Get("private"); err != vaults.ErrVaultNotFound {
+		t.Errorf("Vault without members was incorrect, got: %v, want: %v", err, vaults.ErrVaultNotFound)
+	}
+}
+
+func Test_it_should_not_rekey_vault_changed_since_it_was_read(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	session := newTestSession(t, dir, "alice")
+	defer session.Close()
+
+	salt, verifier, _ := core.NewSrpVerifier("alice", "secret")
+	session.call(OP_REGISTER, PrivateKeyExchange{Username: "alice", SrpSalt: salt, SrpVerifier: verifier})
+
+	if _, err := session.Login("secret"); err != nil {
+		t.Fatalf("User could not log in: %s", err)
+	}
+
+	session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_CREATE_VAULT, VaultName: "team", WrappedKey: []byte("key")})
+
+	read, err := session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_GET_VAULT, VaultName: "team"})
+
+	if err != nil {
+		t.Fatalf("Shared vault could not be read: %s", err)
+	}
+
+	// Another member pushes an entry between reading and re-keying.
+	if _, err := session.Do(PrivateKeyExchange{Type: MESSAGE_TYPE_PUSH_SHARED, VaultName: "team", SyncEntries: []service.SyncEntry{{Id: "db", Data: []byte("entry")}}}); err != nil {
+		t.Fatalf("Shared entry could not be pushed: %s", err)
+	}
+
+	rekey := PrivateKeyExchange{
+		Type:         MESSAGE_TYPE_REKEY_VAULT,
+		VaultName:    "team",
+		KeyVersion:   read.SharedVault.KeyVersion,
+		SyncRevision: read.SharedVault.Revision,
+		Members:      map[string][]byte{"alice": []byte("new key")},
+	}
+
+	var protocolError *ProtocolError
+
+	if _, err := session.Do(rekey); !errors.As(err, &protocolError) || protocolError.Type != MESSAGE_TYPE_VAULT_CHANGED {
+		t.Fatalf("Re-key of changed vault was incorrect, got: %v, want: %s", err, MESSAGE_TYPE_VAULT_CHANGED)
+	}
+
+	vault, _ := vaults.NewStore(filepath.Join(dir, "vaults")).Get("team")
+
+	if _, ok := vault.Entries["db"]; !ok || vault.KeyVersion != read.SharedVault.KeyVersion {
+		t.Errorf("Shared vault was incorrect, got: %v", vault)
+	}
+
+	rekey.SyncRevision = vault.Revision
+
+	if _, err := session.Do(rekey); err != nil {
+		t.Errorf("Shared vault could not be re-keyed: %s", err)
+	}
+}
@@ -2,183 +2,1041 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/blueskan/harpocrates/audit"
+	"github.com/blueskan/harpocrates/bans"
 	"github.com/blueskan/harpocrates/core"
 	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
+	"github.com/blueskan/harpocrates/vaults"
 	"github.com/vmihailenco/msgpack"
 )
 
-var masterPasswordHash string
-
 // Errors
 const MESSAGE_TYPE_WRONG_CREDENTIALS = "WRONG_CREDENTIALS"
 const MESSAGE_TYPE_BANNED = "BANNED"
 const MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS = "PRIVATE_KEY_ALREADY_EXISTS"
+const MESSAGE_TYPE_PRIVATE_KEY_NOT_ENCRYPTED = "PRIVATE_KEY_NOT_ENCRYPTED"
+const MESSAGE_TYPE_INTERNAL_ERROR = "INTERNAL_ERROR"
+const MESSAGE_TYPE_USER_DISABLED = "USER_DISABLED"
+const MESSAGE_TYPE_USER_ALREADY_EXISTS = "USER_ALREADY_EXISTS"
+const MESSAGE_TYPE_INVALID_USERNAME = "INVALID_USERNAME"
+const MESSAGE_TYPE_REGISTRATION_CLOSED = "REGISTRATION_CLOSED"
+const MESSAGE_TYPE_VAULT_NOT_FOUND = "VAULT_NOT_FOUND"
+const MESSAGE_TYPE_VAULT_ALREADY_EXISTS = "VAULT_ALREADY_EXISTS"
+const MESSAGE_TYPE_INVALID_VAULT_NAME = "INVALID_VAULT_NAME"
+const MESSAGE_TYPE_VAULT_FORBIDDEN = "VAULT_FORBIDDEN"
+const MESSAGE_TYPE_VAULT_KEY_CHANGED = "VAULT_KEY_CHANGED"
+const MESSAGE_TYPE_VAULT_CHANGED = "VAULT_CHANGED"
+const MESSAGE_TYPE_MEMBER_NOT_FOUND = "MEMBER_NOT_FOUND"
+const MESSAGE_TYPE_MEMBER_ALREADY_EXISTS = "MEMBER_ALREADY_EXISTS"
+const MESSAGE_TYPE_INVALID_ROLE = "INVALID_ROLE"
+const MESSAGE_TYPE_UNAUTHENTICATED = "UNAUTHENTICATED"
+const MESSAGE_TYPE_UNKNOWN_REQUEST = "UNKNOWN_REQUEST"
+const MESSAGE_TYPE_BAD_REQUEST = "BAD_REQUEST"
+const MESSAGE_TYPE_SESSION_INVALID = "SESSION_INVALID"
+const MESSAGE_TYPE_ALREADY_AUTHENTICATED = "ALREADY_AUTHENTICATED"
+const MESSAGE_TYPE_NOT_NEGOTIATED = "NOT_NEGOTIATED"
 
 // Successes
 const MESSAGE_TYPE_PRIVATE_KEY_SAVED = "MESSAGE_TYPE_PRIVATE_KEY_SAVED"
+const MESSAGE_TYPE_REGISTERED = "REGISTERED"
+const MESSAGE_TYPE_AUTHENTICATED = "AUTHENTICATED"
+const MESSAGE_TYPE_LOGGED_OUT = "LOGGED_OUT"
+
+// Authentication
+const MESSAGE_TYPE_SRP_INIT = "SRP_INIT"
+const MESSAGE_TYPE_SRP_CHALLENGE = "SRP_CHALLENGE"
+const MESSAGE_TYPE_REGISTER = "REGISTER"
 
 // Common Messages
 const MESSAGE_TYPE_GET_PRIVATE_KEY = "GET_PRIVATE_KEY"
 const MESSAGE_TYPE_STORE_PRIVATE_KEY = "STORE_PRIVATE_KEY"
+const MESSAGE_TYPE_UPGRADE_PRIVATE_KEY = "UPGRADE_PRIVATE_KEY"
+
+// Sync
+const MESSAGE_TYPE_PULL_VAULT = "PULL_VAULT"
+const MESSAGE_TYPE_PUSH_VAULT = "PUSH_VAULT"
+
+// Shared vaults
+const MESSAGE_TYPE_CREATE_VAULT = "CREATE_VAULT"
+const MESSAGE_TYPE_LIST_VAULTS = "LIST_VAULTS"
+const MESSAGE_TYPE_GET_VAULT = "GET_VAULT"
+const MESSAGE_TYPE_GET_PUBLIC_KEY = "GET_PUBLIC_KEY"
+const MESSAGE_TYPE_ADD_MEMBER = "ADD_MEMBER"
+const MESSAGE_TYPE_REKEY_VAULT = "REKEY_VAULT"
+const MESSAGE_TYPE_PUSH_SHARED = "PUSH_SHARED"
+const MESSAGE_TYPE_SET_ROLE = "SET_ROLE"
 
 const DEFAULT_SERVER_DEADLINE = 15 * time.Second
 
+// DEFAULT_USERNAME is the user of clients set up before the server had
+// accounts, the single master password of such servers becomes its account.
+const DEFAULT_USERNAME = "harpocrates"
+
+// SETTING_USERS_DIR is the server setting holding the directory of the user
+// accounts, registration of new users is turned off with allow_registration
+// set to false.
+const SETTING_USERS_DIR = "users_dir"
+const SETTING_VAULTS_DIR = "vaults_dir"
+const SETTING_ALLOW_REGISTRATION = "allow_registration"
+
+// SETTING_SRP_SECRET holds the secret the SRP challenges of unknown users
+// are derived from, the server creates it.
+const SETTING_SRP_SECRET = "srp_secret"
+
+// PrivateKeyExchange carries SRP-6a parameters: SrpPublicKey is A from the
+// client and B from the server, SrpProof is M1 from the client and M2 from
+// the server. Username is also the SRP identity, a registration carries the
+// SrpSalt and SrpVerifier of the new user. SyncRevision and SyncEntries carry
+// the synced entries, see service.SyncTransport. PublicKey is published with
+// the private key requests and returned for Member, the other fields carry
+// the shared vaults, see service.SharedVaultTransport. SessionToken resumes
+// a login on a new connection until SessionExpiresAt.
 type PrivateKeyExchange struct {
-	PasswordHash string
-	PrivateKey   string
-	Type         string
+	PrivateKey       string
+	Type             string
+	Username         string
+	SrpPublicKey     []byte
+	SrpSalt          []byte
+	SrpProof         []byte
+	SrpVerifier      []byte
+	SyncRevision     uint64
+	SyncEntries      []service.SyncEntry
+	PublicKey        string
+	Member           string
+	Role             string
+	VaultName        string
+	WrappedKey       []byte
+	KeyVersion       uint64
+	Members          map[string][]byte
+	SharedVault      *service.SharedVault
+	SharedVaults     []service.SharedVault
+	SessionToken     string
+	SessionExpiresAt time.Time
 }
 
-type Fail2Ban struct {
-	IPAddr      string
-	FailCount   int
-	BannedUntil time.Time
-}
+// Server serves the settings of storageService overridden by the
+// environment variables and flags, see ServerSettings.
+func Server(storageService service.Storage, flags map[string]string) {
+	storedSettings := storageService.ReadSettings()
+	settings := ServerSettings(storedSettings, flags)
 
-var blacklist map[string]Fail2Ban = make(map[string]Fail2Ban, 0)
+	config, err := loadConfig(settings)
+	if err != nil {
+		log.Fatalf("Harpocrates Server: %s", err)
+	}
 
-func Server(storageService service.Storage) {
-	settings := storageService.ReadSettings()
+	userStore := users.NewStore(settings[SETTING_USERS_DIR])
+	vaultStore := vaults.NewStore(settings[SETTING_VAULTS_DIR])
 
-	masterPasswordHash, _ = core.HashPassword(settings["password"])
+	err = migrateSingleUser(storedSettings, storageService, userStore)
+	if err != nil {
+		log.Fatalf("Harpocrates Server: migrate single user: %s", err)
+	}
 
-	cert, err := tls.LoadX509KeyPair("server/util/certs/server.pem", "server/util/certs/server.key")
+	secret, err := loadSrpSecret(storedSettings, storageService)
 	if err != nil {
-		log.Fatalf("Harpocrates Server: loadkeys: %s", err)
+		log.Fatalf("Harpocrates Server: srp secret: %s", err)
 	}
 
-	config := tls.Config{Certificates: []tls.Certificate{cert}}
-	config.Rand = rand.Reader
-	service := "0.0.0.0:" + settings["port"]
-	listener, err := tls.Listen("tcp", service, &config)
+	tokens, err := newTokenIssuer(config.sessionTtl)
+	if err != nil {
+		log.Fatalf("Harpocrates Server: session tokens: %s", err)
+	}
+
+	listeners := make([]net.Listener, 0, len(config.addresses))
+
+	for _, address := range config.addresses {
+		listener, err := tls.Listen(listenNetwork(address), address, config.tls)
+
+		if err != nil {
+			log.Fatalf("Harpocrates Server: listen: %s", err)
+		}
+
+		log.Printf("Harpocrates Server: listening on %s", address)
+
+		listeners = append(listeners, listener)
+	}
+
+	state := connState{
+		settings:   settings,
+		userStore:  userStore,
+		vaultStore: vaultStore,
+		banStore:   bans.NewStore(settings[SETTING_BAN_FILE], config.banPolicy),
+		tokens:     tokens,
+		srpSecret:  secret,
+		auditLog:   audit.NewLog(settings[SETTING_AUDIT_FILE]),
+		limits:     config.limits,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+
+		// A second signal kills the server without waiting.
+		signal.Stop(signals)
+
+		log.Printf("Harpocrates Server: %s received, shutting down", sig)
+		cancel()
+	}()
+
+	if err := serve(ctx, listeners, state); err != nil {
+		log.Fatalf("Harpocrates Server: accept connection: %s", err)
+	}
+
+	log.Print("Harpocrates Server: stopped")
+}
+
+// handleClient serves a connection with a copy of the base state of the
+// server.
+func handleClient(conn net.Conn, state connState) {
+	defer conn.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go state.watch(conn, finished)
+
+	state.ip = remoteIP(conn)
+
+	if tlscon, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(state.limits.HandshakeTimeout))
+
+		if err := tlscon.Handshake(); err != nil {
+			log.Printf("Harpocrates Server: handshake: %s", err)
+			return
+		}
+
+		if certs := tlscon.ConnectionState().PeerCertificates; len(certs) > 0 {
+			state.certificate = CertificateFingerprint(certs[0].Raw)
+
+			log.Printf("Harpocrates Server: client certificate `%s` (%s)", certs[0].Subject.CommonName, state.certificate)
+		}
+	}
+
+	state.serve(conn)
+
+	log.Println("Harpocrates Server: Client connection closed")
+}
+
+// connState is what the server knows about a client connection. Requests
+// are served once SRP authenticated the user.
+type connState struct {
+	settings   map[string]string
+	userStore  users.Store
+	vaultStore vaults.Store
+	banStore   bans.Store
+	tokens     *tokenIssuer
+	srpSecret  []byte
+	auditLog   audit.Log
+	limits     limits
+	ip         net.IP
+
+	// stopping is closed when the server stops accepting connections,
+	// closing when it stops waiting for the requests in flight.
+	stopping <-chan struct{}
+	closing  <-chan struct{}
+
+	// certificate is the fingerprint of the client certificate, session
+	// tokens are bound to it.
+	certificate string
+
+	// username is the user the client claims, identity the one SRP or a
+	// session token proved. Requests run as identity.
+	version         uint16
+	capabilities    []string
+	username        string
+	identity        string
+	user            *users.User
+	srpServer       *core.SrpServer
+	clientPublicKey []byte
+	authenticated   bool
+	token           *sessionToken
+}
+
+func (c *connState) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(c.limits.ReadTimeout))
+
+	first, err := reader.Peek(1)
 
 	if err != nil {
-		log.Fatalf("Harpocrates Server: listen: %s", err)
+		return
+	}
+
+	if isUnframed(first[0]) {
+		c.serveUnframed(conn, reader)
+		return
 	}
 
-	log.Print("Harpocrates Server: listening")
+	c.serveFrames(conn, reader)
+}
 
+// serveFrames serves requests until the client closes the connection, stays
+// idle for ReadTimeout, fails to log in or the server stops.
+func (c *connState) serveFrames(conn net.Conn, reader io.Reader) {
 	for {
-		conn, err := listener.Accept()
-		conn.SetDeadline(time.Now().Add(DEFAULT_SERVER_DEADLINE))
+		conn.SetReadDeadline(time.Now().Add(c.limits.ReadTimeout))
+
+		// Checked after the deadline is set, which watch overrides once the
+		// server stops.
+		if c.stopped() {
+			return
+		}
+
+		frame, err := readFrame(reader)
+
+		if err == io.EOF {
+			return
+		}
+
 		if err != nil {
-			log.Printf("Harpocrates Server accept connection: %s", err)
-			break
+			log.Printf("Harpocrates Server: read frame: %s", err)
+			return
+		}
+
+		response, done := c.serveFrame(frame)
+
+		conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+
+		if err := writeFrame(conn, response); err != nil {
+			log.Printf("Harpocrates Server: write frame: %s", err)
+			return
+		}
+
+		if done {
+			return
 		}
+	}
+}
+
+// serveFrame answers a frame, done is set when the connection should be
+// closed afterwards.
+func (c *connState) serveFrame(frame *Frame) (response *Frame, done bool) {
+	response = &Frame{
+		Version: frame.Version,
+		Id:      frame.Id,
+		Op:      frame.Op,
+	}
+
+	if frame.Op == OP_HELLO {
+		return c.hello(frame, response)
+	}
+
+	if c.version == 0 {
+		response.Status = STATUS_BAD_REQUEST
+		response.Error = "hello is required before other requests"
+
+		return response, true
+	}
+
+	if frame.Version != c.version {
+		response.Status = STATUS_UNSUPPORTED_VERSION
+		response.Error = fmt.Sprintf("version %d was negotiated, got: %d", c.version, frame.Version)
+
+		return response, true
+	}
+
+	request := new(PrivateKeyExchange)
+	var message PrivateKeyExchange
 
-		defer conn.Close()
-		tlscon, ok := conn.(*tls.Conn)
-		if ok {
-			state := tlscon.ConnectionState()
-			for _, v := range state.PeerCertificates {
-				log.Print(x509.MarshalPKIXPublicKey(v.PublicKey))
+	if err := msgpack.Unmarshal(frame.Payload, request); err != nil {
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_BAD_REQUEST}
+	} else if capability, ok := opCapabilities[frame.Op]; ok && !containsString(c.capabilities, capability) {
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_NOT_NEGOTIATED}
+	} else if c.authenticated && isLogin(frame.Op) {
+		// A connection logs in once, another user needs another connection.
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_ALREADY_AUTHENTICATED}
+	} else {
+		switch frame.Op {
+		case OP_REGISTER:
+			message = c.register(request)
+		case OP_SRP_INIT:
+			message = c.srpInit(request)
+		case OP_SRP_PROOF:
+			message = c.srpVerify(request)
+
+			if c.authenticated {
+				c.issueToken(&message)
+			}
+		case OP_RESUME:
+			message = c.resume(request)
+		case OP_REFRESH_SESSION:
+			if !c.authenticated {
+				message = PrivateKeyExchange{Type: MESSAGE_TYPE_UNAUTHENTICATED}
+			} else {
+				message = PrivateKeyExchange{Type: MESSAGE_TYPE_AUTHENTICATED}
+				c.issueToken(&message)
+			}
+		case OP_LOGOUT:
+			message = c.logout(request)
+		default:
+			if messageType, ok := opTypes[frame.Op]; !ok {
+				message = PrivateKeyExchange{Type: MESSAGE_TYPE_UNKNOWN_REQUEST}
+			} else if !c.authenticated {
+				message = PrivateKeyExchange{Type: MESSAGE_TYPE_UNAUTHENTICATED}
+			} else {
+				request.Type = messageType
+				message = c.handle(request)
 			}
 		}
+	}
+
+	if frame.Op != OP_SRP_INIT || message.Type != MESSAGE_TYPE_SRP_CHALLENGE {
+		c.recordRequest(frame.Op.String(), request, &message)
+	}
 
-		go handleClient(conn, settings, storageService)
+	if status, ok := messageStatuses[message.Type]; ok {
+		response.Status = status.Status
+		response.Error = status.Error
 	}
+
+	payload, err := msgpack.Marshal(&message)
+
+	if err != nil {
+		log.Printf("Harpocrates Server: encode response: %s", err)
+
+		response.Status = STATUS_INTERNAL_ERROR
+		response.Error = messageStatuses[MESSAGE_TYPE_INTERNAL_ERROR].Error
+	}
+
+	response.Payload = payload
+
+	switch message.Type {
+	case MESSAGE_TYPE_WRONG_CREDENTIALS, MESSAGE_TYPE_BANNED, MESSAGE_TYPE_USER_DISABLED:
+		done = true
+	}
+
+	return response, done
 }
 
-func handleClient(conn net.Conn, settings map[string]string, storageService service.Storage) {
-	defer conn.Close()
+// isLogin tells whether op registers or logs in a user.
+func isLogin(op Op) bool {
+	return op == OP_REGISTER || op == OP_SRP_INIT || op == OP_SRP_PROOF || op == OP_RESUME
+}
 
-	decoder := msgpack.NewDecoder(conn)
+func (c *connState) hello(frame *Frame, response *Frame) (*Frame, bool) {
+	hello := new(Hello)
+
+	if err := msgpack.Unmarshal(frame.Payload, hello); err != nil {
+		response.Status = STATUS_BAD_REQUEST
+		response.Error = messageStatuses[MESSAGE_TYPE_BAD_REQUEST].Error
+
+		return response, true
+	}
+
+	version, ok := negotiate(hello)
+
+	if !ok {
+		response.Status = STATUS_UNSUPPORTED_VERSION
+		response.Error = fmt.Sprintf("server speaks versions %d to %d, client %d to %d", PROTOCOL_MIN_VERSION, PROTOCOL_VERSION, hello.MinVersion, hello.MaxVersion)
+
+		return response, true
+	}
+
+	c.version = version
+	c.capabilities = commonCapabilities(hello.Capabilities)
+
+	payload, err := msgpack.Marshal(&Hello{
+		MinVersion:   PROTOCOL_MIN_VERSION,
+		MaxVersion:   PROTOCOL_VERSION,
+		Version:      version,
+		Capabilities: c.capabilities,
+		IdleTimeout:  int64(c.limits.ReadTimeout),
+	})
+
+	if err != nil {
+		response.Status = STATUS_INTERNAL_ERROR
+		response.Error = messageStatuses[MESSAGE_TYPE_INTERNAL_ERROR].Error
+
+		return response, true
+	}
+
+	response.Version = version
+	response.Payload = payload
+
+	return response, false
+}
+
+// serveUnframed serves the single request of a client from before the
+// framed protocol, the request rides on the SRP proof.
+func (c *connState) serveUnframed(conn net.Conn, reader io.Reader) {
+	encoder := msgpack.NewEncoder(conn)
+	decoder := msgpack.NewDecoder(reader)
 	tmpstruct := new(PrivateKeyExchange)
 
 	decoder.Decode(tmpstruct)
 
-	var message PrivateKeyExchange
+	if tmpstruct.Type == MESSAGE_TYPE_REGISTER {
+		message := c.register(tmpstruct)
+		c.recordRequest(MESSAGE_TYPE_REGISTER, tmpstruct, &message)
 
-	if val, ok := blacklist[conn.RemoteAddr().String()]; ok {
-		if val.BannedUntil.After(time.Now()) {
-			message = PrivateKeyExchange{
-				Type: MESSAGE_TYPE_BANNED,
-			}
+		conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+		encoder.Encode(message)
+		return
+	}
+
+	if tmpstruct.Type == MESSAGE_TYPE_SRP_INIT {
+		challenge := c.srpInit(tmpstruct)
 
-			b, _ := msgpack.Marshal(message)
-			conn.Write(b)
+		conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+		encoder.Encode(challenge)
+
+		if challenge.Type != MESSAGE_TYPE_SRP_CHALLENGE {
+			c.recordRequest(MESSAGE_TYPE_SRP_INIT, tmpstruct, &challenge)
 			return
 		}
+
+		tmpstruct = new(PrivateKeyExchange)
+
+		conn.SetReadDeadline(time.Now().Add(c.limits.ReadTimeout))
+		decoder.Decode(tmpstruct)
+	}
+
+	message := c.srpVerify(tmpstruct)
+	c.recordRequest(OP_SRP_PROOF.String(), &PrivateKeyExchange{}, &message)
+
+	if c.authenticated {
+		serverProof := message.SrpProof
+
+		message = c.handle(tmpstruct)
+		message.SrpProof = serverProof
+
+		c.recordRequest(tmpstruct.Type, tmpstruct, &message)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+	encoder.Encode(message)
+}
+
+func (c *connState) banned() bool {
+	_, banned, err := c.banStore.Banned(c.ip)
+
+	if err != nil {
+		log.Printf("Harpocrates Server: bans: %s", err)
+	}
+
+	return banned
+}
+
+func (c *connState) register(request *PrivateKeyExchange) PrivateKeyExchange {
+	if c.banned() {
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_BANNED,
+		}
+	}
+
+	return register(request, c.settings, c.userStore)
+}
+
+// srpInit answers the first SRP message with the challenge of the user.
+func (c *connState) srpInit(request *PrivateKeyExchange) PrivateKeyExchange {
+	if c.banned() {
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_BANNED,
+		}
+	}
+
+	c.username = usernameOrDefault(request.Username)
+	user, err := c.userStore.Get(c.username)
+
+	if err != nil && err != users.ErrUserNotFound {
+		log.Printf("Harpocrates Server: user `%s`: %s", c.username, err)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INTERNAL_ERROR,
+		}
+	}
+
+	srpServer, err := newSrpServer(c.username, user, c.srpSecret)
+
+	if err != nil {
+		log.Printf("Harpocrates Server: srp: %s", err)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INTERNAL_ERROR,
+		}
+	}
+
+	c.user = user
+	c.srpServer = srpServer
+	c.clientPublicKey = request.SrpPublicKey
+
+	return PrivateKeyExchange{
+		Type:         MESSAGE_TYPE_SRP_CHALLENGE,
+		SrpPublicKey: srpServer.PublicKey(),
+		SrpSalt:      srpServer.Salt(),
 	}
+}
 
-	authResult := core.CheckPasswordHash(tmpstruct.PasswordHash, masterPasswordHash)
+// srpVerify checks the proof of the client, a challenge is answered once.
+func (c *connState) srpVerify(request *PrivateKeyExchange) PrivateKeyExchange {
+	authResult := false
+	var serverProof []byte
+
+	if c.srpServer != nil {
+		var err error
+
+		serverProof, err = c.srpServer.Verify(c.clientPublicKey, request.SrpProof)
+		authResult = err == nil && c.user != nil
+		c.srpServer = nil
+	}
 
 	if authResult == false {
-		if val, ok := blacklist[conn.RemoteAddr().String()]; !ok {
-			blacklist[conn.RemoteAddr().String()] = Fail2Ban{
-				IPAddr:      conn.RemoteAddr().String(),
-				FailCount:   1,
-				BannedUntil: time.Now(),
-			}
-		} else {
-			bannedUntil := val.BannedUntil.Add(time.Duration(val.FailCount) * time.Minute)
+		ban, err := c.banStore.Fail(c.ip)
 
-			blacklist[conn.RemoteAddr().String()] = Fail2Ban{
-				IPAddr:      val.IPAddr,
-				FailCount:   val.FailCount + 1,
-				BannedUntil: bannedUntil,
-			}
+		if err != nil {
+			log.Printf("Harpocrates Server: bans: %s", err)
+		} else if ban.Banned(time.Now()) {
+			log.Printf("Harpocrates Server: %s banned until %s after %d failed logins", ban.Address, ban.BannedUntil.Format(time.RFC3339), ban.Failures)
+
+			c.record(audit.Event{
+				Operation: audit.OPERATION_BAN,
+				Outcome:   audit.OUTCOME_BANNED,
+				Detail:    fmt.Sprintf("`%s` until %s after %d failed logins", ban.Address, ban.BannedUntil.Format(time.RFC3339), ban.Failures),
+			})
 		}
 
 		log.Println("Wrong password attempt!")
 
-		message = PrivateKeyExchange{
+		return PrivateKeyExchange{
 			Type: MESSAGE_TYPE_WRONG_CREDENTIALS,
 		}
-	} else {
-		if _, ok := blacklist[conn.RemoteAddr().String()]; ok {
-			delete(blacklist, conn.RemoteAddr().String())
+	}
+
+	if c.user.Disabled {
+		log.Printf("Harpocrates Server: disabled user `%s` tried to log in", c.username)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_USER_DISABLED,
 		}
+	}
+
+	if err := c.banStore.Succeed(c.ip); err != nil {
+		log.Printf("Harpocrates Server: bans: %s", err)
+	}
+
+	c.identity = c.username
+	c.authenticated = true
 
-		switch tmpstruct.Type {
-		case MESSAGE_TYPE_GET_PRIVATE_KEY:
-			priKeyFile, _ := os.OpenFile(settings["private_key"], os.O_RDONLY|os.O_CREATE, 0666)
-			bytes, _ := ioutil.ReadAll(priKeyFile)
+	return PrivateKeyExchange{
+		Type:     MESSAGE_TYPE_AUTHENTICATED,
+		SrpProof: serverProof,
+	}
+}
+
+// issueToken adds a new session token to message, it replaces the token of
+// the connection.
+func (c *connState) issueToken(message *PrivateKeyExchange) {
+	s, token, err := c.tokens.issue(c.identity, c.certificate)
+
+	if err != nil {
+		log.Printf("Harpocrates Server: session token: %s", err)
+
+		*message = PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INTERNAL_ERROR,
+		}
+
+		return
+	}
+
+	if c.token != nil {
+		c.tokens.revoke(c.token)
+	}
+
+	c.token = token
+	message.SessionToken = s
+	message.SessionExpiresAt = token.ExpiresAt
+}
+
+// resume logs the connection in with a session token instead of SRP.
+func (c *connState) resume(request *PrivateKeyExchange) PrivateKeyExchange {
+	if c.banned() {
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_BANNED,
+		}
+	}
+
+	token, err := c.tokens.verify(request.SessionToken, c.certificate)
+
+	if err != nil {
+		log.Printf("Harpocrates Server: resume: %s", err)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_SESSION_INVALID,
+		}
+	}
+
+	user, err := c.userStore.Get(token.Username)
+
+	if err == users.ErrUserNotFound {
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_SESSION_INVALID,
+		}
+	}
+
+	if err != nil {
+		log.Printf("Harpocrates Server: user `%s`: %s", token.Username, err)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INTERNAL_ERROR,
+		}
+	}
+
+	if user.Disabled {
+		log.Printf("Harpocrates Server: disabled user `%s` tried to resume a session", token.Username)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_USER_DISABLED,
+		}
+	}
+
+	// A pending SRP challenge was for the user of srpInit.
+	c.srpServer = nil
+	c.username = token.Username
+	c.identity = token.Username
+	c.user = user
+	c.token = token
+	c.authenticated = true
+
+	return PrivateKeyExchange{
+		Type:             MESSAGE_TYPE_AUTHENTICATED,
+		SessionToken:     request.SessionToken,
+		SessionExpiresAt: token.ExpiresAt,
+	}
+}
+
+// logout revokes the token of the connection and the one of the request, a
+// client may log out a saved token without resuming it first.
+func (c *connState) logout(request *PrivateKeyExchange) PrivateKeyExchange {
+	if len(request.SessionToken) > 0 {
+		if token, err := c.tokens.verify(request.SessionToken, c.certificate); err == nil {
+			c.tokens.revoke(token)
+		}
+	}
+
+	if c.token != nil {
+		c.tokens.revoke(c.token)
+	}
+
+	c.token = nil
+	c.user = nil
+	c.identity = ""
+	c.authenticated = false
+
+	return PrivateKeyExchange{
+		Type: MESSAGE_TYPE_LOGGED_OUT,
+	}
+}
+
+// handle serves a request of the authenticated user.
+func (c *connState) handle(request *PrivateKeyExchange) PrivateKeyExchange {
+	username := c.identity
+	userStore := c.userStore
+
+	var message PrivateKeyExchange
+
+	existing, err := userStore.PrivateKey(username)
+
+	publishPublicKey(username, request.PublicKey, userStore)
+
+	switch request.Type {
+	case MESSAGE_TYPE_GET_PRIVATE_KEY:
+		message = PrivateKeyExchange{
+			PrivateKey: string(existing),
+			Type:       MESSAGE_TYPE_GET_PRIVATE_KEY,
+		}
+	case MESSAGE_TYPE_STORE_PRIVATE_KEY:
+		if err != users.ErrPrivateKeyNotFound {
+			log.Println("Attempt to private key override!")
 
 			message = PrivateKeyExchange{
-				PrivateKey: string(bytes),
-				Type:       MESSAGE_TYPE_GET_PRIVATE_KEY,
+				Type: MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS,
 			}
+		} else {
+			message = storePrivateKey(username, request.PrivateKey, userStore)
+		}
+	case MESSAGE_TYPE_UPGRADE_PRIVATE_KEY:
+		// Keys escrowed before sealing existed are plain PEM; the client
+		// may replace such a key with its sealed form exactly once.
+		if err != nil || core.IsPassphraseSealed(existing) {
+			log.Println("Attempt to private key override!")
 
-			priKeyFile.Close()
-			break
-		case MESSAGE_TYPE_STORE_PRIVATE_KEY:
-			if _, ok := settings["private_key"]; ok {
-				log.Println("Attempt to private key override!")
+			message = PrivateKeyExchange{
+				Type: MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS,
+			}
+		} else {
+			message = storePrivateKey(username, request.PrivateKey, userStore)
+		}
+	case MESSAGE_TYPE_PULL_VAULT:
+		entries, revision, err := pullVault(userStore.Location(username, users.SYNC_VAULT_NAME), request.SyncRevision)
 
-				message = PrivateKeyExchange{
-					Type: MESSAGE_TYPE_PRIVATE_KEY_ALREADY_EXISTS,
-				}
-			} else {
-				priKeyFile, _ := os.OpenFile(service.PRIVATE_KEY_LOCATION, os.O_WRONLY|os.O_CREATE, 0666)
+		message = syncMessage(MESSAGE_TYPE_PULL_VAULT, entries, revision, err)
+	case MESSAGE_TYPE_PUSH_VAULT:
+		entries, err := pushVault(userStore.Location(username, users.SYNC_VAULT_NAME), request.SyncEntries)
+
+		message = syncMessage(MESSAGE_TYPE_PUSH_VAULT, entries, 0, err)
+	case MESSAGE_TYPE_CREATE_VAULT, MESSAGE_TYPE_LIST_VAULTS, MESSAGE_TYPE_GET_VAULT, MESSAGE_TYPE_GET_PUBLIC_KEY,
+		MESSAGE_TYPE_ADD_MEMBER, MESSAGE_TYPE_REKEY_VAULT, MESSAGE_TYPE_PUSH_SHARED, MESSAGE_TYPE_SET_ROLE:
+		message = handleSharedVault(username, request, userStore, c.vaultStore)
+	default:
+		message = PrivateKeyExchange{
+			Type: MESSAGE_TYPE_UNKNOWN_REQUEST,
+		}
+	}
 
-				writer := bufio.NewWriter(priKeyFile)
-				writer.Write([]byte(tmpstruct.PrivateKey))
-				writer.Flush()
+	return message
+}
 
-				settings["private_key"] = service.PRIVATE_KEY_LOCATION
-				storageService.StoreSettings(settings)
+// publishPublicKey keeps the first public key a user sends, later ones can
+// not replace it behind the back of the members of shared vaults.
+func publishPublicKey(username, publicKey string, userStore users.Store) {
+	if len(publicKey) <= 0 {
+		return
+	}
 
-				priKeyFile.Close()
+	if _, err := userStore.PublicKey(username); err != users.ErrPublicKeyNotFound {
+		return
+	}
 
-				message = PrivateKeyExchange{
-					Type: MESSAGE_TYPE_PRIVATE_KEY_SAVED,
-				}
-			}
+	if err := userStore.StorePublicKey(username, []byte(publicKey)); err != nil {
+		log.Printf("Harpocrates Server: store public key: %s", err)
+	}
+}
+
+// register creates an account from the SRP verifier the client computed, the
+// password never reaches the server.
+func register(request *PrivateKeyExchange, settings map[string]string, userStore users.Store) PrivateKeyExchange {
+	if settings[SETTING_ALLOW_REGISTRATION] == "false" {
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_REGISTRATION_CLOSED,
 		}
 	}
 
-	b, _ := msgpack.Marshal(message)
-	conn.Write(b)
+	err := userStore.Create(users.User{
+		Name:        request.Username,
+		SrpSalt:     request.SrpSalt,
+		SrpVerifier: request.SrpVerifier,
+	})
 
-	log.Println("Harpocrates Server: Client connection closed")
+	switch err {
+	case nil:
+		log.Printf("Harpocrates Server: user `%s` registered", request.Username)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_REGISTERED,
+		}
+	case users.ErrUserExists:
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_USER_ALREADY_EXISTS,
+		}
+	case users.ErrInvalidUsername:
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INVALID_USERNAME,
+		}
+	}
+
+	log.Printf("Harpocrates Server: register: %s", err)
+
+	return PrivateKeyExchange{
+		Type: MESSAGE_TYPE_INTERNAL_ERROR,
+	}
+}
+
+func storePrivateKey(username, privateKey string, userStore users.Store) PrivateKeyExchange {
+	if !core.IsPassphraseSealed([]byte(privateKey)) {
+		log.Println("Attempt to store unencrypted private key!")
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_PRIVATE_KEY_NOT_ENCRYPTED,
+		}
+	}
+
+	if err := userStore.StorePrivateKey(username, []byte(privateKey)); err != nil {
+		log.Printf("Harpocrates Server: store private key: %s", err)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INTERNAL_ERROR,
+		}
+	}
+
+	return PrivateKeyExchange{
+		Type: MESSAGE_TYPE_PRIVATE_KEY_SAVED,
+	}
+}
+
+func syncMessage(messageType string, entries []service.SyncEntry, revision uint64, err error) PrivateKeyExchange {
+	if err != nil {
+		log.Printf("Harpocrates Server: sync: %s", err)
+
+		return PrivateKeyExchange{
+			Type: MESSAGE_TYPE_INTERNAL_ERROR,
+		}
+	}
+
+	return PrivateKeyExchange{
+		Type:         messageType,
+		SyncRevision: revision,
+		SyncEntries:  entries,
+	}
+}
+
+// migrateSingleUser turns the master password and private key of servers
+// set up before accounts existed into the account of DEFAULT_USERNAME. Every
+// step can run again, so a server which stopped halfway finishes the
+// migration on the next start.
+func migrateSingleUser(settings map[string]string, storageService service.Storage, userStore users.Store) error {
+	// The verifier is stored first, a new one would not match the account
+	// of an earlier run.
+	if _, ok := settings["password"]; ok {
+		salt, verifier, err := core.NewSrpVerifier(DEFAULT_USERNAME, settings["password"])
+
+		if err != nil {
+			return err
+		}
+
+		settings["srp_salt"] = hex.EncodeToString(salt)
+		settings["srp_verifier"] = hex.EncodeToString(verifier)
+		delete(settings, "password")
+
+		storageService.StoreSettings(settings)
+	}
+
+	if _, ok := settings["srp_verifier"]; !ok {
+		return nil
+	}
+
+	salt, err := hex.DecodeString(settings["srp_salt"])
+	if err != nil {
+		return err
+	}
+
+	verifier, err := hex.DecodeString(settings["srp_verifier"])
+	if err != nil {
+		return err
+	}
+
+	err = userStore.Create(users.User{
+		Name:        DEFAULT_USERNAME,
+		SrpSalt:     salt,
+		SrpVerifier: verifier,
+	})
+
+	if err == users.ErrUserExists {
+		err = checkMigratedUser(salt, verifier, userStore)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if location, ok := settings["private_key"]; ok {
+		privateKey, err := ioutil.ReadFile(location)
+
+		if os.IsNotExist(err) {
+			// Removed by an earlier run once the account held it.
+			_, err = userStore.PrivateKey(DEFAULT_USERNAME)
+		} else if err == nil {
+			err = userStore.StorePrivateKey(DEFAULT_USERNAME, privateKey)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		os.Remove(location)
+	}
+
+	if _, err := os.Stat(service.SYNC_VAULT_LOCATION); err == nil {
+		if err := os.Rename(service.SYNC_VAULT_LOCATION, userStore.Location(DEFAULT_USERNAME, users.SYNC_VAULT_NAME)); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{"password", "srp_salt", "srp_verifier", "private_key"} {
+		delete(settings, key)
+	}
+
+	storageService.StoreSettings(settings)
+
+	log.Printf("Harpocrates Server: master password and private key moved to user `%s`", DEFAULT_USERNAME)
+
+	return nil
+}
+
+// checkMigratedUser accepts the account of DEFAULT_USERNAME when an earlier
+// migration created it with the same verifier.
+func checkMigratedUser(salt, verifier []byte, userStore users.Store) error {
+	user, err := userStore.Get(DEFAULT_USERNAME)
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(user.SrpSalt, salt) || !bytes.Equal(user.SrpVerifier, verifier) {
+		return fmt.Errorf("user `%s` exists with another master password", DEFAULT_USERNAME)
+	}
+
+	return nil
+}
+
+// newSrpServer answers unknown users with the challenge of a decoy
+// verifier, so they fail like a wrong password and can not be told apart
+// from existing users.
+func newSrpServer(username string, user *users.User, secret []byte) (*core.SrpServer, error) {
+	if user == nil {
+		salt, verifier := core.NewSrpDecoy(secret, username)
+
+		return core.NewSrpServer(username, salt, verifier)
+	}
+
+	return core.NewSrpServer(user.Name, user.SrpSalt, user.SrpVerifier)
+}
+
+// loadSrpSecret returns the secret of the decoy verifiers, it is created on the
+// first start and kept in the settings so the decoys survive restarts.
+func loadSrpSecret(settings map[string]string, storageService service.Storage) ([]byte, error) {
+	if secret, err := hex.DecodeString(settings[SETTING_SRP_SECRET]); err == nil && len(secret) >= 32 {
+		return secret, nil
+	}
+
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	settings[SETTING_SRP_SECRET] = hex.EncodeToString(secret)
+	storageService.StoreSettings(settings)
+
+	return secret, nil
+}
+
+func usernameOrDefault(username string) string {
+	if len(username) <= 0 {
+		return DEFAULT_USERNAME
+	}
+
+	return username
 }
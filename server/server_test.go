@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
+)
+
+func Test_it_should_finish_single_user_migration_on_next_start(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	settingsLocation := filepath.Join(dir, "server_harpocrates.ini")
+	privateKey := filepath.Join(dir, "harpocrates.key")
+
+	ioutil.WriteFile(privateKey, []byte("private key"), 0600)
+
+	storageService := service.NewStorage("", settingsLocation, "server")
+	storageService.StoreSettings(map[string]string{"password": "secret", "private_key": privateKey})
+
+	userStore := users.NewStore(filepath.Join(dir, "users"))
+
+	if err := migrateSingleUser(storageService.ReadSettings(), storageService, userStore); err != nil {
+		t.Fatalf("Single user could not be migrated: %s", err)
+	}
+
+	// A start which stopped after removing the private key, before the
+	// settings were cleared.
+	user, _ := userStore.Get(DEFAULT_USERNAME)
+
+	storageService.StoreSettings(map[string]string{
+		"srp_salt":     hex.EncodeToString(user.SrpSalt),
+		"srp_verifier": hex.EncodeToString(user.SrpVerifier),
+		"private_key":  privateKey,
+	})
+
+	if err := migrateSingleUser(storageService.ReadSettings(), storageService, userStore); err != nil {
+		t.Fatalf("Single user migration could not run again: %s", err)
+	}
+
+	settings := storageService.ReadSettings()
+
+	for _, key := range []string{"password", "srp_salt", "srp_verifier", "private_key"} {
+		if _, ok := settings[key]; ok {
+			t.Errorf("Setting `%s` was not cleared", key)
+		}
+	}
+
+	if key, err := userStore.PrivateKey(DEFAULT_USERNAME); err != nil || string(key) != "private key" {
+		t.Errorf("Private key was incorrect, got: %s, %v, want: %s", key, err, "private key")
+	}
+
+	// An account of another master password is not taken over.
+	storageService.StoreSettings(map[string]string{"password": "other"})
+
+	if err := migrateSingleUser(storageService.ReadSettings(), storageService, userStore); err == nil {
+		t.Errorf("Account of another master password was migrated")
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
+	"github.com/blueskan/harpocrates/vaults"
+)
+
+var errVaultForbidden = errors.New("forbidden")
+var errVaultKeyChanged = errors.New("key changed")
+var errVaultChanged = errors.New("vault changed")
+var errMemberExists = errors.New("member exists")
+
+// handleSharedVault serves the shared vault messages of an authenticated
+// user. Only members see a vault, read-write members change its passwords
+// and admins change its members and their roles.
+func handleSharedVault(username string, request *PrivateKeyExchange, userStore users.Store, vaultStore vaults.Store) PrivateKeyExchange {
+	var message PrivateKeyExchange
+	var err error
+
+	switch request.Type {
+	case MESSAGE_TYPE_CREATE_VAULT:
+		vault := vaults.Vault{
+			Name:    request.VaultName,
+			Owner:   username,
+			Members: map[string][]byte{username: request.WrappedKey},
+		}
+
+		vault.SetRole(username, username, service.SHARED_VAULT_ROLE_ADMIN)
+
+		err = vaultStore.Create(vault)
+
+		if err == nil {
+			log.Printf("Harpocrates Server: user `%s` created shared vault `%s`", username, request.VaultName)
+		}
+	case MESSAGE_TYPE_LIST_VAULTS:
+		var list []vaults.Vault
+		list, err = vaultStore.List()
+
+		message.SharedVaults = make([]service.SharedVault, 0)
+
+		for _, vault := range list {
+			if _, ok := vault.Members[username]; ok {
+				sharedVault := toSharedVault(&vault, username)
+				sharedVault.WrappedKey = nil
+				sharedVault.Audit = nil
+
+				message.SharedVaults = append(message.SharedVaults, *sharedVault)
+			}
+		}
+	case MESSAGE_TYPE_GET_VAULT:
+		var vault *vaults.Vault
+		vault, err = vaultStore.Get(request.VaultName)
+
+		if err == nil {
+			if _, ok := vault.Members[username]; !ok {
+				err = vaults.ErrVaultNotFound
+			} else {
+				message.SharedVault = toSharedVault(vault, username)
+			}
+		}
+	case MESSAGE_TYPE_GET_PUBLIC_KEY:
+		var publicKey []byte
+		publicKey, err = userStore.PublicKey(request.Member)
+		message.PublicKey = string(publicKey)
+	case MESSAGE_TYPE_ADD_MEMBER:
+		if err = service.ValidateSharedVaultRole(request.Role); err != nil {
+			break
+		}
+
+		if _, err = userStore.PublicKey(request.Member); err != nil {
+			break
+		}
+
+		err = vaultStore.Update(request.VaultName, func(vault *vaults.Vault) error {
+			if err := checkRole(vault, username, service.SHARED_VAULT_ROLE_ADMIN); err != nil {
+				return err
+			}
+
+			if _, ok := vault.Members[request.Member]; ok {
+				return errMemberExists
+			}
+
+			vault.Members[request.Member] = request.WrappedKey
+			vault.SetRole(username, request.Member, request.Role)
+
+			return nil
+		})
+
+		if err == nil {
+			log.Printf("Harpocrates Server: user `%s` added `%s` to shared vault `%s` as %s", username, request.Member, request.VaultName, request.Role)
+		}
+	case MESSAGE_TYPE_SET_ROLE:
+		if err = service.ValidateSharedVaultRole(request.Role); err != nil {
+			break
+		}
+
+		err = vaultStore.Update(request.VaultName, func(vault *vaults.Vault) error {
+			if err := checkRole(vault, username, service.SHARED_VAULT_ROLE_ADMIN); err != nil {
+				return err
+			}
+
+			if _, ok := vault.Members[request.Member]; !ok {
+				return users.ErrUserNotFound
+			}
+
+			// The owner stays an admin, otherwise nobody may be left to
+			// manage the vault.
+			if request.Member == vault.Owner {
+				return errVaultForbidden
+			}
+
+			vault.SetRole(username, request.Member, request.Role)
+
+			return nil
+		})
+
+		if err == nil {
+			log.Printf("Harpocrates Server: user `%s` made `%s` %s in shared vault `%s`", username, request.Member, request.Role, request.VaultName)
+		}
+	case MESSAGE_TYPE_REKEY_VAULT:
+		err = vaultStore.Update(request.VaultName, func(vault *vaults.Vault) error {
+			if err := checkRole(vault, username, service.SHARED_VAULT_ROLE_ADMIN); err != nil {
+				return err
+			}
+
+			if vault.KeyVersion != request.KeyVersion {
+				return errVaultKeyChanged
+			}
+
+			// The re-key replaces the entries, the ones pushed since the
+			// client read the vault would be lost.
+			if vault.Revision != request.SyncRevision {
+				return errVaultChanged
+			}
+
+			// Members can be removed but not added by a re-key, and the
+			// owner always stays unless it was deleted.
+			if _, ok := request.Members[vault.Owner]; !ok && len(vault.Owner) > 0 {
+				return errVaultForbidden
+			}
+
+			for member := range request.Members {
+				if _, ok := vault.Members[member]; !ok {
+					return errVaultForbidden
+				}
+			}
+
+			for member := range vault.Members {
+				if _, ok := request.Members[member]; !ok {
+					vault.SetRole(username, member, "")
+				}
+			}
+
+			vault.KeyVersion++
+			vault.RekeyNeeded = false
+			vault.Revision++
+			vault.Members = request.Members
+			vault.Entries = make(map[string]service.SyncEntry, len(request.SyncEntries))
+
+			for _, entry := range request.SyncEntries {
+				entry.Revision = vault.Revision
+				entry.BaseRevision = 0
+				vault.Entries[entry.Id] = entry
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			log.Printf("Harpocrates Server: user `%s` re-keyed shared vault `%s`", username, request.VaultName)
+		}
+	case MESSAGE_TYPE_PUSH_SHARED:
+		message.SyncEntries = make([]service.SyncEntry, 0, len(request.SyncEntries))
+
+		err = vaultStore.Update(request.VaultName, func(vault *vaults.Vault) error {
+			if err := checkRole(vault, username, service.SHARED_VAULT_ROLE_READ_WRITE); err != nil {
+				return err
+			}
+
+			if vault.KeyVersion != request.KeyVersion {
+				return errVaultKeyChanged
+			}
+
+			for _, entry := range request.SyncEntries {
+				if vault.Entries[entry.Id].Revision != entry.BaseRevision {
+					message.SyncEntries = append(message.SyncEntries, service.SyncEntry{Id: entry.Id, Conflict: true})
+					continue
+				}
+
+				vault.Revision++
+
+				if entry.Deleted {
+					delete(vault.Entries, entry.Id)
+				} else {
+					entry.Revision = vault.Revision
+					entry.BaseRevision = 0
+					vault.Entries[entry.Id] = entry
+				}
+
+				message.SyncEntries = append(message.SyncEntries, service.SyncEntry{Id: entry.Id, Revision: vault.Revision, Deleted: entry.Deleted})
+			}
+
+			return nil
+		})
+	}
+
+	switch err {
+	case nil:
+		message.Type = request.Type
+	case vaults.ErrVaultNotFound:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_VAULT_NOT_FOUND}
+	case vaults.ErrVaultExists:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_VAULT_ALREADY_EXISTS}
+	case vaults.ErrInvalidVaultName:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_INVALID_VAULT_NAME}
+	case errVaultForbidden:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_VAULT_FORBIDDEN}
+	case errVaultKeyChanged:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_VAULT_KEY_CHANGED}
+	case errVaultChanged:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_VAULT_CHANGED}
+	case users.ErrUserNotFound, users.ErrPublicKeyNotFound:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_MEMBER_NOT_FOUND}
+	case errMemberExists:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_MEMBER_ALREADY_EXISTS}
+	case service.ErrInvalidRole:
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_INVALID_ROLE}
+	default:
+		log.Printf("Harpocrates Server: shared vault: %s", err)
+
+		message = PrivateKeyExchange{Type: MESSAGE_TYPE_INTERNAL_ERROR}
+	}
+
+	return message
+}
+
+func checkRole(vault *vaults.Vault, username, role string) error {
+	if _, ok := vault.Members[username]; !ok {
+		return vaults.ErrVaultNotFound
+	}
+
+	if !vault.Allows(username, role) {
+		return errVaultForbidden
+	}
+
+	return nil
+}
+
+func toSharedVault(vault *vaults.Vault, username string) *service.SharedVault {
+	sharedVault := &service.SharedVault{
+		Name:        vault.Name,
+		Owner:       vault.Owner,
+		Members:     make([]string, 0, len(vault.Members)),
+		Roles:       make(map[string]string, len(vault.Members)),
+		Role:        vault.Role(username),
+		KeyVersion:  vault.KeyVersion,
+		RekeyNeeded: vault.RekeyNeeded,
+		WrappedKey:  vault.Members[username],
+		Revision:    vault.Revision,
+		Entries:     make([]service.SyncEntry, 0, len(vault.Entries)),
+		Audit:       vault.Audit,
+	}
+
+	for member := range vault.Members {
+		sharedVault.Members = append(sharedVault.Members, member)
+		sharedVault.Roles[member] = vault.Role(member)
+	}
+
+	sort.Strings(sharedVault.Members)
+
+	for _, entry := range vault.Entries {
+		sharedVault.Entries = append(sharedVault.Entries, entry)
+	}
+
+	return sharedVault
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/vmihailenco/msgpack"
+)
+
+// syncVault keeps the entries clients push. They are encrypted by the
+// clients, the server only orders them with a revision counter.
+type syncVault struct {
+	Revision uint64
+	Entries  map[string]service.SyncEntry
+}
+
+var syncMutex sync.Mutex
+
+func readSyncVault(location string) (*syncVault, error) {
+	vault := &syncVault{Entries: make(map[string]service.SyncEntry)}
+
+	b, err := ioutil.ReadFile(location)
+
+	if os.IsNotExist(err) {
+		return vault, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := msgpack.Unmarshal(b, vault); err != nil {
+		return nil, err
+	}
+
+	if vault.Entries == nil {
+		vault.Entries = make(map[string]service.SyncEntry)
+	}
+
+	return vault, nil
+}
+
+// pullVault returns the entries of the vault at location changed after the
+// revision since.
+func pullVault(location string, since uint64) ([]service.SyncEntry, uint64, error) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	vault, err := readSyncVault(location)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]service.SyncEntry, 0)
+
+	for _, entry := range vault.Entries {
+		if entry.Revision > since {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, vault.Revision, nil
+}
+
+// pushVault stores the entries based on the current revision of their id and
+// returns them with their new revision, the others come back as Conflict.
+func pushVault(location string, entries []service.SyncEntry) ([]service.SyncEntry, error) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	vault, err := readSyncVault(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pushed := make([]service.SyncEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		if vault.Entries[entry.Id].Revision != entry.BaseRevision {
+			pushed = append(pushed, service.SyncEntry{Id: entry.Id, Conflict: true})
+			continue
+		}
+
+		vault.Revision++
+
+		entry.Revision = vault.Revision
+		entry.BaseRevision = 0
+		entry.Conflict = false
+		vault.Entries[entry.Id] = entry
+
+		pushed = append(pushed, service.SyncEntry{Id: entry.Id, Revision: entry.Revision, Deleted: entry.Deleted})
+	}
+
+	b, err := msgpack.Marshal(vault)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := service.WriteFileAtomic(location, b); err != nil {
+		return nil, err
+	}
+
+	return pushed, nil
+}
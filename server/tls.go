@@ -0,0 +1,267 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/blueskan/harpocrates/ca"
+)
+
+// Certificate settings, server_harpocrates.ini uses tls_cert, tls_key and
+// tls_ca (the CA client certificates must chain to) and optionally tls_crl,
+// the revocation list of that CA which is read again on every handshake so a
+// `harpocrates ca revoke` takes effect immediately. client_harpocrates.ini
+// uses tls_cert, tls_key, optionally tls_ca (the CA the server certificate
+// must chain to) and server_fingerprint, which pins the server certificate.
+const SETTING_TLS_CERT = "tls_cert"
+const SETTING_TLS_KEY = "tls_key"
+const SETTING_TLS_CA = "tls_ca"
+const SETTING_TLS_CRL = "tls_crl"
+const SETTING_TLS_SERVER_NAME = "tls_server_name"
+const SETTING_SERVER_FINGERPRINT = "server_fingerprint"
+
+// tls_min_version is the oldest TLS version the server accepts, 1.2 or 1.3.
+// tls_cipher_suites limits the TLS 1.2 cipher suites, the ones of TLS 1.3
+// are not configurable.
+const SETTING_TLS_MIN_VERSION = "tls_min_version"
+const SETTING_TLS_CIPHER_SUITES = "tls_cipher_suites"
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var ErrFingerprintMismatch = errors.New("server certificate does not match pinned fingerprint")
+var ErrCertificateRevoked = errors.New("client certificate is revoked")
+var ErrCrlExpired = errors.New("certificate revocation list is expired, run `harpocrates ca crl`")
+
+func serverTlsConfig(settings map[string]string) (*tls.Config, error) {
+	if err := requireSettings(settings, SETTING_TLS_CERT, SETTING_TLS_KEY, SETTING_TLS_CA); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(settings[SETTING_TLS_CERT], settings[SETTING_TLS_KEY])
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s: %s", SETTING_TLS_CERT, SETTING_TLS_KEY, err)
+	}
+
+	clientCAs, err := loadCertPool(settings[SETTING_TLS_CA])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", SETTING_TLS_CA, err)
+	}
+
+	minVersion, ok := tlsVersions[settingOrDefault(settings, SETTING_TLS_MIN_VERSION, "1.2")]
+	if !ok {
+		return nil, fmt.Errorf("%s should be 1.2 or 1.3, got: %s", SETTING_TLS_MIN_VERSION, settings[SETTING_TLS_MIN_VERSION])
+	}
+
+	cipherSuites, err := parseCipherSuites(settings[SETTING_TLS_CIPHER_SUITES])
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		Rand:         rand.Reader,
+	}
+
+	if crlLocation, ok := settings[SETTING_TLS_CRL]; ok && len(crlLocation) > 0 {
+		if _, err := loadCrl(crlLocation); err != nil {
+			return nil, fmt.Errorf("%s: %s", SETTING_TLS_CRL, err)
+		}
+
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkRevocation(crlLocation, verifiedChains)
+		}
+	}
+
+	return config, nil
+}
+
+// parseCipherSuites returns the suites of a comma separated list of names,
+// nil for an empty list leaves the choice to crypto/tls. Insecure suites are
+// refused.
+func parseCipherSuites(names string) ([]uint16, error) {
+	if len(strings.TrimSpace(names)) <= 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				known[suite.Name] = suite.ID
+			}
+		}
+	}
+
+	suites := make([]uint16, 0)
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: %s is no secure TLS 1.2 cipher suite", SETTING_TLS_CIPHER_SUITES, name)
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+// clientTlsConfig verifies the server against tls_ca when one is configured
+// and always checks server_fingerprint once it is pinned. Without a CA the
+// first certificate seen is trusted and its fingerprint is written back to
+// settings, the caller is responsible for persisting it.
+func clientTlsConfig(settings map[string]string) (*tls.Config, error) {
+	if err := requireSettings(settings, SETTING_TLS_CERT, SETTING_TLS_KEY); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(settings[SETTING_TLS_CERT], settings[SETTING_TLS_KEY])
+	if err != nil {
+		return nil, fmt.Errorf("loadkeys: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caLocation, ok := settings[SETTING_TLS_CA]; ok && len(caLocation) > 0 {
+		rootCAs, err := loadCertPool(caLocation)
+		if err != nil {
+			return nil, fmt.Errorf("server ca: %s", err)
+		}
+
+		config.RootCAs = rootCAs
+		config.ServerName = settingOrDefault(settings, SETTING_TLS_SERVER_NAME, settings["server_host"])
+	} else {
+		// Chain verification is replaced by the fingerprint pin below.
+		config.InsecureSkipVerify = true
+	}
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrFingerprintMismatch
+		}
+
+		fingerprint := CertificateFingerprint(rawCerts[0])
+		pinned, ok := settings[SETTING_SERVER_FINGERPRINT]
+
+		if !ok || len(pinned) == 0 {
+			settings[SETTING_SERVER_FINGERPRINT] = fingerprint
+			return nil
+		}
+
+		if subtle.ConstantTimeCompare([]byte(pinned), []byte(fingerprint)) != 1 {
+			return ErrFingerprintMismatch
+		}
+
+		return nil
+	}
+
+	return config, nil
+}
+
+func checkRevocation(crlLocation string, verifiedChains [][]*x509.Certificate) error {
+	crl, err := loadCrl(crlLocation)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(crl.NextUpdate) {
+		return ErrCrlExpired
+	}
+
+	for _, chain := range verifiedChains {
+		// A certificate that is itself a trust anchor can not be revoked.
+		if len(chain) < 2 {
+			continue
+		}
+
+		if err := crl.CheckSignatureFrom(chain[1]); err != nil {
+			return fmt.Errorf("crl: %s", err)
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(chain[0].SerialNumber) == 0 {
+				return ErrCertificateRevoked
+			}
+		}
+	}
+
+	return nil
+}
+
+func loadCrl(location string) (*x509.RevocationList, error) {
+	bytes, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca.ParseCrl(bytes)
+}
+
+// CertificateFingerprint is the hex encoded SHA-256 of a DER certificate.
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func loadCertPool(location string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", location)
+	}
+
+	return pool, nil
+}
+
+// requireSettings refuses to fall back to any certificate, every install
+// uses its own, see `harpocrates ca`.
+func requireSettings(settings map[string]string, keys ...string) error {
+	missing := make([]string, 0)
+
+	for _, key := range keys {
+		if len(settings[key]) <= 0 {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%s required, create the certificates with `harpocrates ca`", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func settingOrDefault(settings map[string]string, key, defaultValue string) string {
+	if value, ok := settings[key]; ok && len(value) > 0 {
+		return value
+	}
+
+	return defaultValue
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/vmihailenco/msgpack"
+)
+
+// SETTING_SESSION_TTL is the server setting holding how long a session token
+// is valid, SETTING_SESSION_FILE the client setting holding where the token
+// is kept between commands.
+const SETTING_SESSION_TTL = "session_ttl"
+const SETTING_SESSION_FILE = "session_file"
+
+const DEFAULT_SESSION_TTL = 15 * time.Minute
+const DEFAULT_SESSION_FILE_NAME = "harpocrates_session"
+
+var errTokenInvalid = errors.New("session token is invalid")
+var errTokenExpired = errors.New("session token is expired")
+var errTokenRevoked = errors.New("session token was logged out")
+
+// sessionToken lets a client resume its login on new connections. It is
+// bound to the fingerprint of the client certificate it was issued to.
+type sessionToken struct {
+	Id          []byte
+	Username    string
+	Certificate string
+	ExpiresAt   time.Time
+}
+
+// tokenIssuer signs the session tokens with a key which only lives as long
+// as the server process, a restart logs every client out.
+type tokenIssuer struct {
+	key     []byte
+	ttl     time.Duration
+	mutex   sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newTokenIssuer(ttl time.Duration) (*tokenIssuer, error) {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &tokenIssuer{
+		key:     key,
+		ttl:     ttl,
+		revoked: make(map[string]time.Time),
+	}, nil
+}
+
+func (i *tokenIssuer) issue(username, certificate string) (string, *sessionToken, error) {
+	id := make([]byte, 16)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	token := &sessionToken{
+		Id:          id,
+		Username:    username,
+		Certificate: certificate,
+		ExpiresAt:   time.Now().Add(i.ttl).Truncate(time.Second),
+	}
+
+	payload, err := msgpack.Marshal(token)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoding := base64.RawURLEncoding
+
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(i.sign(payload)), token, nil
+}
+
+func (i *tokenIssuer) verify(s, certificate string) (*sessionToken, error) {
+	parts := strings.Split(s, ".")
+
+	if len(parts) != 2 {
+		return nil, errTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil || !hmac.Equal(signature, i.sign(payload)) {
+		return nil, errTokenInvalid
+	}
+
+	token := new(sessionToken)
+
+	if err := msgpack.Unmarshal(payload, token); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	if token.Certificate != certificate {
+		return nil, errTokenInvalid
+	}
+
+	if !token.ExpiresAt.After(time.Now()) {
+		return nil, errTokenExpired
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if _, ok := i.revoked[hex.EncodeToString(token.Id)]; ok {
+		return nil, errTokenRevoked
+	}
+
+	return token, nil
+}
+
+// revoke keeps the token refused until it expires anyway.
+func (i *tokenIssuer) revoke(token *sessionToken) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	now := time.Now()
+
+	for id, expiresAt := range i.revoked {
+		if !expiresAt.After(now) {
+			delete(i.revoked, id)
+		}
+	}
+
+	i.revoked[hex.EncodeToString(token.Id)] = token.ExpiresAt
+}
+
+func (i *tokenIssuer) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, i.key)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// savedSession is a session token as the client keeps it.
+type savedSession struct {
+	Server    string    `json:"server"`
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// stale tells whether less than half of the lifetime of the token is left.
+func (s *savedSession) stale() bool {
+	return time.Until(s.ExpiresAt) < s.ExpiresAt.Sub(s.IssuedAt)/2
+}
+
+func sessionLocation(settings map[string]string) string {
+	if location, ok := settings[SETTING_SESSION_FILE]; ok && len(location) > 0 {
+		return location
+	}
+
+	homeDir, _ := os.UserHomeDir()
+
+	return filepath.Join(homeDir, DEFAULT_SESSION_FILE_NAME)
+}
+
+// loadSession returns the saved token of the server and user of settings
+// unless it expired.
+func loadSession(settings map[string]string) *savedSession {
+	b, err := ioutil.ReadFile(sessionLocation(settings))
+
+	if err != nil {
+		return nil
+	}
+
+	saved := new(savedSession)
+
+	if err := json.Unmarshal(b, saved); err != nil {
+		return nil
+	}
+
+	if saved.Server != serverAddress(settings) || saved.Username != usernameOrDefault(settings[SETTING_USERNAME]) || !saved.ExpiresAt.After(time.Now()) {
+		return nil
+	}
+
+	return saved
+}
+
+func saveSession(settings map[string]string, token string, expiresAt time.Time) error {
+	b, err := json.Marshal(&savedSession{
+		Server:    serverAddress(settings),
+		Username:  usernameOrDefault(settings[SETTING_USERNAME]),
+		Token:     token,
+		IssuedAt:  time.Now(),
+		ExpiresAt: expiresAt,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return service.WriteFileAtomic(sessionLocation(settings), b)
+}
+
+func deleteSession(settings map[string]string) error {
+	err := os.Remove(sessionLocation(settings))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltMetaBucket = []byte("meta")
+var boltEntriesBucket = []byte("entries")
+
+type boltDatabase struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// NewBoltStorage keeps the passwords in a bbolt file. The file is opened for
+// every operation only, bbolt locks it while it is open.
+func NewBoltStorage(passwordLocation, settingsLocation, mode string) Storage {
+	if len(passwordLocation) <= 0 {
+		passwordLocation = homeLocation(DEFAULT_BOLT_DATABASE_NAME)
+	}
+
+	s := newFileStorage(passwordLocation, settingsLocation, mode)
+
+	return &recordStorage{
+		storage: s,
+		open: func() (recordDatabase, error) {
+			db, err := bolt.Open(s.passwordLocation, 0600, &bolt.Options{Timeout: LOCK_TIMEOUT})
+
+			if err == bolt.ErrTimeout {
+				return nil, ErrVaultBusy
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &boltDatabase{db: db}, nil
+		},
+	}
+}
+
+func (d *boltDatabase) View(fn func(tx recordTx) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (d *boltDatabase) Update(fn func(tx recordTx) error) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMetaBucket, boltEntriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (d *boltDatabase) Close() error {
+	return d.db.Close()
+}
+
+func (t *boltTx) Meta(key string) ([]byte, error) {
+	bucket := t.tx.Bucket(boltMetaBucket)
+
+	if bucket == nil {
+		return nil, nil
+	}
+
+	return copyBytes(bucket.Get([]byte(key))), nil
+}
+
+func (t *boltTx) SetMeta(key string, value []byte) error {
+	return t.tx.Bucket(boltMetaBucket).Put([]byte(key), value)
+}
+
+func (t *boltTx) Records() (map[string][]byte, error) {
+	records := make(map[string][]byte)
+
+	bucket := t.tx.Bucket(boltEntriesBucket)
+
+	if bucket == nil {
+		return records, nil
+	}
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		records[string(k)] = copyBytes(v)
+		return nil
+	})
+
+	return records, err
+}
+
+func (t *boltTx) PutRecord(id string, data []byte) error {
+	return t.tx.Bucket(boltEntriesBucket).Put([]byte(id), data)
+}
+
+func (t *boltTx) DeleteRecord(id string) error {
+	return t.tx.Bucket(boltEntriesBucket).Delete([]byte(id))
+}
+
+// copyBytes copies values out of bbolt, they are only valid during the
+// transaction.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
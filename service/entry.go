@@ -0,0 +1,65 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ENTRY_SCHEMA_VERSION is stored in every entry. Entries written before it
+// existed decode with version 0 and are upgraded when the database is read.
+const ENTRY_SCHEMA_VERSION = 1
+
+const ENTRY_TYPE_LOGIN = "login"
+const ENTRY_TYPE_NOTE = "note"
+const ENTRY_TYPE_CARD = "card"
+const ENTRY_TYPE_SSH_KEY = "ssh-key"
+
+var ENTRY_TYPES = []string{ENTRY_TYPE_LOGIN, ENTRY_TYPE_NOTE, ENTRY_TYPE_CARD, ENTRY_TYPE_SSH_KEY}
+
+// CustomField is an arbitrary key/value pair of an entry, secret values are
+// kept in EncryptedValue instead of Value.
+type CustomField struct {
+	Name           string
+	Value          string
+	EncryptedValue []byte
+	Secret         bool
+}
+
+type CustomFieldRepresentation struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+func ValidateEntryType(entryType string) error {
+	for _, val := range ENTRY_TYPES {
+		if val == entryType {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Entry type `%s` is not one of %s", entryType, strings.Join(ENTRY_TYPES, ", "))
+}
+
+// ParseCustomField parses a `name=value` pair given on the command line.
+func ParseCustomField(field string, secret bool) (CustomFieldRepresentation, error) {
+	parts := strings.SplitN(field, "=", 2)
+
+	if len(parts) != 2 || len(parts[0]) <= 0 {
+		return CustomFieldRepresentation{}, fmt.Errorf("Custom field `%s` should be in name=value format", field)
+	}
+
+	return CustomFieldRepresentation{
+		Name:   parts[0],
+		Value:  parts[1],
+		Secret: secret,
+	}, nil
+}
+
+func upgradeEntry(password *Password) {
+	if password.SchemaVersion < 1 {
+		password.Type = ENTRY_TYPE_LOGIN
+	}
+
+	password.SchemaVersion = ENTRY_SCHEMA_VERSION
+}
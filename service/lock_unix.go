@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile takes an exclusive advisory lock. The lock is held on a separate
+// file because the database itself is replaced by rename on every write.
+func lockFile(location string) (*os.File, error) {
+	file, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(LOCK_TIMEOUT)
+
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+
+		if err == nil {
+			return file, nil
+		}
+
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			file.Close()
+
+			if err == syscall.EWOULDBLOCK {
+				return nil, ErrVaultBusy
+			}
+
+			return nil, err
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func unlockFile(file *os.File) error {
+	defer file.Close()
+
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile creates the lock file exclusively, there is no flock on Windows.
+// A lock file left behind by a crash has to be removed by hand.
+func lockFile(location string) (*os.File, error) {
+	deadline := time.Now().Add(LOCK_TIMEOUT)
+
+	for {
+		file, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+
+		if err == nil {
+			return file, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrVaultBusy
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func unlockFile(file *os.File) error {
+	file.Close()
+
+	return os.Remove(file.Name())
+}
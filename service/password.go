@@ -1,23 +1,96 @@
 package service
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blueskan/harpocrates/core"
+	"github.com/vmihailenco/msgpack"
 )
 
+const DEFAULT_HISTORY_SIZE = 10
+
 type Password struct {
+	SchemaVersion     int
+	Type              string
 	Url               string
+	Username          string
+	EncryptedPassword []byte
+	EncryptedNotes    []byte
+	Tags              []string
+	Fields            []CustomField
+	CreatedAt         time.Time
+	ModifiedAt        time.Time
+	AccessedAt        time.Time
+	History           []PasswordVersion
+	// Revision is the server revision the entry was last synced at, 0 when
+	// it was never synced. Dirty entries changed since, Deleted entries are
+	// kept as tombstones until their deletion is synced.
+	Revision uint64
+	Dirty    bool
+	Deleted  bool
+}
+
+// PasswordVersion is a previous value of a password, newest first in
+// Password.History.
+type PasswordVersion struct {
 	EncryptedPassword []byte
+	ReplacedAt        time.Time
 }
 
 type PasswordRepresentation struct {
-	Name     string
-	Url      string
-	Password string
+	Name       string                      `json:"name"`
+	Type       string                      `json:"type,omitempty"`
+	Url        string                      `json:"url"`
+	Username   string                      `json:"username,omitempty"`
+	Password   string                      `json:"password,omitempty"`
+	Notes      string                      `json:"notes,omitempty"`
+	Tags       []string                    `json:"tags,omitempty"`
+	Fields     []CustomFieldRepresentation `json:"fields,omitempty"`
+	CreatedAt  *time.Time                  `json:"created_at,omitempty"`
+	ModifiedAt *time.Time                  `json:"modified_at,omitempty"`
+	AccessedAt *time.Time                  `json:"accessed_at,omitempty"`
+}
+
+// PasswordUpdate holds the fields to change, nil fields are kept as they are.
+// Fields are merged by name, RemoveFields drops custom fields by name.
+type PasswordUpdate struct {
+	Type         *string
+	Url          *string
+	Username     *string
+	Password     *string
+	Notes        *string
+	Tags         *[]string
+	Fields       []CustomFieldRepresentation
+	RemoveFields []string
+}
+
+func (u PasswordUpdate) IsEmpty() bool {
+	return u.Type == nil && u.Url == nil && u.Username == nil && u.Password == nil && u.Notes == nil &&
+		u.Tags == nil && len(u.Fields) <= 0 && len(u.RemoveFields) <= 0
+}
+
+type PasswordVersionRepresentation struct {
+	Version    int       `json:"version"`
+	ReplacedAt time.Time `json:"replaced_at"`
+	Password   string    `json:"password,omitempty"`
+}
+
+type PasswordNotFoundError struct {
+	Name string
+}
+
+func (e *PasswordNotFoundError) Error() string {
+	return fmt.Sprintf("Password named as `%s` not exists", e.Name)
 }
 
 type PasswordService struct {
@@ -26,6 +99,7 @@ type PasswordService struct {
 	publicKey      *rsa.PublicKey
 	passwords      map[string]Password
 	storageService Storage
+	historySize    int
 }
 
 func NewPasswordService(
@@ -33,8 +107,21 @@ func NewPasswordService(
 	privateKey *rsa.PrivateKey,
 	publicKey *rsa.PublicKey,
 	storageService Storage,
-) *PasswordService {
-	passwords := storageService.ReadPasswords()
+) (*PasswordService, error) {
+	storageService.SetVaultCipher(NewVaultCipher(cryptoManager, privateKey, publicKey))
+
+	passwords, err := storageService.ReadPasswords()
+
+	if err != nil {
+		return nil, err
+	}
+
+	passwords = livePasswords(passwords)
+
+	historySize, err := strconv.Atoi(storageService.ReadSettings()["history_size"])
+	if err != nil || historySize < 0 {
+		historySize = DEFAULT_HISTORY_SIZE
+	}
 
 	return &PasswordService{
 		cryptoManager:  cryptoManager,
@@ -42,7 +129,8 @@ func NewPasswordService(
 		publicKey:      publicKey,
 		passwords:      passwords,
 		storageService: storageService,
-	}
+		historySize:    historySize,
+	}, nil
 }
 
 func (p *PasswordService) ListPasswords() []*PasswordRepresentation {
@@ -50,58 +138,540 @@ func (p *PasswordService) ListPasswords() []*PasswordRepresentation {
 
 	for key, val := range p.passwords {
 		passwords = append(passwords, &PasswordRepresentation{
-			Name: key,
-			Url:  val.Url,
+			Name:       key,
+			Type:       val.Type,
+			Url:        val.Url,
+			Username:   val.Username,
+			Tags:       val.Tags,
+			CreatedAt:  timestamp(val.CreatedAt),
+			ModifiedAt: timestamp(val.ModifiedAt),
+			AccessedAt: timestamp(val.AccessedAt),
 		})
 	}
 
+	sort.Slice(passwords, func(i, j int) bool {
+		return passwords[i].Name < passwords[j].Name
+	})
+
 	return passwords
 }
 
+// GetPassword decrypts an entry and records the access time. Recording it
+// is best effort, a database that can not be written is still readable.
 func (p *PasswordService) GetPassword(name string) (*PasswordRepresentation, error) {
-	if val, ok := p.passwords[name]; ok {
-		password := p.cryptoManager.DecryptWithPrivateKey(val.EncryptedPassword, p.privateKey)
+	val, ok := p.passwords[name]
 
-		return &PasswordRepresentation{
-			Name:     name,
-			Url:      val.Url,
-			Password: string(password),
-		}, nil
+	if !ok {
+		return nil, &PasswordNotFoundError{Name: name}
+	}
+
+	representation, err := p.decrypt(name, val)
+
+	if err != nil {
+		return nil, err
+	}
+
+	accessedAt := time.Now()
+
+	err = p.change(func(passwords map[string]Password) error {
+		if val, ok := passwords[name]; ok {
+			val.AccessedAt = accessedAt
+			passwords[name] = val
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		representation.AccessedAt = timestamp(accessedAt)
 	}
 
-	return nil, fmt.Errorf("Key `%s` not found", name)
+	return representation, nil
 }
 
-func (p *PasswordService) DeletePassword(name string) error {
-	if _, ok := p.passwords[name]; !ok {
-		return fmt.Errorf("Password named as `%s` not exists", name)
+func (p *PasswordService) decrypt(name string, val Password) (*PasswordRepresentation, error) {
+	password, err := p.open(val.EncryptedPassword)
+
+	if err != nil {
+		return nil, err
+	}
+
+	notes, err := p.open(val.EncryptedNotes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]CustomFieldRepresentation, 0, len(val.Fields))
+
+	for _, field := range val.Fields {
+		value := field.Value
+
+		if field.Secret {
+			value, err = p.open(field.EncryptedValue)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		fields = append(fields, CustomFieldRepresentation{
+			Name:   field.Name,
+			Value:  value,
+			Secret: field.Secret,
+		})
 	}
 
-	delete(p.passwords, name)
+	return &PasswordRepresentation{
+		Name:       name,
+		Type:       val.Type,
+		Url:        val.Url,
+		Username:   val.Username,
+		Password:   password,
+		Notes:      notes,
+		Tags:       val.Tags,
+		Fields:     fields,
+		CreatedAt:  timestamp(val.CreatedAt),
+		ModifiedAt: timestamp(val.ModifiedAt),
+		AccessedAt: timestamp(val.AccessedAt),
+	}, nil
+}
+
+func (p *PasswordService) DeletePassword(name string) error {
+	return p.change(func(passwords map[string]Password) error {
+		if _, ok := passwords[name]; !ok {
+			return &PasswordNotFoundError{Name: name}
+		}
 
-	p.storageService.StorePasswords(p.passwords)
+		delete(passwords, name)
+
+		return nil
+	})
+}
+
+// change applies a change to the newest passwords on disk, so changes other
+// clients made since this one read the database are kept. The change only
+// sees live entries, changed entries are marked for the next sync.
+func (p *PasswordService) change(apply func(passwords map[string]Password) error) error {
+	passwords, err := p.storageService.UpdatePasswords(func(stored map[string]Password) error {
+		live := livePasswords(stored)
+
+		if err := apply(live); err != nil {
+			return err
+		}
+
+		trackChanges(stored, live)
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	p.passwords = livePasswords(passwords)
 
 	return nil
 }
 
-func (p *PasswordService) ExportToCsv(filename string) {
-	file, _ := os.Create(filename)
+// livePasswords returns the entries without tombstones, upgraded to the
+// current schema.
+func livePasswords(stored map[string]Password) map[string]Password {
+	live := make(map[string]Password, len(stored))
+
+	for name, password := range stored {
+		if password.Deleted {
+			continue
+		}
+
+		if password.SchemaVersion < ENTRY_SCHEMA_VERSION {
+			upgradeEntry(&password)
+		}
+
+		live[name] = password
+	}
+
+	return live
+}
+
+// trackChanges writes the live entries back to stored. New and changed
+// entries become dirty, removed entries that were synced become tombstones.
+func trackChanges(stored map[string]Password, live map[string]Password) {
+	for name, password := range live {
+		previous, ok := stored[name]
+
+		if ok && !previous.Deleted && !changedForSync(previous, password) {
+			stored[name] = password
+			continue
+		}
+
+		// A renamed entry is new under its new name, a recreated one is
+		// based on its tombstone.
+		password.Revision = 0
+
+		if ok {
+			password.Revision = previous.Revision
+		}
+
+		password.Dirty = true
+		password.Deleted = false
+		stored[name] = password
+	}
+
+	for name, password := range stored {
+		if _, ok := live[name]; ok || password.Deleted {
+			continue
+		}
+
+		if password.Revision <= 0 {
+			delete(stored, name)
+			continue
+		}
+
+		stored[name] = Password{
+			ModifiedAt: time.Now(),
+			Revision:   password.Revision,
+			Dirty:      true,
+			Deleted:    true,
+		}
+	}
+}
+
+// changedForSync ignores the access time, reading an entry is not a change
+// other devices need.
+func changedForSync(previous, current Password) bool {
+	previous.AccessedAt, current.AccessedAt = time.Time{}, time.Time{}
+	previous.Dirty, current.Dirty = false, false
+
+	a, errA := msgpack.Marshal(&previous)
+	b, errB := msgpack.Marshal(&current)
+
+	return errA != nil || errB != nil || !bytes.Equal(a, b)
+}
+
+// UpdatePassword changes the given fields of an existing entry. The secret
+// is only encrypted again when it changes.
+func (p *PasswordService) UpdatePassword(name string, update PasswordUpdate) (*PasswordRepresentation, error) {
+	var password Password
+
+	err := p.change(func(passwords map[string]Password) error {
+		var ok bool
+		password, ok = passwords[name]
+
+		if !ok {
+			return &PasswordNotFoundError{Name: name}
+		}
+
+		if update.Type != nil {
+			if err := ValidateEntryType(*update.Type); err != nil {
+				return err
+			}
+
+			password.Type = *update.Type
+		}
+
+		if update.Url != nil {
+			password.Url = *update.Url
+		}
+
+		if update.Username != nil {
+			password.Username = *update.Username
+		}
+
+		if update.Notes != nil {
+			encryptedNotes, err := p.seal(*update.Notes)
+
+			if err != nil {
+				return err
+			}
+
+			password.EncryptedNotes = encryptedNotes
+		}
+
+		if update.Tags != nil {
+			password.Tags = *update.Tags
+		}
+
+		fields := make([]CustomField, 0, len(password.Fields))
+
+		for _, field := range password.Fields {
+			if !containsString(update.RemoveFields, field.Name) {
+				fields = append(fields, field)
+			}
+		}
+
+		for _, representation := range update.Fields {
+			field, err := p.sealField(representation)
+
+			if err != nil {
+				return err
+			}
+
+			fields = setField(fields, field)
+		}
+
+		password.Fields = fields
+
+		if update.Password != nil {
+			if len(*update.Password) <= 0 && password.Type == ENTRY_TYPE_LOGIN {
+				return fmt.Errorf("Password of `%s` can not be empty", name)
+			}
+
+			encryptedPassword, err := p.seal(*update.Password)
+
+			if err != nil {
+				return err
+			}
+
+			p.pushHistory(&password)
+			password.EncryptedPassword = encryptedPassword
+		}
+
+		password.ModifiedAt = time.Now()
+
+		passwords[name] = password
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordRepresentation{
+		Name:       name,
+		Type:       password.Type,
+		Url:        password.Url,
+		Username:   password.Username,
+		Tags:       password.Tags,
+		CreatedAt:  timestamp(password.CreatedAt),
+		ModifiedAt: timestamp(password.ModifiedAt),
+	}, nil
+}
+
+// PasswordHistory returns the previous values of a password, version 1 is
+// the value it had before the last change.
+func (p *PasswordService) PasswordHistory(name string) ([]*PasswordVersionRepresentation, error) {
+	password, ok := p.passwords[name]
+
+	if !ok {
+		return nil, &PasswordNotFoundError{Name: name}
+	}
+
+	versions := make([]*PasswordVersionRepresentation, 0)
+
+	for i, version := range password.History {
+		decrypted, err := p.cryptoManager.OpenEnvelope(version.EncryptedPassword, p.privateKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, &PasswordVersionRepresentation{
+			Version:    i + 1,
+			ReplacedAt: version.ReplacedAt,
+			Password:   string(decrypted),
+		})
+	}
+
+	return versions, nil
+}
+
+// RestorePassword makes a previous version current again, the current value
+// moves to the history so the restore can be undone.
+func (p *PasswordService) RestorePassword(name string, version int) error {
+	return p.change(func(passwords map[string]Password) error {
+		password, ok := passwords[name]
+
+		if !ok {
+			return &PasswordNotFoundError{Name: name}
+		}
+
+		if version < 1 || version > len(password.History) {
+			return fmt.Errorf("Password named as `%s` has no version %d", name, version)
+		}
+
+		restored := password.History[version-1]
+		password.History = append(password.History[:version-1:version-1], password.History[version:]...)
+
+		p.pushHistory(&password)
+		password.EncryptedPassword = restored.EncryptedPassword
+		password.ModifiedAt = time.Now()
+
+		passwords[name] = password
+
+		return nil
+	})
+}
+
+func (p *PasswordService) pushHistory(password *Password) {
+	history := append([]PasswordVersion{{
+		EncryptedPassword: password.EncryptedPassword,
+		ReplacedAt:        time.Now(),
+	}}, password.History...)
+
+	if len(history) > p.historySize {
+		history = history[:p.historySize]
+	}
+
+	password.History = history
+}
+
+func (p *PasswordService) RenamePassword(name, newName string) error {
+	if len(newName) <= 0 {
+		return fmt.Errorf("New name of `%s` can not be empty", name)
+	}
+
+	return p.change(func(passwords map[string]Password) error {
+		password, ok := passwords[name]
+
+		if !ok {
+			return &PasswordNotFoundError{Name: name}
+		}
+
+		if _, ok := passwords[newName]; ok {
+			return fmt.Errorf("Key `%s` already exists in your password database, please prefer other name.", newName)
+		}
+
+		delete(passwords, name)
+		passwords[newName] = password
+
+		return nil
+	})
+}
+
+func (p *PasswordService) ExportToCsv(filename string) error {
+	file, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
 	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	return p.ExportCsv(file)
+}
+
+// CSV_HEADER is the first row written by ExportCsv. Custom fields are
+// written as a JSON array in a single column.
+var CSV_HEADER = []string{"Name", "Type", "Username", "URL", "Password", "Notes", "Tags", "Fields", "Created", "Modified", "Accessed"}
+
+func (p *PasswordService) ExportCsv(w io.Writer) error {
+	writer := csv.NewWriter(w)
+
+	var data = [][]string{CSV_HEADER}
+
+	for key, val := range p.passwords {
+		password, err := p.decrypt(key, val)
 
-	var data = [][]string{{"Name", "URL", "Password"}}
+		if err != nil {
+			return fmt.Errorf("Password named as `%s` could not be exported: %s", key, err)
+		}
 
-	for key, _ := range p.passwords {
-		password, _ := p.GetPassword(key)
+		fields, err := json.Marshal(password.Fields)
 
-		data = append(data, []string{key, password.Url, password.Password})
+		if err != nil {
+			return err
+		}
+
+		data = append(data, []string{
+			key,
+			password.Type,
+			password.Username,
+			password.Url,
+			password.Password,
+			password.Notes,
+			strings.Join(password.Tags, ","),
+			string(fields),
+			formatTimestamp(password.CreatedAt),
+			formatTimestamp(password.ModifiedAt),
+			formatTimestamp(password.AccessedAt),
+		})
 	}
 
-	for _, value := range data {
-		writer.Write(value)
+	return writer.WriteAll(data)
+}
+
+// ImportCsv stores every row of a CSV in the format written by ExportCsv, or
+// the Name, URL, Password format of older versions, and returns the names it
+// skipped because they already exist.
+func (p *PasswordService) ImportCsv(r io.Reader) (int, []string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+
+	if err != nil {
+		return 0, nil, err
 	}
+
+	imported := 0
+	skipped := make([]string, 0)
+
+	for i, row := range rows {
+		if i == 0 && len(row) > 0 && row[0] == "Name" {
+			continue
+		}
+
+		representation, err := parseCsvRow(row)
+
+		if err != nil {
+			return imported, skipped, fmt.Errorf("Row %d: %s", i+1, err)
+		}
+
+		if _, ok := p.passwords[representation.Name]; ok {
+			skipped = append(skipped, representation.Name)
+			continue
+		}
+
+		_, err = p.StorePassword(*representation)
+
+		if err != nil {
+			return imported, skipped, err
+		}
+
+		imported++
+	}
+
+	return imported, skipped, nil
+}
+
+func parseCsvRow(row []string) (*PasswordRepresentation, error) {
+	if len(row) == 3 {
+		return &PasswordRepresentation{
+			Name:     row[0],
+			Url:      row[1],
+			Password: row[2],
+		}, nil
+	}
+
+	if len(row) != len(CSV_HEADER) {
+		return nil, fmt.Errorf("should have %s columns", strings.Join(CSV_HEADER, ", "))
+	}
+
+	representation := &PasswordRepresentation{
+		Name:       row[0],
+		Type:       row[1],
+		Username:   row[2],
+		Url:        row[3],
+		Password:   row[4],
+		Notes:      row[5],
+		CreatedAt:  parseTimestamp(row[8]),
+		ModifiedAt: parseTimestamp(row[9]),
+		AccessedAt: parseTimestamp(row[10]),
+	}
+
+	if len(row[6]) > 0 {
+		representation.Tags = strings.Split(row[6], ",")
+	}
+
+	if len(row[7]) > 0 {
+		if err := json.Unmarshal([]byte(row[7]), &representation.Fields); err != nil {
+			return nil, fmt.Errorf("custom fields of `%s` are not valid JSON", row[0])
+		}
+	}
+
+	return representation, nil
 }
 
 func (p *PasswordService) StorePassword(representation PasswordRepresentation) (*PasswordRepresentation, error) {
@@ -109,13 +679,178 @@ func (p *PasswordService) StorePassword(representation PasswordRepresentation) (
 		return nil, fmt.Errorf("Key `%s` already exists in your password database, please prefer other name or get password from this key.", representation.Name)
 	}
 
-	encryptedPassword := p.cryptoManager.EncryptWithPublicKey([]byte(representation.Password), p.publicKey)
-	p.passwords[representation.Name] = Password{
+	if len(representation.Type) <= 0 {
+		representation.Type = ENTRY_TYPE_LOGIN
+	}
+
+	if err := ValidateEntryType(representation.Type); err != nil {
+		return nil, err
+	}
+
+	encryptedPassword, err := p.seal(representation.Password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedNotes, err := p.seal(representation.Notes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]CustomField, 0, len(representation.Fields))
+
+	for _, val := range representation.Fields {
+		field, err := p.sealField(val)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fields = setField(fields, field)
+	}
+
+	now := time.Now()
+
+	password := Password{
+		SchemaVersion:     ENTRY_SCHEMA_VERSION,
+		Type:              representation.Type,
 		Url:               representation.Url,
+		Username:          representation.Username,
 		EncryptedPassword: encryptedPassword,
+		EncryptedNotes:    encryptedNotes,
+		Tags:              representation.Tags,
+		Fields:            fields,
+		CreatedAt:         now,
+		ModifiedAt:        now,
+	}
+
+	if representation.CreatedAt != nil {
+		password.CreatedAt = *representation.CreatedAt
+	}
+
+	if representation.ModifiedAt != nil {
+		password.ModifiedAt = *representation.ModifiedAt
+	}
+
+	if representation.AccessedAt != nil {
+		password.AccessedAt = *representation.AccessedAt
+	}
+
+	err = p.change(func(passwords map[string]Password) error {
+		if _, ok := passwords[representation.Name]; ok {
+			return fmt.Errorf("Key `%s` already exists in your password database, please prefer other name or get password from this key.", representation.Name)
+		}
+
+		passwords[representation.Name] = password
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordRepresentation{
+		Name:       representation.Name,
+		Type:       password.Type,
+		Url:        password.Url,
+		Username:   password.Username,
+		Tags:       password.Tags,
+		CreatedAt:  timestamp(password.CreatedAt),
+		ModifiedAt: timestamp(password.ModifiedAt),
+	}, nil
+}
+
+// seal encrypts a secret, empty secrets are stored as nil.
+func (p *PasswordService) seal(value string) ([]byte, error) {
+	if len(value) <= 0 {
+		return nil, nil
+	}
+
+	return p.cryptoManager.SealEnvelope([]byte(value), p.publicKey)
+}
+
+func (p *PasswordService) open(ciphertext []byte) (string, error) {
+	if len(ciphertext) <= 0 {
+		return "", nil
+	}
+
+	plaintext, err := p.cryptoManager.OpenEnvelope(ciphertext, p.privateKey)
+
+	if err != nil {
+		return "", err
 	}
 
-	p.storageService.StorePasswords(p.passwords)
+	return string(plaintext), nil
+}
+
+func (p *PasswordService) sealField(representation CustomFieldRepresentation) (CustomField, error) {
+	field := CustomField{
+		Name:   representation.Name,
+		Secret: representation.Secret,
+	}
+
+	if !representation.Secret {
+		field.Value = representation.Value
+		return field, nil
+	}
+
+	encryptedValue, err := p.seal(representation.Value)
+
+	if err != nil {
+		return field, err
+	}
+
+	field.EncryptedValue = encryptedValue
+
+	return field, nil
+}
+
+func setField(fields []CustomField, field CustomField) []CustomField {
+	for i, val := range fields {
+		if val.Name == field.Name {
+			fields[i] = field
+			return fields
+		}
+	}
+
+	return append(fields, field)
+}
+
+func containsString(list []string, value string) bool {
+	for _, val := range list {
+		if val == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func timestamp(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func formatTimestamp(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func parseTimestamp(value string) *time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return nil
+	}
 
-	return &representation, nil
+	return &t
 }
@@ -0,0 +1,317 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blueskan/harpocrates/core"
+)
+
+func newTestPasswordService(t *testing.T, dir string) *PasswordService {
+	cryptoManager := core.NewCryptoManager(2048)
+
+	pri, pub, err := cryptoManager.CreatePubPriKey()
+
+	if err != nil {
+		t.Fatalf("Crypto Manager could not create keys: %s", err)
+	}
+
+	settings := filepath.Join(dir, DEFAULT_SETTINGS_NAME)
+
+	if err := ioutil.WriteFile(settings, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordService, err := NewPasswordService(cryptoManager, pri, pub, NewStorage(filepath.Join(dir, DEFAULT_DATABASE_NAME), settings, "client"))
+
+	if err != nil {
+		t.Fatalf("Password Service could not be created: %s", err)
+	}
+
+	return passwordService
+}
+
+func Test_it_should_update_url_without_encrypting_password_again(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	sut := newTestPasswordService(t, dir)
+
+	sut.StorePassword(PasswordRepresentation{Name: "mail", Url: "mail.example.com", Username: "alice", Password: "first-secret"})
+
+	encryptedPassword := sut.passwords["mail"].EncryptedPassword
+	url := "webmail.example.com"
+
+	if _, err := sut.UpdatePassword("mail", PasswordUpdate{Url: &url}); err != nil {
+		t.Fatalf("Password could not be updated: %s", err)
+	}
+
+	if string(sut.passwords["mail"].EncryptedPassword) != string(encryptedPassword) || len(sut.passwords["mail"].History) != 0 {
+		t.Errorf("Password was encrypted again on url change")
+	}
+
+	secret := "second-secret"
+
+	if _, err := sut.UpdatePassword("mail", PasswordUpdate{Password: &secret}); err != nil {
+		t.Fatalf("Password could not be updated: %s", err)
+	}
+
+	password, _ := sut.GetPassword("mail")
+
+	if password.Password != secret || password.Url != url || password.Username != "alice" {
+		t.Errorf("Updated password was incorrect, got: %v, want: %s, %s, %s", password, secret, url, "alice")
+	}
+
+	if _, err := sut.UpdatePassword("missing", PasswordUpdate{Url: &url}); err == nil {
+		t.Errorf("Missing password was updated")
+	}
+}
+
+func Test_it_should_not_rename_password_to_existing_name(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	sut := newTestPasswordService(t, dir)
+
+	sut.StorePassword(PasswordRepresentation{Name: "mail", Url: "mail.example.com", Password: "mail-secret"})
+	sut.StorePassword(PasswordRepresentation{Name: "bank", Url: "bank.example.com", Password: "bank-secret"})
+
+	if err := sut.RenamePassword("mail", "bank"); err == nil {
+		t.Errorf("Password was renamed to existing name")
+	}
+
+	if err := sut.RenamePassword("mail", ""); err == nil {
+		t.Errorf("Password was renamed to empty name")
+	}
+
+	if err := sut.RenamePassword("missing", "other"); err == nil {
+		t.Errorf("Missing password was renamed")
+	}
+
+	if err := sut.RenamePassword("mail", "webmail"); err != nil {
+		t.Fatalf("Password could not be renamed: %s", err)
+	}
+
+	password, err := sut.GetPassword("webmail")
+
+	if err != nil || password.Password != "mail-secret" || password.Url != "mail.example.com" {
+		t.Errorf("Renamed password was incorrect, got: %v, %v, want: %s", password, err, "mail-secret")
+	}
+
+	if _, err := sut.GetPassword("mail"); err == nil {
+		t.Errorf("Password was kept under its old name")
+	}
+
+	bank, _ := sut.GetPassword("bank")
+
+	if bank.Password != "bank-secret" {
+		t.Errorf("Other password was incorrect, got: %s, want: %s", bank.Password, "bank-secret")
+	}
+}
+
+func Test_it_should_keep_encrypted_history_and_restore_it(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	sut := newTestPasswordService(t, dir)
+	sut.historySize = 2
+
+	sut.StorePassword(PasswordRepresentation{Name: "mail", Password: "secret-1"})
+
+	for _, secret := range []string{"secret-2", "secret-3", "secret-4"} {
+		secret := secret
+
+		if _, err := sut.UpdatePassword("mail", PasswordUpdate{Password: &secret}); err != nil {
+			t.Fatalf("Password could not be updated: %s", err)
+		}
+	}
+
+	for _, version := range sut.passwords["mail"].History {
+		if strings.Contains(string(version.EncryptedPassword), "secret-") {
+			t.Errorf("History was not encrypted")
+		}
+	}
+
+	if err := sut.RenamePassword("mail", "webmail"); err != nil {
+		t.Fatalf("Password could not be renamed: %s", err)
+	}
+
+	history, err := sut.PasswordHistory("webmail")
+
+	if err != nil || len(history) != 2 || history[0].Password != "secret-3" || history[1].Password != "secret-2" {
+		t.Fatalf("History was incorrect, got: %v, %v, want: %s, %s", history, err, "secret-3", "secret-2")
+	}
+
+	if err := sut.RestorePassword("webmail", 2); err != nil {
+		t.Fatalf("Password could not be restored: %s", err)
+	}
+
+	password, _ := sut.GetPassword("webmail")
+
+	if password.Password != "secret-2" {
+		t.Errorf("Restored password was incorrect, got: %s, want: %s", password.Password, "secret-2")
+	}
+
+	history, _ = sut.PasswordHistory("webmail")
+
+	if len(history) != 2 || history[0].Password != "secret-4" || history[1].Password != "secret-3" {
+		t.Errorf("History after restore was incorrect, got: %v, want: %s, %s", history, "secret-4", "secret-3")
+	}
+
+	if err := sut.RestorePassword("webmail", 3); err == nil {
+		t.Errorf("Missing version was restored")
+	}
+}
+
+func Test_it_should_keep_metadata_of_password(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	sut := newTestPasswordService(t, dir)
+
+	_, err = sut.StorePassword(PasswordRepresentation{
+		Name:     "server",
+		Type:     ENTRY_TYPE_SSH_KEY,
+		Url:      "ssh.example.com",
+		Username: "root",
+		Password: "private-key",
+		Notes:    "rotated every year",
+		Tags:     []string{"work", "ssh"},
+		Fields: []CustomFieldRepresentation{
+			{Name: "port", Value: "2222"},
+			{Name: "passphrase", Value: "key-passphrase", Secret: true},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("Password could not be stored: %s", err)
+	}
+
+	for _, field := range sut.passwords["server"].Fields {
+		if field.Secret && (len(field.Value) > 0 || strings.Contains(string(field.EncryptedValue), "key-passphrase")) {
+			t.Errorf("Secret field was not encrypted")
+		}
+	}
+
+	// A second service reads the metadata back from the database.
+	other, err := NewPasswordService(sut.cryptoManager, sut.privateKey, sut.publicKey, sut.storageService)
+
+	if err != nil {
+		t.Fatalf("Password Service could not be created: %s", err)
+	}
+
+	password, err := other.GetPassword("server")
+
+	if err != nil {
+		t.Fatalf("Password could not be read: %s", err)
+	}
+
+	if password.Type != ENTRY_TYPE_SSH_KEY || password.Url != "ssh.example.com" || password.Username != "root" ||
+		password.Password != "private-key" || password.Notes != "rotated every year" || strings.Join(password.Tags, ",") != "work,ssh" {
+		t.Errorf("Password was incorrect, got: %v", password)
+	}
+
+	if len(password.Fields) != 2 || password.Fields[0].Value != "2222" || password.Fields[1].Value != "key-passphrase" || !password.Fields[1].Secret {
+		t.Errorf("Fields were incorrect, got: %v", password.Fields)
+	}
+
+	if password.CreatedAt == nil || password.ModifiedAt == nil || password.AccessedAt == nil {
+		t.Errorf("Timestamps were incorrect, got: %v, %v, %v", password.CreatedAt, password.ModifiedAt, password.AccessedAt)
+	}
+}
+
+func Test_it_should_not_rotate_backups_on_reading_password(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	sut := newTestPasswordService(t, dir)
+
+	sut.StorePassword(PasswordRepresentation{Name: "mail", Password: "first-secret"})
+
+	secret := "second-secret"
+	sut.UpdatePassword("mail", PasswordUpdate{Password: &secret})
+
+	before, _ := sut.storageService.ListBackups()
+
+	for i := 0; i < DEFAULT_BACKUP_COUNT+1; i++ {
+		if _, err := sut.GetPassword("mail"); err != nil {
+			t.Fatalf("Password could not be read: %s", err)
+		}
+	}
+
+	after, _ := sut.storageService.ListBackups()
+
+	if len(after) != len(before) || after[0].ModifiedAt != before[0].ModifiedAt {
+		t.Errorf("Backups were incorrect, got: %v, want: %v", after, before)
+	}
+
+	if sut.passwords["mail"].AccessedAt.IsZero() {
+		t.Errorf("Access time was not recorded")
+	}
+}
+
+func Test_it_should_not_write_names_and_urls_in_clear(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	sut := newTestPasswordService(t, dir)
+
+	sut.StorePassword(PasswordRepresentation{Name: "secret-bank", Url: "bank.example.com", Username: "alice", Password: "bank-secret", Tags: []string{"finance"}})
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, DEFAULT_DATABASE_NAME))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plain := range []string{"secret-bank", "bank.example.com", "alice", "finance"} {
+		if strings.Contains(string(b), plain) {
+			t.Errorf("Database contains `%s` in clear", plain)
+		}
+	}
+
+	other, err := NewPasswordService(sut.cryptoManager, sut.privateKey, sut.publicKey, sut.storageService)
+
+	if err != nil {
+		t.Fatalf("Password Service could not be created: %s", err)
+	}
+
+	passwords := other.ListPasswords()
+
+	if len(passwords) != 1 || passwords[0].Name != "secret-bank" || passwords[0].Url != "bank.example.com" {
+		t.Errorf("Passwords were incorrect, got: %v, want: %s", passwords, "secret-bank")
+	}
+}
@@ -0,0 +1,480 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/blueskan/harpocrates/core"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Record based backends keep every entry in its own record, so a change only
+// rewrites the records it touches. A random vault key, sealed with the
+// VaultCipher, is stored next to the records: its first half encrypts the
+// records with AES-256-GCM, its second half derives the record ids as an
+// HMAC of the entry name, so names stay hidden like in the file backend.
+// The manifest, sealed with the vault key too, holds the generation and the
+// hash of every record, so records can not be deleted or rolled back one by
+// one.
+const RECORD_VAULT_KEY_SIZE = 2 * core.SYMMETRIC_KEY_SIZE
+
+const META_VAULT_KEY = "vault_key"
+const META_GENERATION = "generation"
+const META_MANIFEST = "manifest"
+
+// SETTING_RECORD_MANIFEST is set once the database has a manifest, databases
+// without one are refused from then on.
+const SETTING_RECORD_MANIFEST = "record_manifest"
+
+var ErrBackupsUnsupported = errors.New("backups are only kept by the file backend")
+
+// recordTx is a transaction of a record based backend.
+type recordTx interface {
+	Meta(key string) ([]byte, error)
+	SetMeta(key string, value []byte) error
+	Records() (map[string][]byte, error)
+	PutRecord(id string, data []byte) error
+	DeleteRecord(id string) error
+}
+
+type recordDatabase interface {
+	View(fn func(tx recordTx) error) error
+	Update(fn func(tx recordTx) error) error
+	Close() error
+}
+
+type record struct {
+	Name     string
+	Password Password
+}
+
+// recordManifest maps the id of every record to the SHA-256 of its sealed
+// data.
+type recordManifest struct {
+	Generation uint64
+	Records    map[string][]byte
+}
+
+// recordStorage implements the password part of Storage on top of a
+// recordDatabase, settings stay in the ini file of the embedded storage.
+type recordStorage struct {
+	*storage
+	open func() (recordDatabase, error)
+}
+
+func (s *recordStorage) ReadPasswords() (map[string]Password, error) {
+	if s.vaultCipher == nil {
+		return nil, ErrVaultLocked
+	}
+
+	var passwords map[string]Password
+	var legacy bool
+
+	err := s.withDatabase(func(database recordDatabase) error {
+		return database.View(func(tx recordTx) error {
+			var err error
+
+			if passwords, _, err = s.readRecords(tx); err != nil {
+				return err
+			}
+
+			legacy, err = isLegacyRecords(tx)
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Databases from before the manifest get one right away.
+	if legacy {
+		return s.UpdatePasswords(func(passwords map[string]Password) error {
+			return nil
+		})
+	}
+
+	return passwords, nil
+}
+
+// StorePasswords replaces the passwords, it fails with ErrVaultConflict when
+// another client wrote them since the last read.
+func (s *recordStorage) StorePasswords(passwords map[string]Password) error {
+	if s.vaultCipher == nil {
+		return ErrVaultLocked
+	}
+
+	err := s.withDatabase(func(database recordDatabase) error {
+		return database.Update(func(tx recordTx) error {
+			generation := s.generation
+
+			_, records, err := s.readRecords(tx)
+
+			if err != nil {
+				return err
+			}
+
+			if s.generation != generation {
+				return ErrVaultConflict
+			}
+
+			return s.writeRecords(tx, records, passwords)
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.markRecordsMigrated()
+
+	return nil
+}
+
+func (s *recordStorage) UpdatePasswords(update func(passwords map[string]Password) error) (map[string]Password, error) {
+	if s.vaultCipher == nil {
+		return nil, ErrVaultLocked
+	}
+
+	var passwords map[string]Password
+
+	err := s.withDatabase(func(database recordDatabase) error {
+		return database.Update(func(tx recordTx) error {
+			var records map[string][]byte
+			var err error
+
+			passwords, records, err = s.readRecords(tx)
+
+			if err != nil {
+				return err
+			}
+
+			if err := update(passwords); err != nil {
+				return err
+			}
+
+			return s.writeRecords(tx, records, passwords)
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.markRecordsMigrated()
+
+	return passwords, nil
+}
+
+func (s *recordStorage) ListBackups() ([]Backup, error) {
+	return make([]Backup, 0), nil
+}
+
+func (s *recordStorage) RestoreBackup(generation int) error {
+	return ErrBackupsUnsupported
+}
+
+func (s *recordStorage) withDatabase(fn func(database recordDatabase) error) error {
+	database, err := s.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer database.Close()
+
+	return fn(database)
+}
+
+// readRecords decrypts every record and returns the entries together with
+// their encoded form, which writeRecords uses to find the changed entries.
+func (s *recordStorage) readRecords(tx recordTx) (map[string]Password, map[string][]byte, error) {
+	passwords := make(map[string]Password, 0)
+	encoded := make(map[string][]byte, 0)
+
+	generation, err := tx.Meta(META_GENERATION)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.generation = 0
+
+	if len(generation) == 8 {
+		s.generation = binary.BigEndian.Uint64(generation)
+	}
+
+	key, err := s.vaultKey(tx)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, err := tx.Records()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := tx.Meta(META_MANIFEST)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A deleted key must not turn the records into an empty vault, which the
+	// next write would replace.
+	if key == nil {
+		if len(records) > 0 || len(manifest) > 0 {
+			return nil, nil, ErrVaultTampered
+		}
+
+		return passwords, encoded, nil
+	}
+
+	if err := s.checkManifest(key, manifest, records); err != nil {
+		return nil, nil, err
+	}
+
+	for id, data := range records {
+		plaintext, err := core.OpenWithKey(key[:core.SYMMETRIC_KEY_SIZE], data, []byte(id))
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("record %s: %w", id, ErrVaultTampered)
+		}
+
+		var r record
+
+		if err := msgpack.Unmarshal(plaintext, &r); err != nil {
+			return nil, nil, fmt.Errorf("record %s: %w", id, ErrVaultCorrupted)
+		}
+
+		// A record copied under the id of another entry is rejected.
+		if recordId(key, r.Name) != id {
+			return nil, nil, fmt.Errorf("record %s: %w", id, ErrVaultTampered)
+		}
+
+		passwords[r.Name] = r.Password
+		encoded[r.Name] = plaintext
+	}
+
+	return passwords, encoded, nil
+}
+
+// writeRecords writes the entries that differ from the encoded ones and
+// deletes the missing ones.
+func (s *recordStorage) writeRecords(tx recordTx, encoded map[string][]byte, passwords map[string]Password) error {
+	key, err := s.vaultKey(tx)
+
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		if key, err = s.createVaultKey(tx); err != nil {
+			return err
+		}
+	}
+
+	for name, password := range passwords {
+		plaintext, err := msgpack.Marshal(&record{Name: name, Password: password})
+
+		if err != nil {
+			return err
+		}
+
+		if previous, ok := encoded[name]; ok && bytes.Equal(previous, plaintext) {
+			continue
+		}
+
+		id := recordId(key, name)
+
+		data, err := core.SealWithKey(key[:core.SYMMETRIC_KEY_SIZE], plaintext, []byte(id))
+
+		if err != nil {
+			return err
+		}
+
+		if err := tx.PutRecord(id, data); err != nil {
+			return err
+		}
+	}
+
+	for name := range encoded {
+		if _, ok := passwords[name]; !ok {
+			if err := tx.DeleteRecord(recordId(key, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	generation := make([]byte, 8)
+	binary.BigEndian.PutUint64(generation, s.generation+1)
+
+	if err := tx.SetMeta(META_GENERATION, generation); err != nil {
+		return err
+	}
+
+	if err := s.writeManifest(tx, key, s.generation+1); err != nil {
+		return err
+	}
+
+	s.generation++
+
+	return nil
+}
+
+// checkManifest compares the records with the manifest, a database without
+// a manifest is only read before the first manifest was written.
+func (s *recordStorage) checkManifest(key, sealed []byte, records map[string][]byte) error {
+	if len(sealed) <= 0 {
+		if s.recordsMigrated() {
+			return ErrVaultTampered
+		}
+
+		return nil
+	}
+
+	plaintext, err := core.OpenWithKey(key[:core.SYMMETRIC_KEY_SIZE], sealed, []byte(META_MANIFEST))
+
+	if err != nil {
+		return fmt.Errorf("manifest: %w", ErrVaultTampered)
+	}
+
+	var manifest recordManifest
+
+	if err := msgpack.Unmarshal(plaintext, &manifest); err != nil {
+		return fmt.Errorf("manifest: %w", ErrVaultCorrupted)
+	}
+
+	if manifest.Generation != s.generation || len(manifest.Records) != len(records) {
+		return fmt.Errorf("manifest: %w", ErrVaultTampered)
+	}
+
+	for id, data := range records {
+		sum := sha256.Sum256(data)
+
+		if !hmac.Equal(manifest.Records[id], sum[:]) {
+			return fmt.Errorf("record %s: %w", id, ErrVaultTampered)
+		}
+	}
+
+	return nil
+}
+
+func (s *recordStorage) writeManifest(tx recordTx, key []byte, generation uint64) error {
+	records, err := tx.Records()
+
+	if err != nil {
+		return err
+	}
+
+	manifest := recordManifest{
+		Generation: generation,
+		Records:    make(map[string][]byte, len(records)),
+	}
+
+	for id, data := range records {
+		sum := sha256.Sum256(data)
+		manifest.Records[id] = sum[:]
+	}
+
+	plaintext, err := msgpack.Marshal(&manifest)
+
+	if err != nil {
+		return err
+	}
+
+	sealed, err := core.SealWithKey(key[:core.SYMMETRIC_KEY_SIZE], plaintext, []byte(META_MANIFEST))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.SetMeta(META_MANIFEST, sealed)
+}
+
+func (s *recordStorage) recordsMigrated() bool {
+	return s.AreSettingsExists() && len(s.ReadSettings()[SETTING_RECORD_MANIFEST]) > 0
+}
+
+// markRecordsMigrated records that the database has a manifest, so one
+// without can not be slipped in later.
+func (s *recordStorage) markRecordsMigrated() {
+	if !s.AreSettingsExists() {
+		return
+	}
+
+	settings := s.ReadSettings()
+
+	if len(settings[SETTING_RECORD_MANIFEST]) > 0 {
+		return
+	}
+
+	settings[SETTING_RECORD_MANIFEST] = "1"
+	s.StoreSettings(settings)
+}
+
+// isLegacyRecords tells whether the database has records but no manifest.
+func isLegacyRecords(tx recordTx) (bool, error) {
+	key, err := tx.Meta(META_VAULT_KEY)
+
+	if err != nil || len(key) <= 0 {
+		return false, err
+	}
+
+	manifest, err := tx.Meta(META_MANIFEST)
+
+	return len(manifest) <= 0, err
+}
+
+func (s *recordStorage) vaultKey(tx recordTx) ([]byte, error) {
+	sealed, err := tx.Meta(META_VAULT_KEY)
+
+	if err != nil || len(sealed) <= 0 {
+		return nil, err
+	}
+
+	key, _, err := s.vaultCipher.Open(sealed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != RECORD_VAULT_KEY_SIZE {
+		return nil, ErrVaultCorrupted
+	}
+
+	return key, nil
+}
+
+func (s *recordStorage) createVaultKey(tx recordTx) ([]byte, error) {
+	key := make([]byte, RECORD_VAULT_KEY_SIZE)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	sealed, err := s.vaultCipher.Seal(key, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, tx.SetMeta(META_VAULT_KEY, sealed)
+}
+
+func recordId(key []byte, name string) string {
+	mac := hmac.New(sha256.New, key[core.SYMMETRIC_KEY_SIZE:])
+	mac.Write([]byte(name))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_it_should_store_passwords_in_record_backends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	vaultCipher := newTestVaultCipher(t)
+	settings := filepath.Join(dir, DEFAULT_SETTINGS_NAME)
+
+	backends := map[string]Storage{
+		STORAGE_BACKEND_BOLT:   NewBoltStorage(filepath.Join(dir, DEFAULT_BOLT_DATABASE_NAME), settings, "client"),
+		STORAGE_BACKEND_SQLITE: NewSqliteStorage(filepath.Join(dir, DEFAULT_SQLITE_DATABASE_NAME), settings, "client"),
+	}
+
+	for backend, sut := range backends {
+		sut.SetVaultCipher(vaultCipher)
+
+		_, err := sut.UpdatePasswords(func(passwords map[string]Password) error {
+			passwords["first"] = Password{Url: "a"}
+			passwords["second"] = Password{Url: "b"}
+			return nil
+		})
+
+		if err != nil {
+			t.Fatalf("Passwords could not be stored in %s: %s", backend, err)
+		}
+
+		_, err = sut.UpdatePasswords(func(passwords map[string]Password) error {
+			delete(passwords, "first")
+			passwords["second"] = Password{Url: "c"}
+			return nil
+		})
+
+		if err != nil {
+			t.Fatalf("Passwords could not be updated in %s: %s", backend, err)
+		}
+
+		passwords, err := sut.ReadPasswords()
+
+		if err != nil {
+			t.Fatalf("Passwords could not be read from %s: %s", backend, err)
+		}
+
+		if len(passwords) != 1 || passwords["second"].Url != "c" {
+			t.Errorf("Passwords of %s were incorrect, got: %v", backend, passwords)
+		}
+	}
+}
+
+func tamperRecords(t *testing.T, sut Storage, fn func(tx recordTx) error) {
+	err := sut.(*recordStorage).withDatabase(func(database recordDatabase) error {
+		return database.Update(fn)
+	})
+
+	if err != nil {
+		t.Fatalf("Records could not be changed: %s", err)
+	}
+}
+
+func Test_it_should_refuse_deleted_and_rolled_back_records(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	vaultCipher := newTestVaultCipher(t)
+
+	for _, backend := range []string{STORAGE_BACKEND_BOLT, STORAGE_BACKEND_SQLITE} {
+		settings := filepath.Join(dir, backend+".ini")
+
+		if err := ioutil.WriteFile(settings, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		sut, err := OpenStorage(backend, filepath.Join(dir, backend+".db"), settings, "client")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sut.SetVaultCipher(vaultCipher)
+
+		sut.UpdatePasswords(func(passwords map[string]Password) error {
+			passwords["first"] = Password{Url: "old"}
+			passwords["second"] = Password{Url: "b"}
+			return nil
+		})
+
+		var old, current map[string][]byte
+
+		tamperRecords(t, sut, func(tx recordTx) (err error) {
+			old, err = tx.Records()
+			return err
+		})
+
+		sut.UpdatePasswords(func(passwords map[string]Password) error {
+			passwords["first"] = Password{Url: "new"}
+			return nil
+		})
+
+		tamperRecords(t, sut, func(tx recordTx) (err error) {
+			current, err = tx.Records()
+			return err
+		})
+
+		restore := func(tx recordTx) error {
+			for id, data := range current {
+				if err := tx.PutRecord(id, data); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		tampers := map[string]func(tx recordTx) error{
+			"rolled back": func(tx recordTx) error {
+				for id, data := range old {
+					if !bytes.Equal(current[id], data) {
+						return tx.PutRecord(id, data)
+					}
+				}
+
+				return nil
+			},
+			"deleted": func(tx recordTx) error {
+				for id := range current {
+					return tx.DeleteRecord(id)
+				}
+
+				return nil
+			},
+		}
+
+		for name, tamper := range tampers {
+			tamperRecords(t, sut, tamper)
+
+			if _, err := sut.ReadPasswords(); !errors.Is(err, ErrVaultTampered) {
+				t.Errorf("%s record of %s was incorrect, got: %v, want: %v", name, backend, err, ErrVaultTampered)
+			}
+
+			tamperRecords(t, sut, restore)
+
+			if passwords, err := sut.ReadPasswords(); err != nil || passwords["first"].Url != "new" {
+				t.Fatalf("Restored passwords of %s were incorrect, got: %v, %v", backend, passwords, err)
+			}
+		}
+
+		tamperRecords(t, sut, func(tx recordTx) error {
+			return tx.SetMeta(META_VAULT_KEY, []byte{})
+		})
+
+		if _, err := sut.ReadPasswords(); !errors.Is(err, ErrVaultTampered) {
+			t.Errorf("Deleted vault key of %s was incorrect, got: %v, want: %v", backend, err, ErrVaultTampered)
+		}
+	}
+}
+
+func Test_it_should_read_records_without_manifest_only_once(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	settings := filepath.Join(dir, DEFAULT_SETTINGS_NAME)
+	ioutil.WriteFile(settings, nil, 0600)
+
+	sut := NewBoltStorage(filepath.Join(dir, DEFAULT_BOLT_DATABASE_NAME), settings, "client")
+	sut.SetVaultCipher(newTestVaultCipher(t))
+
+	sut.UpdatePasswords(func(passwords map[string]Password) error {
+		passwords["first"] = Password{Url: "a"}
+		return nil
+	})
+
+	// A database written before the manifest existed.
+	tamperRecords(t, sut, func(tx recordTx) error {
+		return tx.SetMeta(META_MANIFEST, []byte{})
+	})
+
+	values := sut.ReadSettings()
+	delete(values, SETTING_RECORD_MANIFEST)
+	sut.StoreSettings(values)
+
+	if passwords, err := sut.ReadPasswords(); err != nil || passwords["first"].Url != "a" {
+		t.Fatalf("Passwords without manifest were incorrect, got: %v, %v", passwords, err)
+	}
+
+	var manifest []byte
+
+	tamperRecords(t, sut, func(tx recordTx) (err error) {
+		manifest, err = tx.Meta(META_MANIFEST)
+		return err
+	})
+
+	if len(manifest) <= 0 {
+		t.Errorf("Manifest was not written on reading")
+	}
+
+	tamperRecords(t, sut, func(tx recordTx) error {
+		return tx.SetMeta(META_MANIFEST, []byte{})
+	})
+
+	if _, err := sut.ReadPasswords(); !errors.Is(err, ErrVaultTampered) {
+		t.Errorf("Passwords without manifest were incorrect, got: %v, want: %v", err, ErrVaultTampered)
+	}
+}
@@ -0,0 +1,591 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blueskan/harpocrates/core"
+	"github.com/vmihailenco/msgpack"
+)
+
+// SHARED_VAULT_REKEY_ATTEMPTS is how often removing a member reads the vault
+// again when the vault changed during the re-key.
+const SHARED_VAULT_REKEY_ATTEMPTS = 3
+
+// SHARED_VAULT_KEY_SIZE is the size of the data key of a shared vault, like
+// the sync key its first half encrypts the entries and its second half
+// derives their ids.
+const SHARED_VAULT_KEY_SIZE = 2 * core.SYMMETRIC_KEY_SIZE
+
+// Roles of the members of a shared vault. Read-only members only read the
+// passwords, read-write members also change them and admins also manage the
+// members. The owner is always an admin.
+const SHARED_VAULT_ROLE_READ_ONLY = "read-only"
+const SHARED_VAULT_ROLE_READ_WRITE = "read-write"
+const SHARED_VAULT_ROLE_ADMIN = "admin"
+
+var SHARED_VAULT_ROLES = []string{SHARED_VAULT_ROLE_READ_ONLY, SHARED_VAULT_ROLE_READ_WRITE, SHARED_VAULT_ROLE_ADMIN}
+
+var ErrSharedVaultNotFound = errors.New("shared vault does not exist or you are not a member of it")
+var ErrSharedVaultExists = errors.New("shared vault already exists")
+var ErrSharedVaultForbidden = errors.New("your role in the shared vault does not allow this")
+var ErrSharedVaultKeyChanged = errors.New("shared vault was re-keyed in the meantime, please try again")
+var ErrSharedVaultConflict = errors.New("shared vault entry was changed in the meantime, please try again")
+var ErrMemberNotFound = errors.New("user does not exist or has not published a public key yet")
+var ErrMemberExists = errors.New("user is already a member of the shared vault")
+var ErrInvalidRole = fmt.Errorf("role should be one of %s", strings.Join(SHARED_VAULT_ROLES, ", "))
+
+// SharedVault is a shared vault as a member receives it. WrappedKey is the
+// data key wrapped with the public key of the member and Role the role of
+// the member, list responses leave the key and the entries out. RekeyNeeded
+// is set when the server removed a deleted user, who still knows the key.
+type SharedVault struct {
+	Name        string
+	Owner       string
+	Members     []string
+	Roles       map[string]string
+	Role        string
+	KeyVersion  uint64
+	RekeyNeeded bool
+	WrappedKey  []byte
+	Revision    uint64
+	Entries     []SyncEntry
+	Audit       []SharedVaultRoleChange
+}
+
+// SharedVaultRoleChange records who gave which role to a member, Role is
+// empty when the member was removed.
+type SharedVaultRoleChange struct {
+	At     time.Time `json:"at"`
+	By     string    `json:"by"`
+	Member string    `json:"member"`
+	Role   string    `json:"role"`
+}
+
+type SharedVaultRepresentation struct {
+	Name        string            `json:"name"`
+	Owner       string            `json:"owner"`
+	Members     []string          `json:"members"`
+	Roles       map[string]string `json:"roles"`
+	Role        string            `json:"role"`
+	Entries     int               `json:"entries"`
+	RekeyNeeded bool              `json:"rekey_needed"`
+}
+
+// SharedVaultTransport moves shared vaults between this client and the
+// server. Push and Rekey refuse with ErrSharedVaultKeyChanged when keyVersion
+// is not the current key of the vault. Rekey replaces the entries, so it
+// refuses with ErrSharedVaultConflict when revision is not the current
+// revision of the vault.
+type SharedVaultTransport interface {
+	CreateVault(name string, wrappedKey []byte) error
+	Vaults() ([]SharedVault, error)
+	Vault(name string) (*SharedVault, error)
+	PublicKey(username string) ([]byte, error)
+	AddMember(vault, username, role string, wrappedKey []byte) error
+	SetRole(vault, username, role string) error
+	Rekey(vault string, keyVersion, revision uint64, members map[string][]byte, entries []SyncEntry) error
+	Push(vault string, keyVersion uint64, entries []SyncEntry) ([]SyncEntry, error)
+}
+
+// sharedRecord is the plaintext of a shared entry. Members do not share the
+// private key, so unlike personal entries the secrets are only protected by
+// the data key of the vault.
+type sharedRecord struct {
+	Name     string
+	Password PasswordRepresentation
+}
+
+func (c *syncCipher) sealShared(representation PasswordRepresentation) (SyncEntry, error) {
+	entry := SyncEntry{Id: c.id(representation.Name)}
+
+	plaintext, err := msgpack.Marshal(&sharedRecord{Name: representation.Name, Password: representation})
+
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Data, err = core.SealWithKey(c.key[:core.SYMMETRIC_KEY_SIZE], plaintext, []byte(entry.Id))
+
+	return entry, err
+}
+
+func (c *syncCipher) openShared(entry SyncEntry) (*PasswordRepresentation, error) {
+	plaintext, err := core.OpenWithKey(c.key[:core.SYMMETRIC_KEY_SIZE], entry.Data, []byte(entry.Id))
+
+	if err != nil {
+		return nil, ErrVaultTampered
+	}
+
+	var r sharedRecord
+
+	if err := msgpack.Unmarshal(plaintext, &r); err != nil {
+		return nil, ErrVaultCorrupted
+	}
+
+	if c.id(r.Name) != entry.Id {
+		return nil, ErrVaultTampered
+	}
+
+	r.Password.Name = r.Name
+
+	return &r.Password, nil
+}
+
+// CreateSharedVault creates a shared vault with a new data key, the creator
+// is its owner and first member.
+func (p *PasswordService) CreateSharedVault(transport SharedVaultTransport, name string) error {
+	key, err := newSharedVaultKey()
+
+	if err != nil {
+		return err
+	}
+
+	wrappedKey, err := p.cryptoManager.SealEnvelope(key, p.publicKey)
+
+	if err != nil {
+		return err
+	}
+
+	return transport.CreateVault(name, wrappedKey)
+}
+
+func (p *PasswordService) SharedVaults(transport SharedVaultTransport) ([]*SharedVaultRepresentation, error) {
+	list, err := transport.Vaults()
+
+	if err != nil {
+		return nil, err
+	}
+
+	representations := make([]*SharedVaultRepresentation, 0, len(list))
+
+	for _, vault := range list {
+		representations = append(representations, &SharedVaultRepresentation{
+			Name:        vault.Name,
+			Owner:       vault.Owner,
+			Members:     vault.Members,
+			Roles:       vault.Roles,
+			Role:        vault.Role,
+			Entries:     len(vault.Entries),
+			RekeyNeeded: vault.RekeyNeeded,
+		})
+	}
+
+	return representations, nil
+}
+
+func (p *PasswordService) SharedPasswords(transport SharedVaultTransport, vaultName string) ([]*PasswordRepresentation, error) {
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	passwords := make([]*PasswordRepresentation, 0, len(vault.Entries))
+
+	for _, entry := range vault.Entries {
+		password, err := cipher.openShared(entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("shared entry %s: %w", entry.Id, err)
+		}
+
+		passwords = append(passwords, password)
+	}
+
+	sort.Slice(passwords, func(i, j int) bool {
+		return passwords[i].Name < passwords[j].Name
+	})
+
+	return passwords, nil
+}
+
+func (p *PasswordService) GetSharedPassword(transport SharedVaultTransport, vaultName, name string) (*PasswordRepresentation, error) {
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := findSharedEntry(vault, cipher, name)
+
+	if !ok {
+		return nil, &PasswordNotFoundError{Name: name}
+	}
+
+	return cipher.openShared(entry)
+}
+
+// AddSharedVaultMember wraps the data key with the public key the server
+// published for username. The fingerprint of that key is returned, so it can
+// be compared with the one of the member.
+func (p *PasswordService) AddSharedVaultMember(transport SharedVaultTransport, vaultName, username, role string) (string, error) {
+	if err := ValidateSharedVaultRole(role); err != nil {
+		return "", err
+	}
+
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, fingerprint, err := p.wrapSharedVaultKey(transport, username, cipher.key)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fingerprint, transport.AddMember(vault.Name, username, role, wrappedKey)
+}
+
+func (p *PasswordService) SetSharedVaultRole(transport SharedVaultTransport, vaultName, username, role string) error {
+	if err := ValidateSharedVaultRole(role); err != nil {
+		return err
+	}
+
+	return transport.SetRole(vaultName, username, role)
+}
+
+func (p *PasswordService) SharedVaultAudit(transport SharedVaultTransport, vaultName string) ([]SharedVaultRoleChange, error) {
+	vault, err := transport.Vault(vaultName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return vault.Audit, nil
+}
+
+// StoreSharedPassword adds a password to a shared vault, it needs the
+// read-write role.
+func (p *PasswordService) StoreSharedPassword(transport SharedVaultTransport, vaultName string, representation PasswordRepresentation) error {
+	if len(representation.Type) <= 0 {
+		representation.Type = ENTRY_TYPE_LOGIN
+	}
+
+	if err := ValidateEntryType(representation.Type); err != nil {
+		return err
+	}
+
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := findSharedEntry(vault, cipher, representation.Name); ok {
+		return fmt.Errorf("Password named as `%s` already exists in shared vault `%s`", representation.Name, vaultName)
+	}
+
+	now := time.Now()
+
+	if representation.CreatedAt == nil {
+		representation.CreatedAt = &now
+	}
+
+	if representation.ModifiedAt == nil {
+		representation.ModifiedAt = &now
+	}
+
+	entry, err := cipher.sealShared(representation)
+
+	if err != nil {
+		return err
+	}
+
+	return p.pushShared(transport, vault, entry)
+}
+
+// DeleteSharedPassword deletes a password of a shared vault, it needs the
+// read-write role.
+func (p *PasswordService) DeleteSharedPassword(transport SharedVaultTransport, vaultName, name string) error {
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return err
+	}
+
+	entry, ok := findSharedEntry(vault, cipher, name)
+
+	if !ok {
+		return &PasswordNotFoundError{Name: name}
+	}
+
+	return p.pushShared(transport, vault, SyncEntry{
+		Id:           entry.Id,
+		BaseRevision: entry.Revision,
+		Deleted:      true,
+	})
+}
+
+// CanWrite tells whether the member may change the passwords of the vault.
+func (v *SharedVaultRepresentation) CanWrite() bool {
+	return v.Role == SHARED_VAULT_ROLE_READ_WRITE || v.Role == SHARED_VAULT_ROLE_ADMIN
+}
+
+func ValidateSharedVaultRole(role string) error {
+	if !containsString(SHARED_VAULT_ROLES, role) {
+		return ErrInvalidRole
+	}
+
+	return nil
+}
+
+// RemoveSharedVaultMember replaces the data key, so the removed member can
+// not read entries added afterwards, and encrypts the entries again. The
+// vault is read again when a member changed it during the re-key.
+func (p *PasswordService) RemoveSharedVaultMember(transport SharedVaultTransport, vaultName, username string) error {
+	var err error
+
+	for attempt := 0; attempt < SHARED_VAULT_REKEY_ATTEMPTS; attempt++ {
+		var vault *SharedVault
+		var cipher *syncCipher
+
+		if vault, cipher, err = p.openSharedVault(transport, vaultName); err != nil {
+			return err
+		}
+
+		if username == vault.Owner || !containsString(vault.Members, username) {
+			return fmt.Errorf("User `%s` is not a member of shared vault `%s` who can be removed", username, vaultName)
+		}
+
+		if err = p.rekeySharedVault(transport, vault, cipher, username); err != ErrSharedVaultConflict {
+			return err
+		}
+	}
+
+	return err
+}
+
+// rekeySharedVault wraps a new data key for the members except removed and
+// encrypts the entries with it.
+func (p *PasswordService) rekeySharedVault(transport SharedVaultTransport, vault *SharedVault, cipher *syncCipher, removed string) error {
+	key, err := newSharedVaultKey()
+
+	if err != nil {
+		return err
+	}
+
+	rekeyed := &syncCipher{key: key}
+	members := make(map[string][]byte, len(vault.Members))
+
+	for _, member := range vault.Members {
+		if member == removed {
+			continue
+		}
+
+		if members[member], _, err = p.wrapSharedVaultKey(transport, member, key); err != nil {
+			return fmt.Errorf("member `%s`: %w", member, err)
+		}
+	}
+
+	entries := make([]SyncEntry, 0, len(vault.Entries))
+
+	for _, entry := range vault.Entries {
+		password, err := cipher.openShared(entry)
+
+		if err != nil {
+			return fmt.Errorf("shared entry %s: %w", entry.Id, err)
+		}
+
+		sealed, err := rekeyed.sealShared(*password)
+
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, sealed)
+	}
+
+	return transport.Rekey(vault.Name, vault.KeyVersion, vault.Revision, members, entries)
+}
+
+// MoveToSharedVault moves a personal entry to a shared vault, its history
+// stays behind.
+func (p *PasswordService) MoveToSharedVault(transport SharedVaultTransport, name, vaultName string) error {
+	val, ok := p.passwords[name]
+
+	if !ok {
+		return &PasswordNotFoundError{Name: name}
+	}
+
+	password, err := p.decrypt(name, val)
+
+	if err != nil {
+		return err
+	}
+
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := findSharedEntry(vault, cipher, name); ok {
+		return fmt.Errorf("Password named as `%s` already exists in shared vault `%s`", name, vaultName)
+	}
+
+	entry, err := cipher.sealShared(*password)
+
+	if err != nil {
+		return err
+	}
+
+	if err := p.pushShared(transport, vault, entry); err != nil {
+		return err
+	}
+
+	return p.DeletePassword(name)
+}
+
+// MoveFromSharedVault moves an entry of a shared vault to the personal
+// passwords.
+func (p *PasswordService) MoveFromSharedVault(transport SharedVaultTransport, vaultName, name string) error {
+	vault, cipher, err := p.openSharedVault(transport, vaultName)
+
+	if err != nil {
+		return err
+	}
+
+	// The entry is only copied when it can be deleted from the vault.
+	if vault.Role != SHARED_VAULT_ROLE_READ_WRITE && vault.Role != SHARED_VAULT_ROLE_ADMIN {
+		return ErrSharedVaultForbidden
+	}
+
+	entry, ok := findSharedEntry(vault, cipher, name)
+
+	if !ok {
+		return &PasswordNotFoundError{Name: name}
+	}
+
+	password, err := cipher.openShared(entry)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.StorePassword(*password); err != nil {
+		return err
+	}
+
+	return p.pushShared(transport, vault, SyncEntry{
+		Id:           entry.Id,
+		BaseRevision: entry.Revision,
+		Deleted:      true,
+	})
+}
+
+func (p *PasswordService) pushShared(transport SharedVaultTransport, vault *SharedVault, entry SyncEntry) error {
+	pushed, err := transport.Push(vault.Name, vault.KeyVersion, []SyncEntry{entry})
+
+	if err != nil {
+		return err
+	}
+
+	for _, result := range pushed {
+		if result.Conflict {
+			return ErrSharedVaultConflict
+		}
+	}
+
+	return nil
+}
+
+// openSharedVault reads a shared vault and opens its data key. An admin
+// replaces the key first when the server removed a deleted user from the
+// vault, a member who changed the vault meanwhile leaves it to the next open.
+func (p *PasswordService) openSharedVault(transport SharedVaultTransport, name string) (*SharedVault, *syncCipher, error) {
+	vault, cipher, err := p.readSharedVault(transport, name)
+
+	if err != nil || !vault.RekeyNeeded || vault.Role != SHARED_VAULT_ROLE_ADMIN {
+		return vault, cipher, err
+	}
+
+	err = p.rekeySharedVault(transport, vault, cipher, "")
+
+	if err != nil && err != ErrSharedVaultConflict && err != ErrSharedVaultKeyChanged {
+		return nil, nil, err
+	}
+
+	return p.readSharedVault(transport, name)
+}
+
+func (p *PasswordService) readSharedVault(transport SharedVaultTransport, name string) (*SharedVault, *syncCipher, error) {
+	vault, err := transport.Vault(name)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := p.cryptoManager.OpenEnvelope(vault.WrappedKey, p.privateKey)
+
+	if err != nil {
+		return nil, nil, ErrVaultTampered
+	}
+
+	if len(key) != SHARED_VAULT_KEY_SIZE {
+		return nil, nil, ErrVaultCorrupted
+	}
+
+	return vault, &syncCipher{key: key}, nil
+}
+
+func (p *PasswordService) wrapSharedVaultKey(transport SharedVaultTransport, username string, key []byte) ([]byte, string, error) {
+	publicKeyBytes, err := transport.PublicKey(username)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	publicKey, err := p.cryptoManager.BytesToPublicKey(publicKeyBytes)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	wrappedKey, err := p.cryptoManager.SealEnvelope(key, publicKey)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return wrappedKey, PublicKeyFingerprint(publicKeyBytes), nil
+}
+
+// PublicKeyFingerprint is the SHA-256 of the PEM encoded public key, the
+// same as `sha256sum harpocrates.pub` prints.
+func PublicKeyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func findSharedEntry(vault *SharedVault, cipher *syncCipher, name string) (SyncEntry, bool) {
+	id := cipher.id(name)
+
+	for _, entry := range vault.Entries {
+		if entry.Id == id {
+			return entry, true
+		}
+	}
+
+	return SyncEntry{}, false
+}
+
+func newSharedVaultKey() ([]byte, error) {
+	key := make([]byte, SHARED_VAULT_KEY_SIZE)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueskan/harpocrates/core"
+)
+
+// memorySharedVaultTransport keeps a single shared vault like the server.
+type memorySharedVaultTransport struct {
+	owner       string
+	caller      string
+	keyVersion  uint64
+	revision    uint64
+	rekeyNeeded bool
+	members     map[string][]byte
+	roles       map[string]string
+	publicKeys  map[string][]byte
+	entries     map[string]SyncEntry
+}
+
+func (m *memorySharedVaultTransport) CreateVault(name string, wrappedKey []byte) error {
+	m.owner = m.caller
+	m.members = map[string][]byte{m.caller: wrappedKey}
+	m.roles = map[string]string{m.caller: SHARED_VAULT_ROLE_ADMIN}
+	m.entries = make(map[string]SyncEntry)
+
+	return nil
+}
+
+func (m *memorySharedVaultTransport) Vaults() ([]SharedVault, error) {
+	return nil, nil
+}
+
+func (m *memorySharedVaultTransport) Vault(name string) (*SharedVault, error) {
+	wrappedKey, ok := m.members[m.caller]
+
+	if !ok {
+		return nil, ErrSharedVaultNotFound
+	}
+
+	vault := &SharedVault{Name: name, Owner: m.owner, Role: m.roles[m.caller], KeyVersion: m.keyVersion, RekeyNeeded: m.rekeyNeeded, WrappedKey: wrappedKey, Revision: m.revision}
+
+	for member := range m.members {
+		vault.Members = append(vault.Members, member)
+	}
+
+	for _, entry := range m.entries {
+		vault.Entries = append(vault.Entries, entry)
+	}
+
+	return vault, nil
+}
+
+func (m *memorySharedVaultTransport) PublicKey(username string) ([]byte, error) {
+	return m.publicKeys[username], nil
+}
+
+func (m *memorySharedVaultTransport) AddMember(vault, username, role string, wrappedKey []byte) error {
+	m.members[username] = wrappedKey
+	m.roles[username] = role
+
+	return nil
+}
+
+func (m *memorySharedVaultTransport) SetRole(vault, username, role string) error {
+	m.roles[username] = role
+
+	return nil
+}
+
+func (m *memorySharedVaultTransport) Rekey(vault string, keyVersion, revision uint64, members map[string][]byte, entries []SyncEntry) error {
+	if revision != m.revision {
+		return ErrSharedVaultConflict
+	}
+
+	m.keyVersion++
+	m.revision++
+	m.rekeyNeeded = false
+	m.members = members
+	m.entries = make(map[string]SyncEntry)
+
+	for _, entry := range entries {
+		m.entries[entry.Id] = entry
+	}
+
+	return nil
+}
+
+func (m *memorySharedVaultTransport) Push(vault string, keyVersion uint64, entries []SyncEntry) ([]SyncEntry, error) {
+	if m.roles[m.caller] == SHARED_VAULT_ROLE_READ_ONLY {
+		return nil, ErrSharedVaultForbidden
+	}
+
+	for _, entry := range entries {
+		m.revision++
+
+		if entry.Deleted {
+			delete(m.entries, entry.Id)
+		} else {
+			m.entries[entry.Id] = entry
+		}
+	}
+
+	return entries, nil
+}
+
+func newTestMember(t *testing.T, dir, name string, transport *memorySharedVaultTransport) *PasswordService {
+	cryptoManager := core.NewCryptoManager(2048)
+
+	pri, pub, err := cryptoManager.CreatePubPriKey()
+
+	if err != nil {
+		t.Fatalf("Crypto Manager could not create keys: %s", err)
+	}
+
+	settings := filepath.Join(dir, name+".ini")
+
+	if err := ioutil.WriteFile(settings, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordService, err := NewPasswordService(cryptoManager, pri, pub, NewStorage(filepath.Join(dir, name+".db"), settings, "client"))
+
+	if err != nil {
+		t.Fatalf("Password Service could not be created: %s", err)
+	}
+
+	transport.publicKeys[name] = cryptoManager.PublicKeyToBytes(pub)
+
+	return passwordService
+}
+
+func Test_it_should_share_passwords_until_member_is_removed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	transport := &memorySharedVaultTransport{publicKeys: make(map[string][]byte)}
+	alice := newTestMember(t, dir, "alice", transport)
+	bob := newTestMember(t, dir, "bob", transport)
+
+	transport.caller = "alice"
+
+	if err := alice.CreateSharedVault(transport, "team"); err != nil {
+		t.Fatalf("Shared vault could not be created: %s", err)
+	}
+
+	if _, err := alice.StorePassword(PasswordRepresentation{Name: "db", Password: "secret"}); err != nil {
+		t.Fatalf("Password could not be stored: %s", err)
+	}
+
+	if err := alice.MoveToSharedVault(transport, "db", "team"); err != nil {
+		t.Fatalf("Password could not be moved: %s", err)
+	}
+
+	if _, err := alice.GetPassword("db"); err == nil {
+		t.Errorf("Moved password was kept in the personal passwords")
+	}
+
+	if _, err := alice.AddSharedVaultMember(transport, "team", "bob", SHARED_VAULT_ROLE_READ_ONLY); err != nil {
+		t.Fatalf("Member could not be added: %s", err)
+	}
+
+	transport.caller = "bob"
+
+	password, err := bob.GetSharedPassword(transport, "team", "db")
+
+	if err != nil || password.Password != "secret" {
+		t.Fatalf("Shared password was incorrect, got: %v, %v, want: %s", password, err, "secret")
+	}
+
+	if err := bob.MoveFromSharedVault(transport, "team", "db"); err != ErrSharedVaultForbidden {
+		t.Errorf("Read-only move was incorrect, got: %v, want: %v", err, ErrSharedVaultForbidden)
+	}
+
+	if _, err := bob.GetPassword("db"); err == nil {
+		t.Errorf("Read-only member copied the shared password")
+	}
+
+	removedKey := transport.members["bob"]
+	transport.caller = "alice"
+
+	if err := alice.RemoveSharedVaultMember(transport, "team", "bob"); err != nil {
+		t.Fatalf("Member could not be removed: %s", err)
+	}
+
+	password, err = alice.GetSharedPassword(transport, "team", "db")
+
+	if err != nil || password.Password != "secret" {
+		t.Fatalf("Re-keyed password was incorrect, got: %v, %v, want: %s", password, err, "secret")
+	}
+
+	// The removed member kept the old key, it does not open the entries.
+	transport.caller = "bob"
+	transport.members["bob"] = removedKey
+
+	if _, err := bob.GetSharedPassword(transport, "team", "db"); err == nil {
+		t.Errorf("Removed member could read the re-keyed vault")
+	}
+}
+
+func Test_it_should_rekey_vault_of_deleted_user_when_admin_opens_it(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	transport := &memorySharedVaultTransport{publicKeys: make(map[string][]byte)}
+	alice := newTestMember(t, dir, "alice", transport)
+	bob := newTestMember(t, dir, "bob", transport)
+
+	transport.caller = "alice"
+
+	alice.CreateSharedVault(transport, "team")
+	alice.StoreSharedPassword(transport, "team", PasswordRepresentation{Name: "db", Password: "secret"})
+
+	if _, err := alice.AddSharedVaultMember(transport, "team", "bob", SHARED_VAULT_ROLE_ADMIN); err != nil {
+		t.Fatalf("Member could not be added: %s", err)
+	}
+
+	// The server removes the deleted user alice without a re-key.
+	deletedKey := transport.members["alice"]
+	delete(transport.members, "alice")
+	transport.rekeyNeeded = true
+	transport.caller = "bob"
+
+	password, err := bob.GetSharedPassword(transport, "team", "db")
+
+	if err != nil || password.Password != "secret" {
+		t.Fatalf("Shared password was incorrect, got: %v, %v, want: %s", password, err, "secret")
+	}
+
+	if transport.rekeyNeeded || transport.keyVersion != 1 {
+		t.Errorf("Shared vault was not re-keyed, got: %v, %d", transport.rekeyNeeded, transport.keyVersion)
+	}
+
+	transport.caller = "alice"
+	transport.members["alice"] = deletedKey
+
+	if _, err := alice.GetSharedPassword(transport, "team", "db"); err == nil {
+		t.Errorf("Deleted user could read the re-keyed vault")
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (name TEXT PRIMARY KEY, value BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS entries (id TEXT PRIMARY KEY, data BLOB NOT NULL);
+`
+
+type sqliteDatabase struct {
+	db *sql.DB
+}
+
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+// NewSqliteStorage keeps the passwords in a SQLite database. Writes take the
+// database lock when their transaction begins, so concurrent clients wait
+// for each other instead of failing halfway.
+func NewSqliteStorage(passwordLocation, settingsLocation, mode string) Storage {
+	if len(passwordLocation) <= 0 {
+		passwordLocation = homeLocation(DEFAULT_SQLITE_DATABASE_NAME)
+	}
+
+	s := newFileStorage(passwordLocation, settingsLocation, mode)
+
+	return &recordStorage{
+		storage: s,
+		open: func() (recordDatabase, error) {
+			dsn := "file:" + (&url.URL{Path: s.passwordLocation}).EscapedPath() +
+				"?_txlock=immediate&_busy_timeout=" + strconv.Itoa(int(LOCK_TIMEOUT.Milliseconds()))
+
+			db, err := sql.Open("sqlite3", dsn)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := db.Exec(sqliteSchema); err != nil {
+				db.Close()
+				return nil, err
+			}
+
+			return &sqliteDatabase{db: db}, nil
+		},
+	}
+}
+
+func (d *sqliteDatabase) View(fn func(tx recordTx) error) error {
+	return d.transaction(fn)
+}
+
+func (d *sqliteDatabase) Update(fn func(tx recordTx) error) error {
+	return d.transaction(fn)
+}
+
+func (d *sqliteDatabase) transaction(fn func(tx recordTx) error) error {
+	tx, err := d.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&sqliteTx{tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *sqliteDatabase) Close() error {
+	return d.db.Close()
+}
+
+func (t *sqliteTx) Meta(key string) ([]byte, error) {
+	var value []byte
+
+	err := t.tx.QueryRow("SELECT value FROM meta WHERE name = ?", key).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+func (t *sqliteTx) SetMeta(key string, value []byte) error {
+	_, err := t.tx.Exec("INSERT OR REPLACE INTO meta (name, value) VALUES (?, ?)", key, value)
+
+	return err
+}
+
+func (t *sqliteTx) Records() (map[string][]byte, error) {
+	rows, err := t.tx.Query("SELECT id, data FROM entries")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	records := make(map[string][]byte)
+
+	for rows.Next() {
+		var id string
+		var data []byte
+
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		records[id] = data
+	}
+
+	return records, rows.Err()
+}
+
+func (t *sqliteTx) PutRecord(id string, data []byte) error {
+	_, err := t.tx.Exec("INSERT OR REPLACE INTO entries (id, data) VALUES (?, ?)", id, data)
+
+	return err
+}
+
+func (t *sqliteTx) DeleteRecord(id string) error {
+	_, err := t.tx.Exec("DELETE FROM entries WHERE id = ?", id)
+
+	return err
+}
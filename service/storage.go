@@ -2,46 +2,129 @@ package service
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-ini/ini"
 	"github.com/vmihailenco/msgpack"
 )
 
+const STORAGE_BACKEND_FILE = "file"
+const STORAGE_BACKEND_BOLT = "bolt"
+const STORAGE_BACKEND_SQLITE = "sqlite"
+
+var STORAGE_BACKENDS = []string{STORAGE_BACKEND_FILE, STORAGE_BACKEND_BOLT, STORAGE_BACKEND_SQLITE}
+
+// Client settings that select the backend and its location when they are
+// not given on the command line.
+const SETTING_STORAGE_BACKEND = "storage_backend"
+const SETTING_STORAGE_LOCATION = "storage_location"
+
+// SETTING_VAULT_VERSION is set once the password database is in the current
+// format, databases of older versions are refused from then on.
+const SETTING_VAULT_VERSION = "vault_version"
+
 type Storage interface {
-	StorePasswords(passwords map[string]Password)
-	ReadPasswords() map[string]Password
+	// SetVaultCipher sets the cipher of the password database, passwords are
+	// stored encrypted as a whole once it is set.
+	SetVaultCipher(cipher VaultCipher)
+	StorePasswords(passwords map[string]Password) error
+	ReadPasswords() (map[string]Password, error)
+	// UpdatePasswords applies a change to the passwords on disk while the
+	// database is locked and returns them, so changes other clients made
+	// since the last read are kept.
+	UpdatePasswords(update func(passwords map[string]Password) error) (map[string]Password, error)
+	ListBackups() ([]Backup, error)
+	// RestoreBackup replaces the password database with a backup generation,
+	// the replaced database becomes generation 1.
+	RestoreBackup(generation int) error
 	StoreSettings(settings map[string]string)
 	ReadSettings() map[string]string
 	AreSettingsExists() bool
 }
 
+// Backup is a previous generation of the password database, kept next to it
+// as harpocrates.db.1 (newest) to harpocrates.db.N.
+type Backup struct {
+	Generation int       `json:"generation"`
+	Location   string    `json:"location"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Size       int64     `json:"size"`
+}
+
 type storage struct {
 	passwordLocation string
 	settingsLocation string
+	vaultCipher      VaultCipher
+	generation       uint64
 }
 
 var PRIVATE_KEY_LOCATION string
 var PUBLIC_KEY_LOCATION string
+var SYNC_VAULT_LOCATION string
 
 const DEFAULT_DATABASE_NAME = "harpocrates.db"
+const DEFAULT_BOLT_DATABASE_NAME = "harpocrates.bolt"
+const DEFAULT_SQLITE_DATABASE_NAME = "harpocrates.sqlite"
+const DEFAULT_BACKUP_COUNT = 5
+const LOCK_TIMEOUT = 10 * time.Second
+
+var ErrVaultBusy = errors.New("password database is locked by another client, please try again")
+var ErrVaultConflict = errors.New("password database was changed by another client, please try again")
+
 const DEFAULT_SETTINGS_NAME = "harpocrates.ini"
 
 func NewStorage(passwordLocation, defaultSettingsLocation, mode string) Storage {
-	user, _ := user.Current()
-	homeDir := user.HomeDir
+	return newFileStorage(passwordLocation, defaultSettingsLocation, mode)
+}
+
+// OpenStorage returns the storage of a backend, without a backend the one
+// recorded in the settings is used. The recorded location is used for the
+// recorded backend when no location is given.
+func OpenStorage(backend, passwordLocation, settingsLocation, mode string) (Storage, error) {
+	if settingsStorage := newFileStorage("", settingsLocation, mode); settingsStorage.AreSettingsExists() {
+		settings := settingsStorage.ReadSettings()
+
+		if len(backend) <= 0 {
+			backend = settings[SETTING_STORAGE_BACKEND]
+		}
+
+		if len(passwordLocation) <= 0 && backend == settings[SETTING_STORAGE_BACKEND] {
+			passwordLocation = settings[SETTING_STORAGE_LOCATION]
+		}
+	}
+
+	switch backend {
+	case "", STORAGE_BACKEND_FILE:
+		return NewStorage(passwordLocation, settingsLocation, mode), nil
+	case STORAGE_BACKEND_BOLT:
+		return NewBoltStorage(passwordLocation, settingsLocation, mode), nil
+	case STORAGE_BACKEND_SQLITE:
+		return NewSqliteStorage(passwordLocation, settingsLocation, mode), nil
+	}
+
+	return nil, fmt.Errorf("Storage backend `%s` is not one of %s", backend, strings.Join(STORAGE_BACKENDS, ", "))
+}
 
-	PRIVATE_KEY_LOCATION = homeDir + string(os.PathSeparator) + "harpocrates"
-	PUBLIC_KEY_LOCATION = homeDir + string(os.PathSeparator) + "harpocrates.pub"
+func newFileStorage(passwordLocation, defaultSettingsLocation, mode string) *storage {
+	PRIVATE_KEY_LOCATION = homeLocation("harpocrates")
+	PUBLIC_KEY_LOCATION = homeLocation("harpocrates.pub")
+	SYNC_VAULT_LOCATION = homeLocation("harpocrates_sync.db")
 
 	if len(passwordLocation) <= 0 {
-		passwordLocation = homeDir + string(os.PathSeparator) + DEFAULT_DATABASE_NAME
+		passwordLocation = homeLocation(DEFAULT_DATABASE_NAME)
 	}
 
 	if len(defaultSettingsLocation) <= 0 {
-		defaultSettingsLocation = homeDir + string(os.PathSeparator) + mode + "_" + DEFAULT_SETTINGS_NAME
+		defaultSettingsLocation = homeLocation(mode + "_" + DEFAULT_SETTINGS_NAME)
 	}
 
 	return &storage{
@@ -50,34 +133,465 @@ func NewStorage(passwordLocation, defaultSettingsLocation, mode string) Storage
 	}
 }
 
-func (s *storage) StorePasswords(passwords map[string]Password) {
+func homeLocation(name string) string {
+	user, _ := user.Current()
+
+	return user.HomeDir + string(os.PathSeparator) + name
+}
+
+func (s *storage) SetVaultCipher(cipher VaultCipher) {
+	s.vaultCipher = cipher
+}
+
+// StorePasswords replaces the passwords on disk, it fails with
+// ErrVaultConflict when another client wrote them since the last read.
+func (s *storage) StorePasswords(passwords map[string]Password) error {
+	if s.vaultCipher == nil {
+		return ErrVaultLocked
+	}
+
+	lock, err := lockFile(s.lockLocation())
+
+	if err != nil {
+		return err
+	}
+
+	defer unlockFile(lock)
+
+	generation := s.generation
+
+	if _, err := s.readPasswords(); err != nil {
+		return err
+	}
+
+	if s.generation != generation {
+		return ErrVaultConflict
+	}
+
+	return s.storePasswords(passwords, true)
+}
+
+func (s *storage) UpdatePasswords(update func(passwords map[string]Password) error) (map[string]Password, error) {
+	if s.vaultCipher == nil {
+		return nil, ErrVaultLocked
+	}
+
+	lock, err := lockFile(s.lockLocation())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlockFile(lock)
+
+	passwords, err := s.readPasswords()
+
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]Password, len(passwords))
+
+	for name, password := range passwords {
+		previous[name] = password
+	}
+
+	if err := update(passwords); err != nil {
+		return nil, err
+	}
+
+	// Reading an entry only records its access time, that must not push the
+	// backups out of rotation.
+	err = s.storePasswords(passwords, !accessedOnly(previous, passwords))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return passwords, nil
+}
+
+// storePasswords replaces the database, with backup the current one is kept
+// as the newest backup.
+func (s *storage) storePasswords(passwords map[string]Password, backup bool) error {
 	b, err := msgpack.Marshal(&passwords)
 
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	b, err = s.vaultCipher.Seal(b, s.generation+1)
+
+	if err != nil {
+		return err
 	}
 
-	ioutil.WriteFile(s.passwordLocation, b, 666)
+	if backup {
+		if err := s.rotateBackups(); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteFileAtomic(s.passwordLocation, b); err != nil {
+		return err
+	}
+
+	s.generation++
+	s.markVaultMigrated()
+
+	return nil
 }
 
-func (s *storage) ReadPasswords() map[string]Password {
-	database, err := os.OpenFile(s.passwordLocation, os.O_RDONLY|os.O_CREATE, 0666)
-	defer database.Close()
+func (s *storage) lockLocation() string {
+	return s.passwordLocation + ".lock"
+}
+
+// LockFile takes the exclusive lock kept in location for other processes
+// sharing a file, the returned function releases it.
+func LockFile(location string) (func() error, error) {
+	file, err := lockFile(location)
 
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	return func() error {
+		return unlockFile(file)
+	}, nil
+}
+
+// WriteFileAtomic replaces a file atomically: the data is written and synced
+// to a temporary file with 0600 permissions which is renamed over the file.
+func WriteFileAtomic(location string, b []byte) error {
+	dir := filepath.Dir(location)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(location)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), location); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// accessedOnly tells whether a change only set access times.
+func accessedOnly(previous, current map[string]Password) bool {
+	if len(previous) != len(current) {
+		return false
+	}
+
+	for name, password := range current {
+		before, ok := previous[name]
+
+		if !ok {
+			return false
+		}
+
+		before.AccessedAt, password.AccessedAt = time.Time{}, time.Time{}
+
+		a, errA := msgpack.Marshal(&before)
+		b, errB := msgpack.Marshal(&password)
+
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *storage) rotateBackups() error {
+	count := s.backupCount()
+
+	if count <= 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(s.passwordLocation); os.IsNotExist(err) {
+		return nil
+	}
+
+	os.Remove(s.backupLocation(count))
+
+	for generation := count - 1; generation >= 1; generation-- {
+		err := os.Rename(s.backupLocation(generation), s.backupLocation(generation+1))
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// A hard link keeps the database in place until the rename, copying is
+	// the fallback for file systems without links.
+	if err := os.Link(s.passwordLocation, s.backupLocation(1)); err == nil {
+		return nil
+	}
+
+	return copyFile(s.passwordLocation, s.backupLocation(1))
+}
+
+func (s *storage) backupCount() int {
+	if !s.AreSettingsExists() {
+		return DEFAULT_BACKUP_COUNT
+	}
+
+	count, err := strconv.Atoi(s.ReadSettings()["backup_count"])
+
+	if err != nil || count < 0 {
+		return DEFAULT_BACKUP_COUNT
+	}
+
+	return count
+}
+
+func (s *storage) backupLocation(generation int) string {
+	return s.passwordLocation + "." + strconv.Itoa(generation)
+}
+
+func (s *storage) ListBackups() ([]Backup, error) {
+	backups := make([]Backup, 0)
+
+	for generation := 1; ; generation++ {
+		info, err := os.Stat(s.backupLocation(generation))
+
+		if os.IsNotExist(err) {
+			return backups, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, Backup{
+			Generation: generation,
+			Location:   s.backupLocation(generation),
+			ModifiedAt: info.ModTime(),
+			Size:       info.Size(),
+		})
 	}
+}
+
+func (s *storage) RestoreBackup(generation int) error {
+	if s.vaultCipher == nil {
+		return ErrVaultLocked
+	}
+
+	lock, err := lockFile(s.lockLocation())
+
+	if err != nil {
+		return err
+	}
+
+	defer unlockFile(lock)
+
+	b, err := ioutil.ReadFile(s.backupLocation(generation))
+
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Backup generation %d not exists", generation)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Only a backup that decrypts and passes the integrity check may replace
+	// the database.
+	passwords, backupGeneration, err := s.decode(b)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.backupLocation(generation), err)
+	}
+
+	// The restored passwords get a new generation, so clients that read the
+	// replaced database notice the change.
+	if _, err := s.readPasswords(); err != nil || s.generation < backupGeneration {
+		s.generation = backupGeneration
+	}
+
+	return s.storePasswords(passwords, true)
+}
+
+func copyFile(from, to string) error {
+	b, err := ioutil.ReadFile(from)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(to, b, 0600)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
 
-	bytes, _ := ioutil.ReadAll(database)
+	// Not every platform can sync a directory, the rename is done anyway.
+	d.Sync()
+
+	return nil
+}
+
+// ReadPasswords decrypts and verifies the password database. A database that
+// can not be read is an error instead of an empty one, so the next store can
+// not overwrite it. Databases of older versions are written again in the
+// current format right away.
+func (s *storage) ReadPasswords() (map[string]Password, error) {
+	if s.vaultCipher == nil {
+		return s.readPasswords()
+	}
+
+	lock, err := lockFile(s.lockLocation())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlockFile(lock)
+
+	b, err := ioutil.ReadFile(s.passwordLocation)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	passwords, err := s.readPasswords()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > 0 && isLegacyVault(b) {
+		if err := s.storePasswords(passwords, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return passwords, nil
+}
+
+// readPasswords reads the database and remembers its generation, the
+// caller holds the lock.
+func (s *storage) readPasswords() (map[string]Password, error) {
+	bytes, err := ioutil.ReadFile(s.passwordLocation)
+
+	if os.IsNotExist(err) {
+		s.generation = 0
+		return make(map[string]Password, 0), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes) <= 0 {
+		s.generation = 0
+		return make(map[string]Password, 0), nil
+	}
+
+	passwords, generation, err := s.decode(bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.passwordLocation, err)
+	}
+
+	s.generation = generation
+
+	return passwords, nil
+}
+
+func (s *storage) decode(b []byte) (map[string]Password, uint64, error) {
+	var generation uint64
+	var err error
+
+	if isLegacyVault(b) {
+		// Without a MAC anyone with the public key could have written it.
+		if s.vaultMigrated() {
+			return nil, 0, ErrVaultTampered
+		}
+
+		if IsVaultEncrypted(b) {
+			if s.vaultCipher == nil {
+				return nil, 0, ErrVaultLocked
+			}
+
+			if b, err = s.vaultCipher.OpenLegacy(b); err != nil {
+				return nil, 0, err
+			}
+		}
+	} else {
+		if s.vaultCipher == nil {
+			return nil, 0, ErrVaultLocked
+		}
+
+		if b, generation, err = s.vaultCipher.Open(b); err != nil {
+			return nil, 0, err
+		}
+
+		s.markVaultMigrated()
+	}
 
 	var passwords map[string]Password
-	msgpack.Unmarshal(bytes, &passwords)
+
+	if err := msgpack.Unmarshal(b, &passwords); err != nil {
+		return nil, 0, ErrVaultCorrupted
+	}
 
 	if passwords == nil {
 		passwords = make(map[string]Password, 0)
 	}
 
-	return passwords
+	return passwords, generation, nil
+}
+
+func (s *storage) vaultMigrated() bool {
+	return s.AreSettingsExists() && len(s.ReadSettings()[SETTING_VAULT_VERSION]) > 0
+}
+
+// markVaultMigrated records that the database is in the current format, so
+// a database of an older version can not be slipped in later.
+func (s *storage) markVaultMigrated() {
+	if !s.AreSettingsExists() {
+		return
+	}
+
+	settings := s.ReadSettings()
+
+	if len(settings[SETTING_VAULT_VERSION]) > 0 {
+		return
+	}
+
+	settings[SETTING_VAULT_VERSION] = strconv.Itoa(VAULT_VERSION)
+	s.StoreSettings(settings)
 }
 
 func (s *storage) StoreSettings(settings map[string]string) {
@@ -89,7 +603,7 @@ func (s *storage) StoreSettings(settings map[string]string) {
 		section.NewKey(key, value)
 	}
 
-	serverConfigFile, err := os.OpenFile(s.settingsLocation, os.O_WRONLY|os.O_CREATE, 0666)
+	serverConfigFile, err := os.OpenFile(s.settingsLocation, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	defer serverConfigFile.Close()
 
 	if err != nil {
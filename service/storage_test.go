@@ -0,0 +1,160 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func Test_it_should_keep_backups_and_restore_them(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, DEFAULT_DATABASE_NAME)
+
+	sut := NewStorage(location, filepath.Join(dir, DEFAULT_SETTINGS_NAME), "client")
+	sut.SetVaultCipher(newTestVaultCipher(t))
+
+	for _, url := range []string{"a", "b", "c"} {
+		if err := sut.StorePasswords(map[string]Password{"name": {Url: url}}); err != nil {
+			t.Fatalf("Passwords could not be stored: %s", err)
+		}
+	}
+
+	info, err := os.Stat(location)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Permissions were incorrect, got: %o, want: %o", info.Mode().Perm(), 0600)
+	}
+
+	backups, err := sut.ListBackups()
+
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Backups were incorrect, got: %v, %v", backups, err)
+	}
+
+	if err := sut.RestoreBackup(2); err != nil {
+		t.Fatalf("Backup could not be restored: %s", err)
+	}
+
+	passwords, err := sut.ReadPasswords()
+
+	if err != nil {
+		t.Fatalf("Passwords could not be read: %s", err)
+	}
+
+	if passwords["name"].Url != "a" {
+		t.Errorf("Restored url was incorrect, got: %s, want: %s", passwords["name"].Url, "a")
+	}
+}
+
+func Test_it_should_detect_and_merge_changes_of_other_clients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, DEFAULT_DATABASE_NAME)
+	settings := filepath.Join(dir, DEFAULT_SETTINGS_NAME)
+	vaultCipher := newTestVaultCipher(t)
+
+	first := NewStorage(location, settings, "client")
+	first.SetVaultCipher(vaultCipher)
+
+	second := NewStorage(location, settings, "client")
+	second.SetVaultCipher(vaultCipher)
+
+	if _, err := first.ReadPasswords(); err != nil {
+		t.Fatalf("Passwords could not be read: %s", err)
+	}
+
+	_, err = second.UpdatePasswords(func(passwords map[string]Password) error {
+		passwords["second"] = Password{}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Passwords could not be updated: %s", err)
+	}
+
+	if err := first.StorePasswords(map[string]Password{"first": {}}); !errors.Is(err, ErrVaultConflict) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrVaultConflict)
+	}
+
+	passwords, err := first.UpdatePasswords(func(passwords map[string]Password) error {
+		passwords["first"] = Password{}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Passwords could not be updated: %s", err)
+	}
+
+	if _, ok := passwords["second"]; !ok || len(passwords) != 2 {
+		t.Errorf("Passwords were not merged, got: %v", passwords)
+	}
+}
+
+func Test_it_should_migrate_legacy_database_only_once(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, DEFAULT_DATABASE_NAME)
+	settings := filepath.Join(dir, DEFAULT_SETTINGS_NAME)
+
+	if err := ioutil.WriteFile(settings, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, _ := msgpack.Marshal(map[string]Password{"name": {Url: "a"}})
+	ioutil.WriteFile(location, legacy, 0600)
+
+	sut := NewStorage(location, settings, "client")
+	sut.SetVaultCipher(newTestVaultCipher(t))
+
+	passwords, err := sut.ReadPasswords()
+
+	if err != nil || passwords["name"].Url != "a" {
+		t.Fatalf("Legacy database was incorrect, got: %v, %v, want: %s", passwords, err, "a")
+	}
+
+	if b, _ := ioutil.ReadFile(location); !IsVaultEncrypted(b) || isLegacyVault(b) {
+		t.Errorf("Legacy database was not migrated")
+	}
+
+	if sut.ReadSettings()[SETTING_VAULT_VERSION] == "" {
+		t.Errorf("Migration was not recorded")
+	}
+
+	forged, _ := msgpack.Marshal(map[string]Password{"name": {Url: "forged"}})
+	ioutil.WriteFile(location, forged, 0600)
+
+	if _, err := sut.ReadPasswords(); !errors.Is(err, ErrVaultTampered) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrVaultTampered)
+	}
+
+	if b, _ := ioutil.ReadFile(location); string(b) != string(forged) {
+		t.Errorf("Refused database was changed")
+	}
+}
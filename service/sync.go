@@ -0,0 +1,315 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/blueskan/harpocrates/core"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SETTING_SYNC_REVISION is the client setting holding the server revision
+// of the last pull.
+const SETTING_SYNC_REVISION = "sync_revision"
+
+// SYNC_ATTEMPTS bounds how often a sync pulls again when another device
+// pushed the same entries in the meantime.
+const SYNC_ATTEMPTS = 3
+
+const syncKeyInfo = "harpocrates sync key"
+
+var ErrSyncConflict = errors.New("entries kept changing on the server during sync, please try again")
+
+// SyncEntry is an entry as the server stores it. Id is an HMAC of the entry
+// name and Data the entry encrypted with a key derived from the private key,
+// so the server learns neither. BaseRevision is the revision a pushed entry
+// is based on, the server refuses the push with Conflict when it has a newer
+// one.
+type SyncEntry struct {
+	Id           string
+	Revision     uint64
+	BaseRevision uint64
+	Deleted      bool
+	Conflict     bool
+	Data         []byte
+}
+
+// SyncTransport moves entries between this client and the server.
+type SyncTransport interface {
+	// Pull returns the entries changed after the revision since and the
+	// current revision of the server.
+	Pull(since uint64) ([]SyncEntry, uint64, error)
+	// Push returns the pushed entries with their new revision, or Conflict.
+	Push(entries []SyncEntry) ([]SyncEntry, error)
+}
+
+type SyncResult struct {
+	Pulled    int    `json:"pulled"`
+	Pushed    int    `json:"pushed"`
+	Conflicts int    `json:"conflicts"`
+	Revision  uint64 `json:"revision"`
+}
+
+type syncCipher struct {
+	key []byte
+}
+
+func newSyncCipher(cryptoManager core.CryptoManager, privateKey *rsa.PrivateKey) (*syncCipher, error) {
+	key := make([]byte, 2*core.SYMMETRIC_KEY_SIZE)
+
+	kdf := hkdf.New(sha256.New, cryptoManager.PrivateKeyToBytes(privateKey), nil, []byte(syncKeyInfo))
+
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+
+	return &syncCipher{key: key}, nil
+}
+
+func (c *syncCipher) id(name string) string {
+	mac := hmac.New(sha256.New, c.key[core.SYMMETRIC_KEY_SIZE:])
+	mac.Write([]byte(name))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *syncCipher) seal(name string, password Password) (SyncEntry, []byte, error) {
+	id := c.id(name)
+
+	entry := SyncEntry{
+		Id:           id,
+		BaseRevision: password.Revision,
+		Deleted:      password.Deleted,
+	}
+
+	password.Revision, password.Dirty, password.Deleted = 0, false, false
+
+	plaintext, err := msgpack.Marshal(&record{Name: name, Password: password})
+
+	if err != nil {
+		return entry, nil, err
+	}
+
+	entry.Data, err = core.SealWithKey(c.key[:core.SYMMETRIC_KEY_SIZE], plaintext, []byte(id))
+
+	return entry, plaintext, err
+}
+
+func (c *syncCipher) open(entry SyncEntry) (string, Password, error) {
+	plaintext, err := core.OpenWithKey(c.key[:core.SYMMETRIC_KEY_SIZE], entry.Data, []byte(entry.Id))
+
+	if err != nil {
+		return "", Password{}, err
+	}
+
+	var r record
+
+	if err := msgpack.Unmarshal(plaintext, &r); err != nil {
+		return "", Password{}, err
+	}
+
+	if c.id(r.Name) != entry.Id {
+		return "", Password{}, ErrVaultTampered
+	}
+
+	r.Password.Revision = entry.Revision
+	r.Password.Deleted = entry.Deleted
+
+	return r.Name, r.Password, nil
+}
+
+// Sync pulls the entries other devices pushed and pushes the local changes.
+// When both changed an entry the one modified last wins.
+func (p *PasswordService) Sync(transport SyncTransport) (*SyncResult, error) {
+	cipher, err := newSyncCipher(p.cryptoManager, p.privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	settings := p.storageService.ReadSettings()
+	since, _ := strconv.ParseUint(settings[SETTING_SYNC_REVISION], 10, 64)
+
+	result := &SyncResult{}
+
+	for attempt := 0; attempt < SYNC_ATTEMPTS; attempt++ {
+		remote, revision, err := transport.Pull(since)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pending := make(map[string][]byte)
+		var entries []SyncEntry
+
+		stored, err := p.storageService.UpdatePasswords(func(stored map[string]Password) error {
+			pulled, err := mergeRemote(cipher, stored, remote)
+
+			if err != nil {
+				return err
+			}
+
+			result.Pulled += pulled
+
+			for name, password := range stored {
+				if !password.Dirty {
+					continue
+				}
+
+				entry, plaintext, err := cipher.seal(name, password)
+
+				if err != nil {
+					return err
+				}
+
+				pending[entry.Id] = plaintext
+				entries = append(entries, entry)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.passwords = livePasswords(stored)
+		since = revision
+
+		if len(entries) <= 0 {
+			break
+		}
+
+		pushed, err := transport.Push(entries)
+
+		if err != nil {
+			return nil, err
+		}
+
+		conflicts := 0
+
+		stored, err = p.storageService.UpdatePasswords(func(stored map[string]Password) error {
+			conflicts = markPushed(cipher, stored, pushed, pending)
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.passwords = livePasswords(stored)
+		result.Pushed += len(entries) - conflicts
+		result.Conflicts = conflicts
+
+		if conflicts <= 0 {
+			break
+		}
+	}
+
+	settings = p.storageService.ReadSettings()
+	settings[SETTING_SYNC_REVISION] = strconv.FormatUint(since, 10)
+	p.storageService.StoreSettings(settings)
+
+	result.Revision = since
+
+	if result.Conflicts > 0 {
+		return result, ErrSyncConflict
+	}
+
+	return result, nil
+}
+
+// mergeRemote applies pulled entries to stored. Entries without local
+// changes take the remote state, on both sides changed entries the one
+// modified last wins and a local winner is rebased on the remote revision.
+func mergeRemote(cipher *syncCipher, stored map[string]Password, remote []SyncEntry) (int, error) {
+	pulled := 0
+
+	for _, entry := range remote {
+		name, password, err := cipher.open(entry)
+
+		if err != nil {
+			return pulled, fmt.Errorf("synced entry %s: %w", entry.Id, err)
+		}
+
+		local, ok := stored[name]
+
+		// The local entry is already based on this revision, usually it is
+		// the one this client pushed.
+		if ok && local.Revision >= password.Revision {
+			continue
+		}
+
+		if ok && local.Dirty && !password.ModifiedAt.After(local.ModifiedAt) {
+			local.Revision = password.Revision
+			stored[name] = local
+			continue
+		}
+
+		if password.Deleted {
+			if !ok {
+				continue
+			}
+
+			delete(stored, name)
+		} else {
+			stored[name] = password
+		}
+
+		pulled++
+	}
+
+	return pulled, nil
+}
+
+// markPushed records the revisions the server gave to pushed entries. An
+// entry changed again locally during the push stays dirty.
+func markPushed(cipher *syncCipher, stored map[string]Password, pushed []SyncEntry, pending map[string][]byte) int {
+	conflicts := 0
+	names := make(map[string]string, len(stored))
+
+	for name := range stored {
+		names[cipher.id(name)] = name
+	}
+
+	for _, entry := range pushed {
+		if entry.Conflict {
+			conflicts++
+			continue
+		}
+
+		name, ok := names[entry.Id]
+
+		if !ok {
+			continue
+		}
+
+		password := stored[name]
+		_, plaintext, err := cipher.seal(name, password)
+
+		if err != nil || string(plaintext) != string(pending[entry.Id]) || password.Deleted != entry.Deleted {
+			password.Revision = entry.Revision
+			stored[name] = password
+			continue
+		}
+
+		if password.Deleted {
+			delete(stored, name)
+			continue
+		}
+
+		password.Revision = entry.Revision
+		password.Dirty = false
+		stored[name] = password
+	}
+
+	return conflicts
+}
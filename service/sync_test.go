@@ -0,0 +1,181 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueskan/harpocrates/core"
+)
+
+// memorySyncTransport mirrors the server, which only orders the entries.
+type memorySyncTransport struct {
+	revision uint64
+	entries  map[string]SyncEntry
+}
+
+func (m *memorySyncTransport) Pull(since uint64) ([]SyncEntry, uint64, error) {
+	entries := make([]SyncEntry, 0)
+
+	for _, entry := range m.entries {
+		if entry.Revision > since {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, m.revision, nil
+}
+
+func (m *memorySyncTransport) Push(entries []SyncEntry) ([]SyncEntry, error) {
+	pushed := make([]SyncEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		if m.entries[entry.Id].Revision != entry.BaseRevision {
+			pushed = append(pushed, SyncEntry{Id: entry.Id, Conflict: true})
+			continue
+		}
+
+		m.revision++
+		entry.Revision = m.revision
+		m.entries[entry.Id] = entry
+
+		pushed = append(pushed, SyncEntry{Id: entry.Id, Revision: entry.Revision, Deleted: entry.Deleted})
+	}
+
+	return pushed, nil
+}
+
+func newTestDevices(t *testing.T, dir string) (*PasswordService, *PasswordService) {
+	cryptoManager := core.NewCryptoManager(2048)
+
+	pri, pub, err := cryptoManager.CreatePubPriKey()
+
+	if err != nil {
+		t.Fatalf("Crypto Manager could not create keys: %s", err)
+	}
+
+	devices := make([]*PasswordService, 0, 2)
+
+	for _, device := range []string{"laptop", "phone"} {
+		settings := filepath.Join(dir, device+".ini")
+
+		if err := ioutil.WriteFile(settings, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		passwordService, err := NewPasswordService(cryptoManager, pri, pub, NewStorage(filepath.Join(dir, device+".db"), settings, "client"))
+
+		if err != nil {
+			t.Fatalf("Password Service could not be created: %s", err)
+		}
+
+		devices = append(devices, passwordService)
+	}
+
+	return devices[0], devices[1]
+}
+
+func Test_it_should_sync_passwords_between_devices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	transport := &memorySyncTransport{entries: make(map[string]SyncEntry)}
+	laptop, phone := newTestDevices(t, dir)
+
+	if _, err := laptop.StorePassword(PasswordRepresentation{Name: "mail", Password: "secret"}); err != nil {
+		t.Fatalf("Password could not be stored: %s", err)
+	}
+
+	if _, err := laptop.StorePassword(PasswordRepresentation{Name: "bank", Password: "secret"}); err != nil {
+		t.Fatalf("Password could not be stored: %s", err)
+	}
+
+	for _, device := range []*PasswordService{laptop, phone} {
+		if _, err := device.Sync(transport); err != nil {
+			t.Fatalf("Passwords could not be synced: %s", err)
+		}
+	}
+
+	password, err := phone.GetPassword("mail")
+
+	if err != nil || password.Password != "secret" {
+		t.Fatalf("Synced password was incorrect, got: %v, %v, want: %s", password, err, "secret")
+	}
+
+	if err := phone.DeletePassword("bank"); err != nil {
+		t.Fatalf("Password could not be deleted: %s", err)
+	}
+
+	if _, err := phone.Sync(transport); err != nil {
+		t.Fatalf("Passwords could not be synced: %s", err)
+	}
+
+	result, err := laptop.Sync(transport)
+
+	if err != nil {
+		t.Fatalf("Passwords could not be synced: %s", err)
+	}
+
+	if result.Pulled != 1 {
+		t.Errorf("Pulled passwords were incorrect, got: %d, want: %d", result.Pulled, 1)
+	}
+
+	if _, err := laptop.GetPassword("bank"); err == nil {
+		t.Errorf("Deleted password was not synced")
+	}
+}
+
+func Test_it_should_keep_the_last_modified_password_on_conflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpocrates")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	transport := &memorySyncTransport{entries: make(map[string]SyncEntry)}
+	laptop, phone := newTestDevices(t, dir)
+
+	if _, err := laptop.StorePassword(PasswordRepresentation{Name: "mail", Password: "first"}); err != nil {
+		t.Fatalf("Password could not be stored: %s", err)
+	}
+
+	for _, device := range []*PasswordService{laptop, phone} {
+		if _, err := device.Sync(transport); err != nil {
+			t.Fatalf("Passwords could not be synced: %s", err)
+		}
+	}
+
+	newPassword := "laptop"
+
+	if _, err := laptop.UpdatePassword("mail", PasswordUpdate{Password: &newPassword}); err != nil {
+		t.Fatalf("Password could not be updated: %s", err)
+	}
+
+	newPassword = "phone"
+
+	if _, err := phone.UpdatePassword("mail", PasswordUpdate{Password: &newPassword}); err != nil {
+		t.Fatalf("Password could not be updated: %s", err)
+	}
+
+	for _, device := range []*PasswordService{laptop, phone, laptop} {
+		if _, err := device.Sync(transport); err != nil {
+			t.Fatalf("Passwords could not be synced: %s", err)
+		}
+	}
+
+	for _, device := range []*PasswordService{laptop, phone} {
+		password, err := device.GetPassword("mail")
+
+		if err != nil || password.Password != "phone" {
+			t.Errorf("Password was incorrect, got: %v, %v, want: %s", password, err, "phone")
+		}
+	}
+}
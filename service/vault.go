@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/blueskan/harpocrates/core"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Vault file layout:
+//
+//	[magic:4][version:1][header length:2][msgpack header][payload length:4][envelope][HMAC-SHA256:32]
+//
+// The header records the cipher and KDF parameters. The MAC covers every
+// byte before it and is checked before anything is decrypted, its key is
+// derived from the private key with HKDF so only the owner can produce it.
+// Version 1 files of the previous release have no header and no MAC, files
+// without the magic are the plain msgpack databases of older versions.
+// Neither can be trusted, anyone with the public key can write them, so
+// they are only read once to migrate a database to the current version.
+var VAULT_MAGIC = []byte("HRPV")
+
+const VAULT_VERSION = 2
+const VAULT_CIPHER = "RSA-OAEP-SHA512+AES-256-GCM"
+const VAULT_KDF = "HKDF-SHA256"
+const VAULT_MAC = "HMAC-SHA256"
+const VAULT_SALT_SIZE = 16
+
+const vaultPreambleSize = 5
+const vaultMacInfo = "harpocrates vault mac"
+
+var ErrVaultLocked = errors.New("password database is encrypted, private key is required")
+var ErrVaultVersion = errors.New("password database is written by a newer version")
+var ErrVaultCorrupted = errors.New("password database is corrupted")
+var ErrVaultTampered = errors.New("password database failed the integrity check, it is corrupted or was modified")
+
+// VaultCipher encrypts the serialized password database before it reaches
+// the disk and checks its integrity when it is read back.
+type VaultCipher interface {
+	Seal(plaintext []byte, generation uint64) ([]byte, error)
+	Open(ciphertext []byte) ([]byte, uint64, error)
+	// OpenLegacy decrypts a version 1 vault, which has no MAC.
+	OpenLegacy(ciphertext []byte) ([]byte, error)
+}
+
+// vaultHeader is authenticated by the MAC. Generation is incremented on
+// every write, so a client can tell that the file changed since it read it.
+type vaultHeader struct {
+	Generation uint64
+	Cipher     string
+	Bits       int
+	Kdf        string
+	Mac        string
+	Salt       []byte
+}
+
+type rsaVaultCipher struct {
+	cryptoManager core.CryptoManager
+	privateKey    *rsa.PrivateKey
+	publicKey     *rsa.PublicKey
+}
+
+func NewVaultCipher(cryptoManager core.CryptoManager, privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) VaultCipher {
+	return &rsaVaultCipher{
+		cryptoManager: cryptoManager,
+		privateKey:    privateKey,
+		publicKey:     publicKey,
+	}
+}
+
+func (c *rsaVaultCipher) Seal(plaintext []byte, generation uint64) ([]byte, error) {
+	header := vaultHeader{
+		Generation: generation,
+		Cipher:     VAULT_CIPHER,
+		Bits:       c.publicKey.Size() * 8,
+		Kdf:        VAULT_KDF,
+		Mac:        VAULT_MAC,
+		Salt:       make([]byte, VAULT_SALT_SIZE),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, header.Salt); err != nil {
+		return nil, err
+	}
+
+	encodedHeader, err := msgpack.Marshal(&header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err := c.cryptoManager.SealEnvelope(plaintext, c.publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	vault := make([]byte, 0, vaultPreambleSize+2+len(encodedHeader)+4+len(envelope)+sha256.Size)
+	vault = append(vault, VAULT_MAGIC...)
+	vault = append(vault, VAULT_VERSION)
+	vault = appendUint16(vault, uint16(len(encodedHeader)))
+	vault = append(vault, encodedHeader...)
+	vault = appendUint32(vault, uint32(len(envelope)))
+	vault = append(vault, envelope...)
+
+	mac, err := c.mac(header.Salt, vault)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(vault, mac...), nil
+}
+
+func (c *rsaVaultCipher) Open(ciphertext []byte) ([]byte, uint64, error) {
+	if !IsVaultEncrypted(ciphertext) {
+		return nil, 0, ErrVaultCorrupted
+	}
+
+	switch version := ciphertext[len(VAULT_MAGIC)]; {
+	case version < VAULT_VERSION:
+		return nil, 0, ErrVaultTampered
+	case version > VAULT_VERSION:
+		return nil, 0, ErrVaultVersion
+	}
+
+	rest := ciphertext[vaultPreambleSize:]
+
+	if len(rest) < 2 {
+		return nil, 0, ErrVaultCorrupted
+	}
+
+	headerLength := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+
+	if len(rest) < headerLength+4 {
+		return nil, 0, ErrVaultCorrupted
+	}
+
+	var header vaultHeader
+
+	if err := msgpack.Unmarshal(rest[:headerLength], &header); err != nil {
+		return nil, 0, ErrVaultCorrupted
+	}
+
+	if header.Cipher != VAULT_CIPHER || header.Kdf != VAULT_KDF || header.Mac != VAULT_MAC {
+		return nil, 0, ErrVaultVersion
+	}
+
+	rest = rest[headerLength:]
+	payloadLength := int(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+
+	if len(rest) != payloadLength+sha256.Size {
+		return nil, 0, ErrVaultCorrupted
+	}
+
+	signed := ciphertext[:len(ciphertext)-sha256.Size]
+
+	expectedMac, err := c.mac(header.Salt, signed)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !hmac.Equal(expectedMac, rest[payloadLength:]) {
+		return nil, 0, ErrVaultTampered
+	}
+
+	plaintext, err := c.open(rest[:payloadLength])
+
+	return plaintext, header.Generation, err
+}
+
+func (c *rsaVaultCipher) OpenLegacy(ciphertext []byte) ([]byte, error) {
+	if !IsVaultEncrypted(ciphertext) || ciphertext[len(VAULT_MAGIC)] != 1 {
+		return nil, ErrVaultCorrupted
+	}
+
+	return c.open(ciphertext[vaultPreambleSize:])
+}
+
+func (c *rsaVaultCipher) open(envelope []byte) ([]byte, error) {
+	plaintext, err := c.cryptoManager.OpenEnvelope(envelope, c.privateKey)
+
+	if err != nil {
+		return nil, ErrVaultTampered
+	}
+
+	return plaintext, nil
+}
+
+func (c *rsaVaultCipher) mac(salt, data []byte) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+
+	kdf := hkdf.New(sha256.New, c.cryptoManager.PrivateKeyToBytes(c.privateKey), salt, []byte(vaultMacInfo))
+
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil), nil
+}
+
+func IsVaultEncrypted(data []byte) bool {
+	return len(data) >= vaultPreambleSize && bytes.HasPrefix(data, VAULT_MAGIC)
+}
+
+// isLegacyVault tells whether data is a database of an older version, plain
+// msgpack or a version 1 vault.
+func isLegacyVault(data []byte) bool {
+	return !IsVaultEncrypted(data) || data[len(VAULT_MAGIC)] < VAULT_VERSION
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+
+	return append(b, buf[:]...)
+}
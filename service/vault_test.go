@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/blueskan/harpocrates/core"
+)
+
+func newTestVaultCipher(t *testing.T) VaultCipher {
+	cryptoManager := core.NewCryptoManager(2048)
+
+	pri, pub, err := cryptoManager.CreatePubPriKey()
+
+	if err != nil {
+		t.Fatalf("Crypto Manager could not create keys: %s", err)
+	}
+
+	return NewVaultCipher(cryptoManager, pri, pub)
+}
+
+func Test_it_should_seal_and_open_vault(t *testing.T) {
+	sut := newTestVaultCipher(t)
+
+	vault, err := sut.Seal([]byte("passwords"), 1)
+
+	if err != nil {
+		t.Fatalf("Vault could not be sealed: %s", err)
+	}
+
+	if !IsVaultEncrypted(vault) || bytes.Contains(vault, []byte("passwords")) {
+		t.Errorf("Vault was not encrypted")
+	}
+
+	opened, generation, err := sut.Open(vault)
+
+	if err != nil {
+		t.Fatalf("Vault could not be opened: %s", err)
+	}
+
+	if generation != 1 {
+		t.Errorf("Generation was incorrect, got: %d, want: %d", generation, 1)
+	}
+
+	if string(opened) != "passwords" {
+		t.Errorf("Opened vault was incorrect, got: %s, want: %s", opened, "passwords")
+	}
+}
+
+func Test_it_should_reject_tampered_or_truncated_vault(t *testing.T) {
+	sut := newTestVaultCipher(t)
+
+	vault, err := sut.Seal([]byte("passwords"), 1)
+
+	if err != nil {
+		t.Fatalf("Vault could not be sealed: %s", err)
+	}
+
+	for i := vaultPreambleSize; i < len(vault); i += 37 {
+		tampered := append([]byte{}, vault...)
+		tampered[i] ^= 1
+
+		if _, _, err := sut.Open(tampered); err == nil {
+			t.Errorf("Vault tampered at byte %d was opened without error", i)
+		}
+	}
+
+	if _, _, err := sut.Open(vault[:len(vault)-1]); !errors.Is(err, ErrVaultCorrupted) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrVaultCorrupted)
+	}
+}
+
+func Test_it_should_reject_vault_of_other_private_key(t *testing.T) {
+	vault, err := newTestVaultCipher(t).Seal([]byte("passwords"), 1)
+
+	if err != nil {
+		t.Fatalf("Vault could not be sealed: %s", err)
+	}
+
+	if _, _, err := newTestVaultCipher(t).Open(vault); !errors.Is(err, ErrVaultTampered) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrVaultTampered)
+	}
+}
+
+func Test_it_should_open_version_1_vault_only_as_legacy(t *testing.T) {
+	cryptoManager := core.NewCryptoManager(2048)
+
+	pri, pub, err := cryptoManager.CreatePubPriKey()
+
+	if err != nil {
+		t.Fatalf("Crypto Manager could not create keys: %s", err)
+	}
+
+	envelope, _ := cryptoManager.SealEnvelope([]byte("passwords"), pub)
+	vault := append(append(append([]byte{}, VAULT_MAGIC...), 1), envelope...)
+
+	sut := NewVaultCipher(cryptoManager, pri, pub)
+
+	if _, _, err := sut.Open(vault); !errors.Is(err, ErrVaultTampered) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrVaultTampered)
+	}
+
+	if opened, err := sut.OpenLegacy(vault); err != nil || string(opened) != "passwords" {
+		t.Errorf("Legacy vault was incorrect, got: %s, %v, want: %s", opened, err, "passwords")
+	}
+}
@@ -0,0 +1,294 @@
+package users
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/vmihailenco/msgpack"
+)
+
+const USER_NAME = "user.db"
+const PRIVATE_KEY_NAME = "private_key"
+const PUBLIC_KEY_NAME = "public_key.pem"
+const SYNC_VAULT_NAME = "sync.db"
+
+const DEFAULT_USERS_DIRECTORY_NAME = "harpocrates_users"
+
+var ErrInvalidUsername = errors.New("username should start with a letter or digit and contain only letters, digits, `.`, `_` and `-`")
+var ErrUserExists = errors.New("user already exists")
+var ErrUserNotFound = errors.New("user does not exist")
+var ErrPrivateKeyNotFound = errors.New("user has no private key")
+var ErrPublicKeyNotFound = errors.New("user has no public key")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// User is an account of the server. The password itself is never known to
+// the server, only its SRP verifier.
+type User struct {
+	Name          string    `json:"name"`
+	SrpSalt       []byte    `json:"-"`
+	SrpVerifier   []byte    `json:"-"`
+	Disabled      bool      `json:"disabled"`
+	CreatedAt     time.Time `json:"created_at"`
+	HasPrivateKey bool      `json:"has_private_key" msgpack:"-"`
+}
+
+type Store interface {
+	Create(user User) error
+	Get(name string) (*User, error)
+	List() ([]User, error)
+	SetDisabled(name string, disabled bool) error
+	Delete(name string) error
+
+	PrivateKey(name string) ([]byte, error)
+	StorePrivateKey(name string, privateKey []byte) error
+
+	// PublicKey is published so other users can share vaults with the user.
+	PublicKey(name string) ([]byte, error)
+	StorePublicKey(name string, publicKey []byte) error
+
+	// Location returns the location of a file kept for the user, like the
+	// synced entries.
+	Location(name, file string) string
+}
+
+// store keeps every user in its own directory: the account in user.db, the
+// escrowed private key, the public key and the synced entries next to it.
+type store struct {
+	directory string
+	mutex     sync.Mutex
+}
+
+// NewStore returns the users kept in directory, an empty directory means
+// `harpocrates_users` in the home directory.
+func NewStore(directory string) Store {
+	if len(directory) <= 0 {
+		homeDir, _ := os.UserHomeDir()
+		directory = filepath.Join(homeDir, DEFAULT_USERS_DIRECTORY_NAME)
+	}
+
+	return &store{
+		directory: directory,
+	}
+}
+
+func ValidateUsername(name string) error {
+	if !usernamePattern.MatchString(name) {
+		return ErrInvalidUsername
+	}
+
+	return nil
+}
+
+func (s *store) Location(name, file string) string {
+	return filepath.Join(s.directory, name, file)
+}
+
+func (s *store) Create(user User) error {
+	if err := ValidateUsername(user.Name); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.directory, 0700); err != nil {
+		return err
+	}
+
+	// Mkdir fails when the directory exists, so two registrations of the
+	// same name cannot both succeed.
+	if err := os.Mkdir(filepath.Join(s.directory, user.Name), 0700); err != nil {
+		if os.IsExist(err) {
+			return ErrUserExists
+		}
+
+		return err
+	}
+
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+
+	return s.write(user)
+}
+
+func (s *store) Get(name string) (*User, error) {
+	if err := ValidateUsername(name); err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.read(name)
+}
+
+func (s *store) List() ([]User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := ioutil.ReadDir(s.directory)
+
+	if os.IsNotExist(err) {
+		return make([]User, 0), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]User, 0, len(entries))
+
+	for _, entry := range entries {
+		if !entry.IsDir() || ValidateUsername(entry.Name()) != nil {
+			continue
+		}
+
+		user, err := s.read(entry.Name())
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, *user)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+func (s *store) SetDisabled(name string, disabled bool) error {
+	if err := ValidateUsername(name); err != nil {
+		return ErrUserNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.read(name)
+
+	if err != nil {
+		return err
+	}
+
+	user.Disabled = disabled
+
+	return s.write(*user)
+}
+
+func (s *store) Delete(name string) error {
+	if err := ValidateUsername(name); err != nil {
+		return ErrUserNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.read(name); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(s.directory, name))
+}
+
+func (s *store) PrivateKey(name string) ([]byte, error) {
+	if err := ValidateUsername(name); err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	privateKey, err := ioutil.ReadFile(s.Location(name, PRIVATE_KEY_NAME))
+
+	if os.IsNotExist(err) {
+		return nil, ErrPrivateKeyNotFound
+	}
+
+	return privateKey, err
+}
+
+func (s *store) StorePrivateKey(name string, privateKey []byte) error {
+	if err := ValidateUsername(name); err != nil {
+		return ErrUserNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.read(name); err != nil {
+		return err
+	}
+
+	return service.WriteFileAtomic(s.Location(name, PRIVATE_KEY_NAME), privateKey)
+}
+
+func (s *store) PublicKey(name string) ([]byte, error) {
+	if err := ValidateUsername(name); err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	publicKey, err := ioutil.ReadFile(s.Location(name, PUBLIC_KEY_NAME))
+
+	if os.IsNotExist(err) {
+		return nil, ErrPublicKeyNotFound
+	}
+
+	return publicKey, err
+}
+
+func (s *store) StorePublicKey(name string, publicKey []byte) error {
+	if err := ValidateUsername(name); err != nil {
+		return ErrUserNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.read(name); err != nil {
+		return err
+	}
+
+	return service.WriteFileAtomic(s.Location(name, PUBLIC_KEY_NAME), publicKey)
+}
+
+func (s *store) read(name string) (*User, error) {
+	b, err := ioutil.ReadFile(s.Location(name, USER_NAME))
+
+	if os.IsNotExist(err) {
+		return nil, ErrUserNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+
+	if err := msgpack.Unmarshal(b, &user); err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(s.Location(name, PRIVATE_KEY_NAME))
+	user.HasPrivateKey = err == nil
+
+	return &user, nil
+}
+
+func (s *store) write(user User) error {
+	b, err := msgpack.Marshal(&user)
+
+	if err != nil {
+		return err
+	}
+
+	return service.WriteFileAtomic(s.Location(user.Name, USER_NAME), b)
+}
@@ -0,0 +1,57 @@
+package users
+
+import "testing"
+
+func Test_it_should_create_disable_and_delete_users(t *testing.T) {
+	sut := NewStore(t.TempDir())
+
+	if err := sut.Create(User{Name: "alice", SrpSalt: []byte("salt"), SrpVerifier: []byte("verifier")}); err != nil {
+		t.Fatalf("User could not be created: %s", err)
+	}
+
+	if err := sut.Create(User{Name: "alice"}); err != ErrUserExists {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrUserExists)
+	}
+
+	if err := sut.StorePrivateKey("alice", []byte("private key")); err != nil {
+		t.Fatalf("Private key could not be stored: %s", err)
+	}
+
+	if err := sut.SetDisabled("alice", true); err != nil {
+		t.Fatalf("User could not be disabled: %s", err)
+	}
+
+	user, err := sut.Get("alice")
+
+	if err != nil {
+		t.Fatalf("User could not be read: %s", err)
+	}
+
+	if !user.Disabled || !user.HasPrivateKey || string(user.SrpVerifier) != "verifier" {
+		t.Errorf("User was incorrect, got: %+v", user)
+	}
+
+	if err := sut.Delete("alice"); err != nil {
+		t.Fatalf("User could not be deleted: %s", err)
+	}
+
+	if _, err := sut.PrivateKey("alice"); err != ErrPrivateKeyNotFound {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrPrivateKeyNotFound)
+	}
+
+	list, _ := sut.List()
+
+	if len(list) != 0 {
+		t.Errorf("Users were incorrect, got: %v, want: none", list)
+	}
+}
+
+func Test_it_should_reject_usernames_escaping_the_directory(t *testing.T) {
+	sut := NewStore(t.TempDir())
+
+	for _, name := range []string{"", "..", "../alice", "alice/bob", ".hidden"} {
+		if err := sut.Create(User{Name: name}); err != ErrInvalidUsername {
+			t.Errorf("Error of `%s` was incorrect, got: %v, want: %v", name, err, ErrInvalidUsername)
+		}
+	}
+}
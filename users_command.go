@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blueskan/harpocrates/server"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/blueskan/harpocrates/users"
+	"github.com/blueskan/harpocrates/vaults"
+	"github.com/spf13/cobra"
+)
+
+var usersDirectory string
+var vaultsDirectory string
+
+func usersCommand() *cobra.Command {
+	usersCmd := &cobra.Command{
+		Use:   "users",
+		Short: "Manage the user accounts of the server",
+	}
+
+	usersCmd.PersistentFlags().StringVar(&usersDirectory, "dir", "", "directory of the user accounts, defaults to users_dir of the server settings")
+	usersCmd.PersistentFlags().StringVar(&vaultsDirectory, "vaults-dir", "", "directory of the shared vaults, defaults to vaults_dir of the server settings")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the users",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			list, err := userStore().List()
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(list)
+				return
+			}
+
+			for _, user := range list {
+				status := "active"
+				if user.Disabled {
+					status = "disabled"
+				}
+
+				fmt.Printf("%s\t%s\t%s\n", user.Name, user.CreatedAt.Format("2006-01-02"), status)
+			}
+		},
+	}
+
+	listCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the users as JSON")
+
+	disableCmd := &cobra.Command{
+		Use:   "disable <username>",
+		Short: "Refuse the logins of a user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(userStore().SetDisabled(args[0], true))
+
+			fmt.Printf("User `%s` disabled\n", args[0])
+		},
+	}
+
+	enableCmd := &cobra.Command{
+		Use:   "enable <username>",
+		Short: "Accept the logins of a disabled user again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(userStore().SetDisabled(args[0], false))
+
+			fmt.Printf("User `%s` enabled\n", args[0])
+		},
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <username>",
+		Short: "Delete a user together with the escrowed private key and synced passwords",
+		Long:  "Delete a user together with the escrowed private key and synced passwords. The user is removed from every shared vault first, so a user registering the name again gets none of its roles, and the next admin opening such a vault replaces its data key.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store := userStore()
+
+			if _, err := store.Get(args[0]); err != nil {
+				exitOnError(err)
+			}
+
+			removed, err := vaultStore().RemoveMember(args[0])
+			exitOnError(err)
+
+			for _, vault := range removed {
+				if len(vault.Members) <= 0 {
+					fmt.Printf("Shared vault `%s` deleted, `%s` was its last member\n", vault.Name, args[0])
+				} else {
+					fmt.Printf("User `%s` removed from shared vault `%s`, an admin replaces its data key the next time the vault is opened\n", args[0], vault.Name)
+				}
+			}
+
+			exitOnError(store.Delete(args[0]))
+
+			fmt.Printf("User `%s` deleted\n", args[0])
+		},
+	}
+
+	usersCmd.AddCommand(listCmd, disableCmd, enableCmd, deleteCmd)
+
+	return usersCmd
+}
+
+func userStore() users.Store {
+	if len(usersDirectory) > 0 {
+		return users.NewStore(usersDirectory)
+	}
+
+	settings := server.ServerSettings(service.NewStorage("", settingsLocation, "server").ReadSettings(), nil)
+
+	return users.NewStore(settings[server.SETTING_USERS_DIR])
+}
+
+// vaultStore refuses to guess the shared vaults of users given by --dir.
+func vaultStore() vaults.Store {
+	if len(vaultsDirectory) > 0 {
+		return vaults.NewStore(vaultsDirectory)
+	}
+
+	if len(usersDirectory) > 0 {
+		exitOnError(errors.New("--vaults-dir is required with --dir, deleting a user also removes it from the shared vaults"))
+	}
+
+	settings := server.ServerSettings(service.NewStorage("", settingsLocation, "server").ReadSettings(), nil)
+
+	return vaults.NewStore(settings[server.SETTING_VAULTS_DIR])
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blueskan/harpocrates/cli"
+	"github.com/blueskan/harpocrates/server"
+	"github.com/blueskan/harpocrates/service"
+	"github.com/spf13/cobra"
+)
+
+func vaultCommand() *cobra.Command {
+	vaultCmd := &cobra.Command{
+		Use:   "vault",
+		Short: "Share passwords with other users of the server",
+	}
+
+	createCmd := &cobra.Command{
+		Use:   "create <vault>",
+		Short: "Create a shared vault, you are its owner",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			exitOnError(passwordService.CreateSharedVault(transport, args[0]))
+
+			fmt.Fprintf(os.Stderr, "Shared vault `%s` created\n", args[0])
+		},
+	}
+
+	lsCmd := &cobra.Command{
+		Use:   "ls [vault]",
+		Short: "List your shared vaults or the passwords of one",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			if len(args) <= 0 {
+				list, err := passwordService.SharedVaults(transport)
+				exitOnError(err)
+
+				if jsonOutput {
+					printJson(list)
+					return
+				}
+
+				for _, vault := range list {
+					fmt.Printf("%s\t%s\t%s\t%s\t%d\n", vault.Name, vault.Role, vault.Owner, strings.Join(vault.Members, ","), vault.Entries)
+
+					if vault.RekeyNeeded {
+						fmt.Fprintf(os.Stderr, "Shared vault `%s` still uses the data key of a deleted user, an admin replaces it with `harpocrates vault ls %s`\n", vault.Name, vault.Name)
+					}
+				}
+
+				return
+			}
+
+			passwords, err := passwordService.SharedPasswords(transport, args[0])
+			exitOnError(err)
+
+			if jsonOutput {
+				for _, password := range passwords {
+					password.Password = ""
+					password.Notes = ""
+					password.Fields = nil
+				}
+
+				printJson(passwords)
+				return
+			}
+
+			for _, password := range passwords {
+				fmt.Printf("%s\t%s\n", password.Name, password.Url)
+			}
+		},
+	}
+
+	lsCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the result as JSON")
+
+	getCmd := &cobra.Command{
+		Use:   "get <vault> <name>",
+		Short: "Print a password of a shared vault",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			password, err := passwordService.GetSharedPassword(transport, args[0], args[1])
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(password)
+				return
+			}
+
+			if password.Type == service.ENTRY_TYPE_NOTE && len(password.Password) <= 0 {
+				fmt.Println(password.Notes)
+				return
+			}
+
+			fmt.Println(password.Password)
+		},
+	}
+
+	getCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the password as JSON")
+
+	rmCmd := &cobra.Command{
+		Use:   "rm <vault> <name>",
+		Short: "Delete a password of a shared vault",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			exitOnError(passwordService.DeleteSharedPassword(transport, args[0], args[1]))
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` deleted from shared vault `%s`\n", args[1], args[0])
+		},
+	}
+
+	var role string
+
+	addMemberCmd := &cobra.Command{
+		Use:   "add-member <vault> <username>",
+		Short: "Give a user access to a shared vault",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			fingerprint, err := passwordService.AddSharedVaultMember(transport, args[0], args[1], role)
+			exitOnError(err)
+
+			fmt.Fprintf(os.Stderr, "User `%s` added to shared vault `%s` as %s\n", args[1], args[0], role)
+			fmt.Fprintf(os.Stderr, "Public key fingerprint of `%s`: %s\n", args[1], fingerprint)
+		},
+	}
+
+	addMemberCmd.Flags().StringVar(&role, "role", service.SHARED_VAULT_ROLE_READ_WRITE, "role of the member: "+strings.Join(service.SHARED_VAULT_ROLES, ", "))
+
+	roleCmd := &cobra.Command{
+		Use:   "role <vault> <username> <role>",
+		Short: "Change the role of a member: " + strings.Join(service.SHARED_VAULT_ROLES, ", "),
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			exitOnError(passwordService.SetSharedVaultRole(transport, args[0], args[1], args[2]))
+
+			fmt.Fprintf(os.Stderr, "User `%s` is %s in shared vault `%s`\n", args[1], args[2], args[0])
+		},
+	}
+
+	auditCmd := &cobra.Command{
+		Use:   "audit <vault>",
+		Short: "Show who changed the roles of a shared vault",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			changes, err := passwordService.SharedVaultAudit(transport, args[0])
+			exitOnError(err)
+
+			if jsonOutput {
+				printJson(changes)
+				return
+			}
+
+			for _, change := range changes {
+				role := change.Role
+
+				if len(role) <= 0 {
+					role = "removed"
+				}
+
+				fmt.Printf("%s\t%s\t%s\t%s\n", change.At.Format(time.RFC3339), change.By, change.Member, role)
+			}
+		},
+	}
+
+	auditCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the role changes as JSON")
+
+	removeMemberCmd := &cobra.Command{
+		Use:   "remove-member <vault> <username>",
+		Short: "Take the access of a user to a shared vault and replace its key",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			exitOnError(passwordService.RemoveSharedVaultMember(transport, args[0], args[1]))
+
+			fmt.Fprintf(os.Stderr, "User `%s` removed from shared vault `%s`, the vault has a new key\n", args[1], args[0])
+		},
+	}
+
+	var to string
+	var from string
+
+	moveCmd := &cobra.Command{
+		Use:   "move <name>",
+		Short: "Move a password into a shared vault with --to or out of one with --from",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if (len(to) > 0) == (len(from) > 0) {
+				exitOnError(fmt.Errorf("Either --to or --from is required"))
+			}
+
+			passwordService, transport := openSharedVaults(cli.NewCli())
+
+			if len(to) > 0 {
+				exitOnError(passwordService.MoveToSharedVault(transport, args[0], to))
+
+				fmt.Fprintf(os.Stderr, "Password named as `%s` moved to shared vault `%s`\n", args[0], to)
+				return
+			}
+
+			exitOnError(passwordService.MoveFromSharedVault(transport, from, args[0]))
+
+			fmt.Fprintf(os.Stderr, "Password named as `%s` moved from shared vault `%s` to your passwords\n", args[0], from)
+		},
+	}
+
+	moveCmd.Flags().StringVar(&to, "to", "", "shared vault to move the password to")
+	moveCmd.Flags().StringVar(&from, "from", "", "shared vault to move the password from")
+
+	vaultCmd.AddCommand(createCmd, lsCmd, getCmd, rmCmd, addMemberCmd, removeMemberCmd, roleCmd, auditCmd, moveCmd)
+
+	return vaultCmd
+}
+
+// openSharedVaults unlocks the passwords and keeps the master password for
+// the shared vault requests to the server.
+func openSharedVaults(harpocratesCli *cli.Cli) (*service.PasswordService, service.SharedVaultTransport) {
+	storageService := newStorage()
+
+	cryptoManager, pri, pub, password := unlock(harpocratesCli, storageService)
+
+	passwordService, err := service.NewPasswordService(cryptoManager, pri, pub, storageService)
+	exitOnError(err)
+
+	return passwordService, server.NewSharedVaultTransport(password, storageService.ReadSettings())
+}
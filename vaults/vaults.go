@@ -0,0 +1,391 @@
+package vaults
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blueskan/harpocrates/service"
+	"github.com/vmihailenco/msgpack"
+)
+
+const VAULT_EXTENSION = ".db"
+
+const DEFAULT_VAULTS_DIRECTORY_NAME = "harpocrates_vaults"
+
+// VAULTS_LOCK_NAME is the lock file in the directory of the shared vaults,
+// the server and `harpocrates users` take it to change a vault.
+const VAULTS_LOCK_NAME = ".lock"
+
+var ErrInvalidVaultName = errors.New("vault name should start with a letter or digit and contain only letters, digits, `.`, `_` and `-`")
+var ErrVaultExists = errors.New("shared vault already exists")
+var ErrVaultNotFound = errors.New("shared vault does not exist")
+
+var vaultNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Vault is a shared vault as the server keeps it. Members maps every member
+// to the data key of the vault wrapped with the public key of the member, the
+// entries are encrypted with the data key, so the server can read neither.
+// KeyVersion changes whenever the data key is replaced. Audit records the
+// role changes. RekeyNeeded is set when a deleted user was removed without a
+// re-key, the deleted user still knows the data key until an admin replaces
+// it.
+type Vault struct {
+	Name        string
+	Owner       string
+	KeyVersion  uint64
+	RekeyNeeded bool
+	Members     map[string][]byte
+	Roles       map[string]string
+	Revision    uint64
+	Entries     map[string]service.SyncEntry
+	Audit       []service.SharedVaultRoleChange
+	CreatedAt   time.Time
+}
+
+var roleLevels = map[string]int{
+	service.SHARED_VAULT_ROLE_READ_ONLY:  1,
+	service.SHARED_VAULT_ROLE_READ_WRITE: 2,
+	service.SHARED_VAULT_ROLE_ADMIN:      3,
+}
+
+// Role returns the role of a member. Members of vaults created before roles
+// existed could change the passwords, so they are read-write. The owner of a
+// vault is empty once the owner was deleted.
+func (v *Vault) Role(member string) string {
+	if _, ok := v.Members[member]; !ok || len(member) <= 0 {
+		return ""
+	}
+
+	if member == v.Owner {
+		return service.SHARED_VAULT_ROLE_ADMIN
+	}
+
+	if role, ok := v.Roles[member]; ok {
+		return role
+	}
+
+	return service.SHARED_VAULT_ROLE_READ_WRITE
+}
+
+// Allows tells whether the role of member includes role.
+func (v *Vault) Allows(member, role string) bool {
+	level, ok := roleLevels[v.Role(member)]
+
+	return ok && level >= roleLevels[role]
+}
+
+// SetRole changes the role of member and records the change, an empty role
+// removes the member.
+func (v *Vault) SetRole(by, member, role string) {
+	if v.Roles == nil {
+		v.Roles = make(map[string]string)
+	}
+
+	if len(role) > 0 {
+		v.Roles[member] = role
+	} else {
+		delete(v.Roles, member)
+	}
+
+	v.Audit = append(v.Audit, service.SharedVaultRoleChange{
+		At:     time.Now(),
+		By:     by,
+		Member: member,
+		Role:   role,
+	})
+}
+
+type Store interface {
+	Create(vault Vault) error
+	Get(name string) (*Vault, error)
+	List() ([]Vault, error)
+	// Update applies fn to the vault and writes it unless fn fails.
+	Update(name string, fn func(vault *Vault) error) error
+	Delete(name string) error
+	// RemoveMember drops a deleted user from every vault and returns the
+	// vaults it was a member of. Vaults left without members are deleted,
+	// the others need a re-key.
+	RemoveMember(member string) ([]Vault, error)
+}
+
+type store struct {
+	directory string
+	mutex     sync.Mutex
+}
+
+// NewStore returns the shared vaults kept in directory, an empty directory
+// means `harpocrates_vaults` in the home directory.
+func NewStore(directory string) Store {
+	if len(directory) <= 0 {
+		homeDir, _ := os.UserHomeDir()
+		directory = filepath.Join(homeDir, DEFAULT_VAULTS_DIRECTORY_NAME)
+	}
+
+	return &store{
+		directory: directory,
+	}
+}
+
+func ValidateVaultName(name string) error {
+	if !vaultNamePattern.MatchString(name) {
+		return ErrInvalidVaultName
+	}
+
+	return nil
+}
+
+func (s *store) Create(vault Vault) error {
+	if err := ValidateVaultName(vault.Name); err != nil {
+		return err
+	}
+
+	unlock, err := s.lock()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	if _, err := os.Stat(s.location(vault.Name)); err == nil {
+		return ErrVaultExists
+	}
+
+	if vault.Entries == nil {
+		vault.Entries = make(map[string]service.SyncEntry)
+	}
+
+	if vault.CreatedAt.IsZero() {
+		vault.CreatedAt = time.Now()
+	}
+
+	return s.write(&vault)
+}
+
+func (s *store) Get(name string) (*Vault, error) {
+	if err := ValidateVaultName(name); err != nil {
+		return nil, ErrVaultNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.read(name)
+}
+
+func (s *store) List() ([]Vault, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.list()
+}
+
+func (s *store) list() ([]Vault, error) {
+	entries, err := ioutil.ReadDir(s.directory)
+
+	if os.IsNotExist(err) {
+		return make([]Vault, 0), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Vault, 0, len(entries))
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), VAULT_EXTENSION)
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), VAULT_EXTENSION) || ValidateVaultName(name) != nil {
+			continue
+		}
+
+		vault, err := s.read(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, *vault)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+func (s *store) Update(name string, fn func(vault *Vault) error) error {
+	if err := ValidateVaultName(name); err != nil {
+		return ErrVaultNotFound
+	}
+
+	unlock, err := s.lock()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	vault, err := s.read(name)
+
+	if err != nil {
+		return err
+	}
+
+	if err := fn(vault); err != nil {
+		return err
+	}
+
+	return s.write(vault)
+}
+
+func (s *store) Delete(name string) error {
+	if err := ValidateVaultName(name); err != nil {
+		return ErrVaultNotFound
+	}
+
+	unlock, err := s.lock()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	err = os.Remove(s.location(name))
+
+	if os.IsNotExist(err) {
+		return ErrVaultNotFound
+	}
+
+	return err
+}
+
+// RemoveMember also takes the ownership away, a user registering the name
+// again must not inherit any role.
+func (s *store) RemoveMember(member string) ([]Vault, error) {
+	unlock, err := s.lock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	list, err := s.list()
+
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]Vault, 0)
+
+	for _, listed := range list {
+		vault, err := s.read(listed.Name)
+
+		if err != nil {
+			return removed, err
+		}
+
+		_, isMember := vault.Members[member]
+
+		if !isMember && vault.Owner != member {
+			continue
+		}
+
+		delete(vault.Members, member)
+		vault.SetRole("", member, "")
+
+		if vault.Owner == member {
+			vault.Owner = ""
+		}
+
+		vault.RekeyNeeded = true
+
+		if len(vault.Members) <= 0 {
+			err = os.Remove(s.location(vault.Name))
+		} else {
+			err = s.write(vault)
+		}
+
+		if err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, *vault)
+	}
+
+	return removed, nil
+}
+
+// lock takes the lock of the directory, which the server shares with the
+// commands changing the vaults, the returned function releases it.
+func (s *store) lock() (func() error, error) {
+	s.mutex.Lock()
+
+	if err := os.MkdirAll(s.directory, 0700); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+
+	unlock, err := service.LockFile(filepath.Join(s.directory, VAULTS_LOCK_NAME))
+
+	if err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+
+	return func() error {
+		defer s.mutex.Unlock()
+
+		return unlock()
+	}, nil
+}
+
+func (s *store) location(name string) string {
+	return filepath.Join(s.directory, name+VAULT_EXTENSION)
+}
+
+func (s *store) read(name string) (*Vault, error) {
+	b, err := ioutil.ReadFile(s.location(name))
+
+	if os.IsNotExist(err) {
+		return nil, ErrVaultNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var vault Vault
+
+	if err := msgpack.Unmarshal(b, &vault); err != nil {
+		return nil, err
+	}
+
+	if vault.Entries == nil {
+		vault.Entries = make(map[string]service.SyncEntry)
+	}
+
+	return &vault, nil
+}
+
+func (s *store) write(vault *Vault) error {
+	b, err := msgpack.Marshal(vault)
+
+	if err != nil {
+		return err
+	}
+
+	return service.WriteFileAtomic(s.location(vault.Name), b)
+}